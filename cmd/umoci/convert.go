@@ -0,0 +1,119 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/cas"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var convertCommand = uxCompress(uxTag(cli.Command{
+	Name:  "convert",
+	Usage: "recompresses the layers of an image",
+	ArgsUsage: `--image <image-path>[:<tag>] [--tag <new-tag>]
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tag of the image to convert and "<new-tag>" is the name of the tag that the
+converted image will be saved as (if not specified, defaults to "<tag>").
+
+Every layer of the image is rewritten using the compression algorithm given
+with --compress (one of "none", "gzip" or "zstd", defaulting to "gzip") at the
+level given with --compress-level. The uncompressed contents of each layer are
+verified against the image configuration, which is not modified.`,
+
+	// convert modifies an image.
+	Category: "image",
+
+	Action: convert,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		return nil
+	},
+}))
+
+func convert(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+	compressor := ctx.App.Metadata["--compress"].(mutate.Compressor)
+
+	tagName := fromName
+	if val, ok := ctx.App.Metadata["--tag"]; ok {
+		tagName = val.(string)
+	}
+
+	// Get a reference to the CAS.
+	engine, err := cas.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	defer engine.Close()
+
+	fromDescriptor, err := engine.GetReference(context.Background(), fromName)
+	if err != nil {
+		return errors.Wrap(err, "get from reference")
+	}
+
+	// FIXME: Implement support for manifest lists.
+	if fromDescriptor.MediaType != ispec.MediaTypeImageManifest {
+		return errors.Wrap(fmt.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", fromDescriptor.MediaType), "invalid from descriptor")
+	}
+
+	mutator, err := mutate.New(engine, fromDescriptor)
+	if err != nil {
+		return errors.Wrap(err, "create mutator for image")
+	}
+
+	if err := mutator.Recompress(context.Background(), compressor); err != nil {
+		return errors.Wrap(err, "recompress layers")
+	}
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "commit mutated image")
+	}
+
+	log.Infof("new image manifest created: %s", newDescriptor.Digest)
+
+	err = engine.PutReference(context.Background(), tagName, newDescriptor)
+	if err == cas.ErrClobber {
+		// We have to clobber a tag.
+		log.Warnf("clobbering existing tag: %s", tagName)
+
+		// Delete the old tag.
+		if err := engine.DeleteReference(context.Background(), tagName); err != nil {
+			return errors.Wrap(err, "delete old tag")
+		}
+		err = engine.PutReference(context.Background(), tagName, newDescriptor)
+	}
+	if err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.Infof("created new tag for image manifest: %s", tagName)
+	return nil
+}
@@ -0,0 +1,229 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/idtools"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var exportCommand = cli.Command{
+	Name:  "export",
+	Usage: "writes the flattened root filesystem of an image as a tar archive",
+	ArgsUsage: `--image <image-path>[:<tag>] [--output <file>]
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tagged image to export (if not specified, defaults to "latest") and "<file>" is
+the path the archive is written to (if not specified, the archive is written
+to stdout).
+
+The layers of the image are merged (with all whiteouts applied) as they are
+read, so neither root privileges nor disk space for the root filesystem are
+required. The archive is compressed with the algorithm given with --compress
+(one of "none", "gzip" or "zstd", defaulting to "none").`,
+
+	// export reads manifest information.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "output, o",
+			Usage: "path to write the archive to (defaults to stdout)",
+		},
+		cli.StringFlag{
+			Name:  "compress",
+			Usage: "compression algorithm for the archive (none, gzip, zstd)",
+			Value: "none",
+		},
+		cli.IntFlag{
+			Name:  "compress-level",
+			Usage: "compression level for the archive (0 is the algorithm's default)",
+		},
+		cli.StringSliceFlag{
+			Name:  "uid-map",
+			Usage: "specifies a uid mapping to apply to the archive",
+		},
+		cli.StringSliceFlag{
+			Name:  "gid-map",
+			Usage: "specifies a gid mapping to apply to the archive",
+		},
+		cli.StringSliceFlag{
+			Name:  "include",
+			Usage: "only export paths matching the given glob (and their parent directories)",
+		},
+		cli.StringSliceFlag{
+			Name:  "exclude",
+			Usage: "do not export paths matching the given glob",
+		},
+	},
+
+	Action: export,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if ctx.IsSet("output") && ctx.String("output") == "" {
+			return errors.Errorf("output path cannot be empty")
+		}
+		return nil
+	},
+}
+
+func export(ctx *cli.Context) (Err error) {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+	outputPath := ctx.String("output")
+
+	compressor, err := parseCompressor(ctx.String("compress"), ctx.Int("compress-level"))
+	if err != nil {
+		return errors.Wrap(err, "invalid --compress")
+	}
+
+	var unpackOptions layer.UnpackOptions
+	for _, uidmap := range ctx.StringSlice("uid-map") {
+		idMap, err := idtools.ParseMapping(uidmap)
+		if err != nil {
+			return errors.Wrapf(err, "failure parsing --uid-map %s", uidmap)
+		}
+		unpackOptions.MapOptions.UIDMappings = append(unpackOptions.MapOptions.UIDMappings, idMap)
+	}
+	for _, gidmap := range ctx.StringSlice("gid-map") {
+		idMap, err := idtools.ParseMapping(gidmap)
+		if err != nil {
+			return errors.Wrapf(err, "failure parsing --gid-map %s", gidmap)
+		}
+		unpackOptions.MapOptions.GIDMappings = append(unpackOptions.MapOptions.GIDMappings, idMap)
+	}
+	for _, filter := range ctx.StringSlice("include") {
+		unpackOptions.Filters.Include = append(unpackOptions.Filters.Include, filepath.Clean(filter))
+	}
+	for _, filter := range ctx.StringSlice("exclude") {
+		unpackOptions.Filters.Exclude = append(unpackOptions.Filters.Exclude, filepath.Clean(filter))
+	}
+	if err := unpackOptions.Filters.Validate(); err != nil {
+		return errors.Wrap(err, "invalid --include or --exclude")
+	}
+
+	log.WithFields(log.Fields{
+		"map.uid": unpackOptions.MapOptions.UIDMappings,
+		"map.gid": unpackOptions.MapOptions.GIDMappings,
+		"include": unpackOptions.Filters.Include,
+		"exclude": unpackOptions.Filters.Exclude,
+	}).Debugf("parsed mappings and path filters")
+
+	// Get a reference to the CAS.
+	engine, err := cas.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.Engine{engine}
+	defer engine.Close()
+
+	fromDescriptor, err := engineExt.GetReference(context.Background(), fromName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+
+	manifestBlob, err := engineExt.FromDescriptor(context.Background(), fromDescriptor)
+	if err != nil {
+		return errors.Wrap(err, "get manifest")
+	}
+	defer manifestBlob.Close()
+
+	// FIXME: Implement support for manifest lists.
+	if manifestBlob.MediaType != ispec.MediaTypeImageManifest {
+		return errors.Wrap(fmt.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", fromDescriptor.MediaType), "invalid --image tag")
+	}
+
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		// Should _never_ be reached.
+		return errors.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.MediaType)
+	}
+
+	// The archive is written to a temporary file next to the output path,
+	// which is only moved into place once it is complete.
+	var output io.Writer = os.Stdout
+	if outputPath != "" {
+		fh, err := ioutil.TempFile(filepath.Dir(outputPath), ".umoci-export-"+filepath.Base(outputPath)+"-")
+		if err != nil {
+			return errors.Wrap(err, "create output")
+		}
+		defer func() {
+			fh.Close()
+			if Err != nil {
+				os.Remove(fh.Name())
+			}
+		}()
+		if err := fh.Chmod(0644); err != nil {
+			return errors.Wrap(err, "chmod output")
+		}
+		output = fh
+	}
+
+	log.WithFields(log.Fields{
+		"image":  imagePath,
+		"ref":    fromName,
+		"output": outputPath,
+	}).Debugf("umoci: exporting OCI image")
+
+	// ExportManifest writes the archive, but compressors only provide a
+	// reader for the compressed stream.
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		pipeWriter.CloseWithError(layer.ExportManifest(context.Background(), engineExt, pipeWriter, manifest, &unpackOptions))
+	}()
+	defer pipeReader.Close()
+
+	compressed, err := compressor.Compress(pipeReader)
+	if err != nil {
+		return errors.Wrap(err, "compress archive")
+	}
+	defer compressed.Close()
+
+	log.Info("exporting image ...")
+	if _, err := io.Copy(output, compressed); err != nil {
+		return errors.Wrap(err, "export image")
+	}
+	log.Info("... done")
+
+	if fh, ok := output.(*os.File); ok && outputPath != "" {
+		if err := fh.Close(); err != nil {
+			return errors.Wrap(err, "close output")
+		}
+		if err := os.Rename(fh.Name(), outputPath); err != nil {
+			return errors.Wrap(err, "move output into place")
+		}
+		log.Infof("exported image: %s", outputPath)
+	}
+	return nil
+}
@@ -0,0 +1,260 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/cas"
+	igen "github.com/openSUSE/umoci/oci/config/generate"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/idtools"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var insertCommand = uxCompress(uxHistory(uxTag(cli.Command{
+	Name:  "insert",
+	Usage: "adds a file or directory to an image as a new layer",
+	ArgsUsage: `--image <image-path>[:<tag>] [--tag <new-tag>] <source> <target>
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tag of the image to modify, "<new-tag>" is the name of the tag that the new
+image will be saved as (if not specified, defaults to "<tag>"), "<source>" is
+the file or directory on the host to add and "<target>" is the path it will
+have inside the image.
+
+If "<source>" is "-", a tar archive is read from stdin and its entries are
+added under the directory "<target>" instead.
+
+The new layer is generated directly from "<source>", so the image does not
+have to be unpacked. The owners of the added files are mapped into the image
+using --uid-map and --gid-map (in the same way as umoci-repack(1)), and can be
+overridden with --uid and --gid. The new layer is compressed using the
+algorithm given with --compress (one of "none", "gzip" or "zstd", defaulting
+to "gzip") at the level given with --compress-level.`,
+
+	// insert modifies an image.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "uid-map",
+			Usage: "specifies a uid mapping to use when generating the layer",
+		},
+		cli.StringSliceFlag{
+			Name:  "gid-map",
+			Usage: "specifies a gid mapping to use when generating the layer",
+		},
+		cli.BoolFlag{
+			Name:  "rootless",
+			Usage: "enable rootless layer generation support",
+		},
+		cli.IntFlag{
+			Name:  "uid",
+			Usage: "owner (in the image) of every added path",
+		},
+		cli.IntFlag{
+			Name:  "gid",
+			Usage: "group (in the image) of every added path",
+		},
+	},
+
+	Action: insert,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 2 {
+			return errors.Errorf("invalid number of positional arguments: expected <source> <target>")
+		}
+		if ctx.Args().Get(0) == "" {
+			return errors.Errorf("source path cannot be empty")
+		}
+		if ctx.Args().Get(1) == "" {
+			return errors.Errorf("target path cannot be empty")
+		}
+		ctx.App.Metadata["source"] = ctx.Args().Get(0)
+		ctx.App.Metadata["target"] = ctx.Args().Get(1)
+		return nil
+	},
+})))
+
+func insert(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+	sourcePath := ctx.App.Metadata["source"].(string)
+	targetPath := ctx.App.Metadata["target"].(string)
+
+	tagName := fromName
+	if val, ok := ctx.App.Metadata["--tag"]; ok {
+		tagName = val.(string)
+	}
+
+	// Parse map options.
+	// We need to set mappings if we're in rootless mode.
+	var insertOptions layer.InsertOptions
+	insertOptions.MapOptions.Rootless = ctx.Bool("rootless")
+	if insertOptions.MapOptions.Rootless {
+		if !ctx.IsSet("uid-map") {
+			ctx.Set("uid-map", fmt.Sprintf("%d:0:1", os.Geteuid()))
+		}
+		if !ctx.IsSet("gid-map") {
+			ctx.Set("gid-map", fmt.Sprintf("%d:0:1", os.Getegid()))
+		}
+	}
+	for _, uidmap := range ctx.StringSlice("uid-map") {
+		idMap, err := idtools.ParseMapping(uidmap)
+		if err != nil {
+			return errors.Wrapf(err, "failure parsing --uid-map %s", uidmap)
+		}
+		insertOptions.MapOptions.UIDMappings = append(insertOptions.MapOptions.UIDMappings, idMap)
+	}
+	for _, gidmap := range ctx.StringSlice("gid-map") {
+		idMap, err := idtools.ParseMapping(gidmap)
+		if err != nil {
+			return errors.Wrapf(err, "failure parsing --gid-map %s", gidmap)
+		}
+		insertOptions.MapOptions.GIDMappings = append(insertOptions.MapOptions.GIDMappings, idMap)
+	}
+
+	// Parse the ownership overrides.
+	if ctx.IsSet("uid") {
+		uid := ctx.Int("uid")
+		if uid < 0 {
+			return errors.Errorf("invalid --uid: %d", uid)
+		}
+		insertOptions.UID = &uid
+	}
+	if ctx.IsSet("gid") {
+		gid := ctx.Int("gid")
+		if gid < 0 {
+			return errors.Errorf("invalid --gid: %d", gid)
+		}
+		insertOptions.GID = &gid
+	}
+
+	log.WithFields(log.Fields{
+		"map.uid": insertOptions.MapOptions.UIDMappings,
+		"map.gid": insertOptions.MapOptions.GIDMappings,
+	}).Debugf("parsed mappings")
+
+	// Get a reference to the CAS.
+	engine, err := cas.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	defer engine.Close()
+
+	fromDescriptor, err := engine.GetReference(context.Background(), fromName)
+	if err != nil {
+		return errors.Wrap(err, "get from reference")
+	}
+
+	// FIXME: Implement support for manifest lists.
+	if fromDescriptor.MediaType != ispec.MediaTypeImageManifest {
+		return errors.Wrap(fmt.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", fromDescriptor.MediaType), "invalid from descriptor")
+	}
+
+	mutator, err := mutate.New(engine, fromDescriptor)
+	if err != nil {
+		return errors.Wrap(err, "create mutator for image")
+	}
+
+	var reader io.ReadCloser
+	if sourcePath == "-" {
+		log.Infof("inserting tar archive from stdin at %s", targetPath)
+		reader, err = layer.GenerateInsertTarLayer(os.Stdin, targetPath, &insertOptions)
+	} else {
+		if _, err := os.Lstat(sourcePath); err != nil {
+			return errors.Wrap(err, "stat source")
+		}
+		log.Infof("inserting %s at %s", sourcePath, targetPath)
+		reader, err = layer.GenerateInsertLayer(sourcePath, targetPath, &insertOptions)
+	}
+	if err != nil {
+		return errors.Wrap(err, "generate insert layer")
+	}
+	defer reader.Close()
+
+	imageMeta, err := mutator.Meta(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "get image metadata")
+	}
+
+	history := ispec.History{
+		Author:     imageMeta.Author,
+		Comment:    "",
+		Created:    time.Now(),
+		CreatedBy:  "umoci insert",
+		EmptyLayer: false,
+	}
+
+	if val, ok := ctx.App.Metadata["--history.author"]; ok {
+		history.Author = val.(string)
+	}
+	if val, ok := ctx.App.Metadata["--history.comment"]; ok {
+		history.Comment = val.(string)
+	}
+	if val, ok := ctx.App.Metadata["--history.created"]; ok {
+		created, err := time.Parse(igen.ISO8601, val.(string))
+		if err != nil {
+			return errors.Wrap(err, "parsing --history.created")
+		}
+		history.Created = created
+	}
+	if val, ok := ctx.App.Metadata["--history.created_by"]; ok {
+		history.CreatedBy = val.(string)
+	}
+
+	if err := mutator.Add(context.Background(), reader, history, &mutate.AddOptions{
+		Compressor: ctx.App.Metadata["--compress"].(mutate.Compressor),
+		Progress:   progressReporterFrom(ctx),
+	}); err != nil {
+		return errors.Wrap(err, "add insert layer")
+	}
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "commit mutated image")
+	}
+
+	log.Infof("new image manifest created: %s", newDescriptor.Digest)
+
+	err = engine.PutReference(context.Background(), tagName, newDescriptor)
+	if err == cas.ErrClobber {
+		// We have to clobber a tag.
+		log.Warnf("clobbering existing tag: %s", tagName)
+
+		// Delete the old tag.
+		if err := engine.DeleteReference(context.Background(), tagName); err != nil {
+			return errors.Wrap(err, "delete old tag")
+		}
+		err = engine.PutReference(context.Background(), tagName, newDescriptor)
+	}
+	if err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.Infof("created new tag for image manifest: %s", tagName)
+	return nil
+}
@@ -77,6 +77,12 @@ func main() {
 			Usage: "set the log level (debug, info, [warn], error, fatal)",
 			Value: "warn",
 		},
+		cli.StringFlag{
+			Name:   "progress",
+			Usage:  "set how progress is reported ([auto], tty, json, none)",
+			Value:  "auto",
+			EnvVar: "UMOCI_PROGRESS",
+		},
 	}
 
 	app.Before = func(ctx *cli.Context) error {
@@ -99,6 +105,20 @@ func main() {
 		if level == log.DebugLevel {
 			errors.Debug(true)
 		}
+
+		reporter, err := parseProgress(ctx.GlobalString("progress"), os.Stderr)
+		if err != nil {
+			return errors.Wrap(err, "parsing --progress")
+		}
+		ctx.App.Metadata["--progress"] = reporter
+		return nil
+	}
+
+	app.After = func(ctx *cli.Context) error {
+		// Make sure that any unfinished progress display is terminated.
+		if reporter, ok := ctx.App.Metadata["--progress"].(progressReporter); ok {
+			return reporter.Close()
+		}
 		return nil
 	}
 
@@ -106,6 +126,10 @@ func main() {
 		configCommand,
 		unpackCommand,
 		repackCommand,
+		convertCommand,
+		squashCommand,
+		insertCommand,
+		exportCommand,
 		gcCommand,
 		initCommand,
 		newCommand,
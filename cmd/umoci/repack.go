@@ -18,9 +18,12 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
 	"time"
 
@@ -28,16 +31,18 @@ import (
 	"github.com/openSUSE/umoci"
 	"github.com/openSUSE/umoci/mutate"
 	"github.com/openSUSE/umoci/oci/cas"
+	iconv "github.com/openSUSE/umoci/oci/config/convert"
 	igen "github.com/openSUSE/umoci/oci/config/generate"
 	"github.com/openSUSE/umoci/oci/layer"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 	"github.com/vbatts/go-mtree"
 	"golang.org/x/net/context"
 )
 
-var repackCommand = uxHistory(cli.Command{
+var repackCommand = uxCompress(uxHistory(cli.Command{
 	Name:  "repack",
 	Usage: "repacks an OCI runtime bundle into a reference",
 	ArgsUsage: `--image <image-path>[:<new-tag>] <bundle>
@@ -59,11 +64,76 @@ new layer.
 It should be noted that this is not the same as oci-create-layer because it
 uses go-mtree to create diff layers from runtime bundles unpacked with
 umoci-unpack(1). In addition, it modifies the image so that all of the relevant
-manifest and configuration information uses the new diff atop the old manifest.`,
+manifest and configuration information uses the new diff atop the old manifest.
+
+The new layer is compressed using the algorithm given with --compress (one of
+"none", "gzip" or "zstd", defaulting to "gzip") at the level given with
+--compress-level.
+
+If --clamp-mtime is given (or the SOURCE_DATE_EPOCH environment variable is
+set) the layer is generated reproducibly, so that repacking the same changes
+results in the same layer. The mtimes of files are clamped to the given time,
+which is also used for whiteouts and the new history entry.
+
+Changes to paths given with --mask-path (and any paths listed in "mask_paths"
+in the bundle's umoci.json) are not included in the new layer. This applies to
+both modifications and deletions of the masked paths and anything inside
+them.
+
+Only the xattrs which pass the xattr filters used to unpack the bundle (see
+umoci-unpack(1)) are included in the new layer. Additional filters can be given
+with --xattr-include and --xattr-exclude, which only apply to this repack.
+
+To find out which files have been modified, only files whose inode number,
+size, modification time or change time differ from when the bundle was
+unpacked are hashed. If --paranoid is specified, every file is hashed instead.
+
+Once the new image has been created, the bundle is updated to refer to it
+(its mtree manifest and "<bundle>/umoci.json" are replaced), so that a later
+umoci-repack(1) of the same bundle only includes the changes made since this
+one. If --no-update-bundle is specified, the bundle is left referring to the
+image it was unpacked from, and every later umoci-repack(1) will include all of
+the changes made since it was unpacked.
+
+If --refresh-config is specified, changes made to the bundle's config.json are
+applied to the image configuration as well (with a separate history entry).
+Only changes to the process's environment, working directory, arguments, uid
+and gid, and to the annotations (which are converted to labels) are applied.`,
 
 	// repack creates a new image, with a given tag.
 	Category: "image",
 
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "clamp-mtime",
+			Usage: "generate a reproducible layer, clamping mtimes to the given ISO-8601 time (defaults to $SOURCE_DATE_EPOCH)",
+		},
+		cli.StringSliceFlag{
+			Name:  "mask-path",
+			Usage: "do not include changes to paths matching the given glob in the new layer",
+		},
+		cli.StringSliceFlag{
+			Name:  "xattr-include",
+			Usage: "also include xattrs which are excluded by default (such as security.selinux) if they match the given glob",
+		},
+		cli.StringSliceFlag{
+			Name:  "xattr-exclude",
+			Usage: "do not include xattrs whose names match the given glob in the new layer",
+		},
+		cli.BoolFlag{
+			Name:  "refresh-config",
+			Usage: "update the image configuration with changes made to the bundle's config.json",
+		},
+		cli.BoolFlag{
+			Name:  "no-update-bundle",
+			Usage: "do not update the bundle to refer to the new image",
+		},
+		cli.BoolFlag{
+			Name:  "paranoid",
+			Usage: "hash every file to find changes (rather than only files whose stat data changed)",
+		},
+	},
+
 	Action: repack,
 
 	Before: func(ctx *cli.Context) error {
@@ -74,9 +144,38 @@ manifest and configuration information uses the new diff atop the old manifest.`
 			return errors.Errorf("bundle path cannot be empty")
 		}
 		ctx.App.Metadata["bundle"] = ctx.Args().First()
+
+		clampMtime, ok, err := parseClampMtime(ctx.String("clamp-mtime"), os.Getenv("SOURCE_DATE_EPOCH"))
+		if err != nil {
+			return err
+		}
+		if ok {
+			ctx.App.Metadata["--clamp-mtime"] = clampMtime
+		}
 		return nil
 	},
-})
+}))
+
+// parseClampMtime returns the time given with --clamp-mtime (an ISO-8601
+// time) or, if that wasn't given, SOURCE_DATE_EPOCH (in seconds since the
+// epoch). The returned bool is false if neither is set.
+func parseClampMtime(flag, sourceDateEpoch string) (time.Time, bool, error) {
+	if flag != "" {
+		clampMtime, err := time.Parse(igen.ISO8601, flag)
+		if err != nil {
+			return time.Time{}, false, errors.Wrap(err, "parsing --clamp-mtime")
+		}
+		return clampMtime, true, nil
+	}
+	if sourceDateEpoch != "" {
+		seconds, err := strconv.ParseInt(sourceDateEpoch, 10, 64)
+		if err != nil {
+			return time.Time{}, false, errors.Wrap(err, "parsing SOURCE_DATE_EPOCH")
+		}
+		return time.Unix(seconds, 0).UTC(), true, nil
+	}
+	return time.Time{}, false, nil
+}
 
 func repack(ctx *cli.Context) error {
 	imagePath := ctx.App.Metadata["--image-path"].(string)
@@ -115,6 +214,7 @@ func repack(ctx *cli.Context) error {
 
 	mtreeName := strings.Replace(meta.From.Digest.String(), "sha256:", "sha256_", 1)
 	mtreePath := filepath.Join(bundlePath, mtreeName+".mtree")
+	statCachePath := filepath.Join(bundlePath, mtreeName+StatCacheSuffix)
 	fullRootfsPath := filepath.Join(bundlePath, layer.RootfsName)
 
 	log.WithFields(log.Fields{
@@ -144,8 +244,44 @@ func repack(ctx *cli.Context) error {
 		fsEval = umoci.RootlessFsEval
 	}
 
+	// Parse the masked paths. They're validated in the same way as path
+	// filters, because they use the same format.
+	maskPaths := meta.MaskPaths
+	for _, mask := range ctx.StringSlice("mask-path") {
+		maskPaths = append(maskPaths, filepath.Clean(mask))
+	}
+	if err := (layer.PathFilters{Exclude: maskPaths}).Validate(); err != nil {
+		return errors.Wrap(err, "invalid --mask-path")
+	}
+
+	// Parse the xattr filters, which are added to the ones used to unpack the
+	// bundle.
+	xattrs := meta.Xattrs
+	xattrs.Include = append(xattrs.Include, ctx.StringSlice("xattr-include")...)
+	xattrs.Exclude = append(xattrs.Exclude, ctx.StringSlice("xattr-exclude")...)
+	if err := xattrs.Validate(); err != nil {
+		return errors.Wrap(err, "invalid --xattr-include or --xattr-exclude")
+	}
+
+	// Unless --no-update-bundle was given, the bundle is updated to refer to
+	// the new image once it has been created. The new stat cache has to be
+	// generated before the rootfs is walked, so that any file modified during
+	// the walk is hashed again by the next umoci-repack(1).
+	updateBundle := !ctx.Bool("no-update-bundle")
+
 	log.Info("computing filesystem diff ...")
-	diffs, err := mtree.Check(fullRootfsPath, spec, MtreeKeywords, fsEval)
+	var newStatCache *layer.StatCache
+	if updateBundle {
+		newStatCache, err = layer.GenerateStatCache(fullRootfsPath, fsEval)
+		if err != nil {
+			return errors.Wrap(err, "generate stat cache")
+		}
+	}
+	newSpec, err := walkBundle(fullRootfsPath, spec, statCachePath, ctx.Bool("paranoid"), fsEval)
+	if err != nil {
+		return errors.Wrap(err, "walk rootfs")
+	}
+	diffs, err := mtree.Compare(spec, newSpec, MtreeKeywords)
 	if err != nil {
 		return errors.Wrap(err, "check mtree")
 	}
@@ -155,7 +291,23 @@ func repack(ctx *cli.Context) error {
 		"ndiff": len(diffs),
 	}).Debugf("umoci: checked mtree spec")
 
-	reader, err := layer.GenerateLayer(fullRootfsPath, diffs, &meta.MapOptions)
+	repackOptions := &layer.RepackOptions{
+		MapOptions: meta.MapOptions,
+		Filters:    meta.Filters,
+		Xattrs:     xattrs,
+		MaskPaths:  maskPaths,
+		Progress:   progressReporterFrom(ctx),
+	}
+	clampMtime, reproducible := ctx.App.Metadata["--clamp-mtime"].(time.Time)
+	if reproducible {
+		log.WithFields(log.Fields{
+			"clamp_mtime": clampMtime,
+		}).Debugf("umoci: generating reproducible layer")
+		repackOptions.Reproducible = true
+		repackOptions.ClampMtime = clampMtime
+	}
+
+	reader, err := layer.GenerateLayer(fullRootfsPath, diffs, repackOptions)
 	if err != nil {
 		return errors.Wrap(err, "generate diff layer")
 	}
@@ -173,6 +325,9 @@ func repack(ctx *cli.Context) error {
 		CreatedBy:  "umoci config", // XXX: Should we append argv to this?
 		EmptyLayer: false,
 	}
+	if reproducible {
+		history.Created = clampMtime
+	}
 
 	if val, ok := ctx.App.Metadata["--history.author"]; ok {
 		history.Author = val.(string)
@@ -193,10 +348,24 @@ func repack(ctx *cli.Context) error {
 
 	// TODO: We should add a flag to allow for a new layer to be made
 	//       non-distributable.
-	if err := mutator.Add(context.Background(), reader, history); err != nil {
+	if err := mutator.Add(context.Background(), reader, history, &mutate.AddOptions{
+		Compressor: ctx.App.Metadata["--compress"].(mutate.Compressor),
+		Progress:   progressReporterFrom(ctx),
+	}); err != nil {
 		return errors.Wrap(err, "add diff layer")
 	}
 
+	if ctx.Bool("refresh-config") {
+		configHistory := history
+		configHistory.CreatedBy = "umoci repack --refresh-config"
+		if val, ok := ctx.App.Metadata["--history.created_by"]; ok {
+			configHistory.CreatedBy = val.(string)
+		}
+		if err := refreshConfig(mutator, bundlePath, configHistory); err != nil {
+			return errors.Wrap(err, "refresh image configuration")
+		}
+	}
+
 	newDescriptor, err := mutator.Commit(context.Background())
 	if err != nil {
 		return errors.Wrap(err, "commit mutated image")
@@ -220,5 +389,117 @@ func repack(ctx *cli.Context) error {
 	}
 
 	log.Infof("created new tag for image manifest: %s", tagName)
+
+	if updateBundle {
+		meta.From = newDescriptor
+		if err := updateBundleMeta(bundlePath, meta, mtreePath, statCachePath, newSpec, newStatCache); err != nil {
+			return errors.Wrap(err, "update bundle")
+		}
+		log.Infof("updated bundle to refer to new image manifest: %s", bundlePath)
+	}
+	return nil
+}
+
+// updateBundleMeta updates a bundle to refer to the image manifest in
+// meta.From, by writing the given mtree manifest and stat cache for it and
+// updating umoci.json. The old mtree manifest and stat cache are then
+// removed.
+func updateBundleMeta(bundlePath string, meta UmociMeta, oldMtreePath, oldStatCachePath string, spec *mtree.DirectoryHierarchy, statCache *layer.StatCache) error {
+	mtreeName := strings.Replace(meta.From.Digest.String(), "sha256:", "sha256_", 1)
+	mtreePath := filepath.Join(bundlePath, mtreeName+".mtree")
+	statCachePath := filepath.Join(bundlePath, mtreeName+StatCacheSuffix)
+
+	log.WithFields(log.Fields{
+		"from":  meta.From,
+		"mtree": mtreePath,
+	}).Debugf("umoci: updating bundle metadata")
+
+	fh, err := os.Create(mtreePath)
+	if err != nil {
+		return errors.Wrap(err, "create mtree")
+	}
+	defer fh.Close()
+
+	if _, err := spec.WriteTo(fh); err != nil {
+		return errors.Wrap(err, "write mtree")
+	}
+	if err := fh.Close(); err != nil {
+		return errors.Wrap(err, "close mtree")
+	}
+	if err := WriteStatCache(statCachePath, statCache); err != nil {
+		return errors.Wrap(err, "write stat cache")
+	}
+
+	// umoci.json is only updated once the new mtree manifest is in place, so
+	// that the bundle is always usable.
+	if err := WriteBundleMeta(bundlePath, meta); err != nil {
+		return errors.Wrap(err, "write umoci.json metadata")
+	}
+
+	if oldMtreePath != mtreePath {
+		if err := os.Remove(oldMtreePath); err != nil {
+			return errors.Wrap(err, "remove old mtree")
+		}
+	}
+	if oldStatCachePath != statCachePath {
+		if err := os.Remove(oldStatCachePath); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "remove old stat cache")
+		}
+	}
 	return nil
 }
+
+// refreshConfig applies the changes made to the config.json of the bundle
+// (since it was generated by umoci-unpack(1)) to the image configuration of
+// the mutator, using the given history entry. Nothing is changed if
+// config.json hasn't been modified.
+func refreshConfig(mutator *mutate.Mutator, bundlePath string, history ispec.History) error {
+	fh, err := os.Open(filepath.Join(bundlePath, "config.json"))
+	if err != nil {
+		return errors.Wrap(err, "open config.json")
+	}
+	defer fh.Close()
+
+	var spec rspec.Spec
+	if err := json.NewDecoder(fh).Decode(&spec); err != nil {
+		return errors.Wrap(err, "parse config.json")
+	}
+
+	config, err := mutator.Config(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "get image config")
+	}
+	meta, err := mutator.Meta(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "get image metadata")
+	}
+	manifest, err := mutator.Manifest(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "get image manifest")
+	}
+
+	image := ispec.Image{
+		Architecture: meta.Architecture,
+		OS:           meta.OS,
+		Config:       config,
+	}
+	newConfig, err := iconv.ToImageConfig(spec, filepath.Join(bundlePath, layer.RootfsName), image, manifest)
+	if err != nil {
+		return errors.Wrap(err, "convert config.json")
+	}
+	if reflect.DeepEqual(newConfig, config) {
+		log.Info("config.json has not been modified")
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"workingdir": newConfig.WorkingDir,
+		"env":        newConfig.Env,
+		"entrypoint": newConfig.Entrypoint,
+		"cmd":        newConfig.Cmd,
+		"user":       newConfig.User,
+		"labels":     newConfig.Labels,
+	}).Debugf("umoci: refreshing image config")
+
+	return errors.Wrap(mutator.Set(context.Background(), newConfig, meta, manifest.Annotations, history), "set image config")
+}
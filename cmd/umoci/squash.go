@@ -0,0 +1,212 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/cas"
+	igen "github.com/openSUSE/umoci/oci/config/generate"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var squashCommand = uxCompress(uxHistory(uxTag(cli.Command{
+	Name:  "squash",
+	Usage: "merges the layers of an image into a single layer",
+	ArgsUsage: `--image <image-path>[:<tag>] [--tag <new-tag>] [--layers <start>:<end>]
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tag of the image to squash and "<new-tag>" is the name of the tag that the
+squashed image will be saved as (if not specified, defaults to "<tag>").
+
+The layers from "<start>" up to (but not including) "<end>" are replaced with
+a single layer containing their merged filesystem, where the lowest layer of
+the image is layer 0. Either end of the range may be omitted, and by default
+every layer of the image is squashed. Files which were overwritten or removed
+within the range do not take up any space in the new layer. The layers are
+merged by streaming them, without unpacking them to disk.
+
+The history entries of the squashed layers are replaced with a single entry.
+The new layer is compressed using the algorithm given with --compress (one of
+"none", "gzip" or "zstd", defaulting to "gzip") at the level given with
+--compress-level.`,
+
+	// squash modifies an image.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "layers",
+			Usage: "range of layers to squash (<start>:<end>, defaults to every layer)",
+		},
+	},
+
+	Action: squash,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		return nil
+	},
+})))
+
+// parseLayerRange parses a --layers range of the form "<start>:<end>", for an
+// image with the given number of layers. Either end of the range may be
+// omitted, and an empty range is every layer of the image.
+func parseLayerRange(value string, numLayers int) (int, int, error) {
+	if value == "" {
+		return 0, numLayers, nil
+	}
+	parts := strings.Split(value, ":")
+	if len(parts) != 2 {
+		return 0, 0, errors.Errorf("invalid layer range (must be <start>:<end>): %s", value)
+	}
+	bounds := []int{0, numLayers}
+	for idx, part := range parts {
+		if part == "" {
+			continue
+		}
+		bound, err := strconv.Atoi(part)
+		if err != nil {
+			return 0, 0, errors.Wrapf(err, "invalid layer range: %s", value)
+		}
+		bounds[idx] = bound
+	}
+	start, end := bounds[0], bounds[1]
+	if start < 0 || end > numLayers || start >= end {
+		return 0, 0, errors.Errorf("invalid layer range for image with %d layers: %s", numLayers, value)
+	}
+	return start, end, nil
+}
+
+func squash(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+	compressor := ctx.App.Metadata["--compress"].(mutate.Compressor)
+
+	tagName := fromName
+	if val, ok := ctx.App.Metadata["--tag"]; ok {
+		tagName = val.(string)
+	}
+
+	// Get a reference to the CAS.
+	engine, err := cas.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	defer engine.Close()
+
+	fromDescriptor, err := engine.GetReference(context.Background(), fromName)
+	if err != nil {
+		return errors.Wrap(err, "get from reference")
+	}
+
+	// FIXME: Implement support for manifest lists.
+	if fromDescriptor.MediaType != ispec.MediaTypeImageManifest {
+		return errors.Wrap(fmt.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", fromDescriptor.MediaType), "invalid from descriptor")
+	}
+
+	mutator, err := mutate.New(engine, fromDescriptor)
+	if err != nil {
+		return errors.Wrap(err, "create mutator for image")
+	}
+
+	manifest, err := mutator.Manifest(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "get image manifest")
+	}
+	start, end, err := parseLayerRange(ctx.String("layers"), len(manifest.Layers))
+	if err != nil {
+		return errors.Wrap(err, "parsing --layers")
+	}
+
+	imageMeta, err := mutator.Meta(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "get image metadata")
+	}
+
+	history := ispec.History{
+		Author:     imageMeta.Author,
+		Comment:    "",
+		Created:    time.Now(),
+		CreatedBy:  "umoci squash",
+		EmptyLayer: false,
+	}
+
+	if val, ok := ctx.App.Metadata["--history.author"]; ok {
+		history.Author = val.(string)
+	}
+	if val, ok := ctx.App.Metadata["--history.comment"]; ok {
+		history.Comment = val.(string)
+	}
+	if val, ok := ctx.App.Metadata["--history.created"]; ok {
+		created, err := time.Parse(igen.ISO8601, val.(string))
+		if err != nil {
+			return errors.Wrap(err, "parsing --history.created")
+		}
+		history.Created = created
+	}
+	if val, ok := ctx.App.Metadata["--history.created_by"]; ok {
+		history.CreatedBy = val.(string)
+	}
+
+	log.WithFields(log.Fields{
+		"start": start,
+		"end":   end,
+	}).Debugf("umoci: squashing layers")
+
+	if err := mutator.Squash(context.Background(), start, end, history, &mutate.AddOptions{
+		Compressor: compressor,
+		Progress:   progressReporterFrom(ctx),
+	}); err != nil {
+		return errors.Wrap(err, "squash layers")
+	}
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "commit mutated image")
+	}
+
+	log.Infof("new image manifest created: %s", newDescriptor.Digest)
+
+	err = engine.PutReference(context.Background(), tagName, newDescriptor)
+	if err == cas.ErrClobber {
+		// We have to clobber a tag.
+		log.Warnf("clobbering existing tag: %s", tagName)
+
+		// Delete the old tag.
+		if err := engine.DeleteReference(context.Background(), tagName); err != nil {
+			return errors.Wrap(err, "delete old tag")
+		}
+		err = engine.PutReference(context.Background(), tagName, newDescriptor)
+	}
+	if err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.Infof("created new tag for image manifest: %s", tagName)
+	return nil
+}
@@ -19,16 +19,20 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 
 	"github.com/apex/log"
+	"github.com/docker/go-units"
 	"github.com/openSUSE/umoci"
 	"github.com/openSUSE/umoci/oci/cas"
 	"github.com/openSUSE/umoci/oci/casext"
 	"github.com/openSUSE/umoci/oci/layer"
 	"github.com/openSUSE/umoci/pkg/idtools"
+	"github.com/openSUSE/umoci/pkg/progress"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
@@ -47,7 +51,22 @@ is the destination to unpack the image to.
 
 It should be noted that this is not the same as oci-create-runtime-bundle,
 because this command also will create an mtree specification to allow for layer
-creation with umoci-repack(1).`,
+creation with umoci-repack(1).
+
+If --update is specified, "<bundle>" must be an existing bundle previously
+created by umoci-unpack(1) which has not been modified since it was unpacked.
+In that case, only the layers that "<tag>" has added on top of the image the
+bundle was unpacked from are extracted, and the bundle metadata is updated to
+refer to "<tag>". Only files whose inode number, size, modification time or
+change time differ from when the bundle was unpacked are hashed to check that
+it is unmodified, unless --paranoid is specified.
+
+The xattrs applied to unpacked files can be controlled with --xattr-include and
+--xattr-exclude, which take xattr names that may contain globs (such as
+"user.*"). xattrs matching --xattr-exclude are never applied. SELinux labels
+("security.selinux") are host-specific, and so are not applied unless they
+match --xattr-include (which doesn't affect any other xattrs). The same
+filters are used by umoci-repack(1).`,
 
 	// unpack reads manifest information.
 	Category: "image",
@@ -65,6 +84,58 @@ creation with umoci-repack(1).`,
 			Name:  "rootless",
 			Usage: "enable rootless unpacking support",
 		},
+		cli.StringSliceFlag{
+			Name:  "include",
+			Usage: "only unpack paths matching the given glob (and their parent directories)",
+		},
+		cli.StringSliceFlag{
+			Name:  "exclude",
+			Usage: "do not unpack paths matching the given glob",
+		},
+		cli.StringSliceFlag{
+			Name:  "xattr-include",
+			Usage: "also apply xattrs which are excluded by default (such as security.selinux) if they match the given glob",
+		},
+		cli.StringSliceFlag{
+			Name:  "xattr-exclude",
+			Usage: "do not apply xattrs whose names match the given glob",
+		},
+		cli.StringFlag{
+			Name:  "max-bytes",
+			Usage: "maximum total size of the files in the image (such as 10GiB)",
+		},
+		cli.Int64Flag{
+			Name:  "max-entries",
+			Usage: "maximum total number of entries in the layers of the image",
+		},
+		cli.IntFlag{
+			Name:  "max-path-depth",
+			Usage: "maximum number of components in a path",
+		},
+		cli.IntFlag{
+			Name:  "max-path-length",
+			Usage: "maximum length of a path or link target",
+		},
+		cli.StringFlag{
+			Name:  "max-xattr-size",
+			Usage: "maximum size of an xattr value (such as 64KiB)",
+		},
+		cli.BoolFlag{
+			Name:  "strip-setuid",
+			Usage: "clear the setuid and setgid bits of unpacked files",
+		},
+		cli.BoolFlag{
+			Name:  "no-devices",
+			Usage: "refuse to unpack images containing device nodes",
+		},
+		cli.BoolFlag{
+			Name:  "update",
+			Usage: "only extract new layers on top of an existing unmodified bundle",
+		},
+		cli.BoolFlag{
+			Name:  "paranoid",
+			Usage: "with --update, hash every file to check the bundle is unmodified (rather than only files whose stat data changed)",
+		},
 	},
 
 	Action: unpack,
@@ -81,7 +152,7 @@ creation with umoci-repack(1).`,
 	},
 }
 
-func unpack(ctx *cli.Context) error {
+func unpack(ctx *cli.Context) (Err error) {
 	imagePath := ctx.App.Metadata["--image-path"].(string)
 	fromName := ctx.App.Metadata["--image-tag"].(string)
 	bundlePath := ctx.App.Metadata["bundle"].(string)
@@ -104,22 +175,87 @@ func unpack(ctx *cli.Context) error {
 	for _, uidmap := range ctx.StringSlice("uid-map") {
 		idMap, err := idtools.ParseMapping(uidmap)
 		if err != nil {
-			return errors.Wrapf(err, "failure parsing --uid-map %s: %s", uidmap)
+			return errors.Wrapf(err, "failure parsing --uid-map %s", uidmap)
 		}
 		meta.MapOptions.UIDMappings = append(meta.MapOptions.UIDMappings, idMap)
 	}
 	for _, gidmap := range ctx.StringSlice("gid-map") {
 		idMap, err := idtools.ParseMapping(gidmap)
 		if err != nil {
-			return errors.Wrapf(err, "failure parsing --gid-map %s: %s", gidmap)
+			return errors.Wrapf(err, "failure parsing --gid-map %s", gidmap)
 		}
 		meta.MapOptions.GIDMappings = append(meta.MapOptions.GIDMappings, idMap)
 	}
 
+	// Parse the path filters.
+	for _, filter := range ctx.StringSlice("include") {
+		meta.Filters.Include = append(meta.Filters.Include, filepath.Clean(filter))
+	}
+	for _, filter := range ctx.StringSlice("exclude") {
+		meta.Filters.Exclude = append(meta.Filters.Exclude, filepath.Clean(filter))
+	}
+	if err := meta.Filters.Validate(); err != nil {
+		return errors.Wrap(err, "invalid --include or --exclude")
+	}
+
+	// Parse the xattr filters.
+	meta.Xattrs.Include = ctx.StringSlice("xattr-include")
+	meta.Xattrs.Exclude = ctx.StringSlice("xattr-exclude")
+	if err := meta.Xattrs.Validate(); err != nil {
+		return errors.Wrap(err, "invalid --xattr-include or --xattr-exclude")
+	}
+
+	// Parse the unpack limits.
+	limits, err := parseUnpackLimits(ctx)
+	if err != nil {
+		return err
+	}
+
+	// With --update, the mapping options and path and xattr filters have to
+	// match the ones used for the original unpack, so we take them from the
+	// existing bundle.
+	var oldMeta *UmociMeta
+	if ctx.Bool("update") {
+		bundleMeta, err := ReadBundleMeta(bundlePath)
+		if err != nil {
+			return errors.Wrap(err, "read umoci.json metadata")
+		}
+		log.WithFields(log.Fields{
+			"version":     bundleMeta.Version,
+			"from":        bundleMeta.From,
+			"map_options": bundleMeta.MapOptions,
+		}).Debugf("umoci: loaded UmociMeta metadata")
+
+		if ctx.IsSet("uid-map") || ctx.IsSet("gid-map") || ctx.IsSet("rootless") {
+			if !reflect.DeepEqual(meta.MapOptions, bundleMeta.MapOptions) {
+				return errors.Errorf("mapping options differ from those used to unpack the bundle")
+			}
+		}
+		if ctx.IsSet("include") || ctx.IsSet("exclude") {
+			if !reflect.DeepEqual(meta.Filters, bundleMeta.Filters) {
+				return errors.Errorf("path filters differ from those used to unpack the bundle")
+			}
+		}
+		if ctx.IsSet("xattr-include") || ctx.IsSet("xattr-exclude") {
+			if !reflect.DeepEqual(meta.Xattrs, bundleMeta.Xattrs) {
+				return errors.Errorf("xattr filters differ from those used to unpack the bundle")
+			}
+		}
+		oldMeta = &bundleMeta
+		meta.MapOptions = bundleMeta.MapOptions
+		meta.Filters = bundleMeta.Filters
+		meta.Xattrs = bundleMeta.Xattrs
+		meta.MaskPaths = bundleMeta.MaskPaths
+	}
+
 	log.WithFields(log.Fields{
-		"map.uid": meta.MapOptions.UIDMappings,
-		"map.gid": meta.MapOptions.GIDMappings,
-	}).Debugf("parsed mappings")
+		"map.uid":       meta.MapOptions.UIDMappings,
+		"map.gid":       meta.MapOptions.GIDMappings,
+		"include":       meta.Filters.Include,
+		"exclude":       meta.Filters.Exclude,
+		"xattr.include": meta.Xattrs.Include,
+		"xattr.exclude": meta.Xattrs.Exclude,
+	}).Debugf("parsed mappings and path and xattr filters")
 
 	// Get a reference to the CAS.
 	engine, err := cas.Open(imagePath)
@@ -146,9 +282,34 @@ func unpack(ctx *cli.Context) error {
 		return errors.Wrap(fmt.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", meta.From.MediaType), "invalid --image tag")
 	}
 
+	fsEval := umoci.DefaultFsEval
+	if meta.MapOptions.Rootless {
+		fsEval = umoci.RootlessFsEval
+	}
+
+	// A new bundle is created in a temporary directory next to bundlePath,
+	// which is only moved into place once it is complete. This ensures that a
+	// failed unpack doesn't leave a partially extracted bundle behind.
+	workPath := bundlePath
+	if oldMeta == nil {
+		tempPath, err := createTempBundle(bundlePath)
+		if err != nil {
+			return errors.Wrap(err, "create temporary bundle")
+		}
+		defer func() {
+			if Err != nil {
+				if err := fsEval.RemoveAll(tempPath); err != nil {
+					log.Warnf("failed to remove temporary bundle %s: %v", tempPath, err)
+				}
+			}
+		}()
+		workPath = tempPath
+	}
+
 	mtreeName := strings.Replace(meta.From.Digest.String(), "sha256:", "sha256_", 1)
-	mtreePath := filepath.Join(bundlePath, mtreeName+".mtree")
-	fullRootfsPath := filepath.Join(bundlePath, layer.RootfsName)
+	mtreePath := filepath.Join(workPath, mtreeName+".mtree")
+	statCachePath := filepath.Join(workPath, mtreeName+StatCacheSuffix)
+	fullRootfsPath := filepath.Join(workPath, layer.RootfsName)
 
 	log.WithFields(log.Fields{
 		"image":  imagePath,
@@ -164,32 +325,39 @@ func unpack(ctx *cli.Context) error {
 		return errors.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.MediaType)
 	}
 
-	// Unpack the runtime bundle.
-	if err := os.MkdirAll(bundlePath, 0755); err != nil {
-		return errors.Wrap(err, "create bundle path")
-	}
-	// XXX: We should probably defer os.RemoveAll(bundlePath).
-
 	// FIXME: Currently we only support OCI layouts, not tar archives. This
 	//        should be fixed once the CAS engine PR is merged into
 	//        image-tools. https://github.com/opencontainers/image-tools/pull/5
-	log.Info("unpacking bundle ...")
-	if err := layer.UnpackManifest(context.Background(), engineExt, bundlePath, manifest, &meta.MapOptions); err != nil {
-		return errors.Wrap(err, "create runtime bundle")
+	if oldMeta != nil {
+		if err := unpackUpdate(engineExt, bundlePath, *oldMeta, manifest, limits, ctx.Bool("paranoid"), progressReporterFrom(ctx), fsEval); err != nil {
+			return errors.Wrap(err, "update runtime bundle")
+		}
+	} else {
+		log.Info("unpacking bundle ...")
+		if err := layer.UnpackManifest(context.Background(), engineExt, workPath, manifest, &layer.UnpackOptions{
+			MapOptions: meta.MapOptions,
+			Filters:    meta.Filters,
+			Xattrs:     meta.Xattrs,
+			Limits:     limits,
+			Progress:   progressReporterFrom(ctx),
+		}); err != nil {
+			return errors.Wrap(err, "create runtime bundle")
+		}
+		log.Info("... done")
 	}
-	log.Info("... done")
 
 	log.WithFields(log.Fields{
 		"keywords": MtreeKeywords,
 		"mtree":    mtreePath,
 	}).Debugf("umoci: generating mtree manifest")
 
-	fsEval := umoci.DefaultFsEval
-	if meta.MapOptions.Rootless {
-		fsEval = umoci.RootlessFsEval
-	}
-
+	// The stat cache must be generated first, so that any file modified while
+	// the manifest is being generated is hashed again by umoci-repack(1).
 	log.Info("computing filesystem manifest ...")
+	statCache, err := layer.GenerateStatCache(fullRootfsPath, fsEval)
+	if err != nil {
+		return errors.Wrap(err, "generate stat cache")
+	}
 	dh, err := mtree.Walk(fullRootfsPath, nil, MtreeKeywords, fsEval)
 	if err != nil {
 		return errors.Wrap(err, "generate mtree spec")
@@ -207,6 +375,12 @@ func unpack(ctx *cli.Context) error {
 	if _, err := dh.WriteTo(fh); err != nil {
 		return errors.Wrap(err, "write mtree")
 	}
+	if err := fh.Close(); err != nil {
+		return errors.Wrap(err, "close mtree")
+	}
+	if err := WriteStatCache(statCachePath, statCache); err != nil {
+		return errors.Wrap(err, "write stat cache")
+	}
 
 	log.WithFields(log.Fields{
 		"version":     meta.Version,
@@ -214,10 +388,193 @@ func unpack(ctx *cli.Context) error {
 		"map_options": meta.MapOptions,
 	}).Debugf("umoci: saving UmociMeta metadata")
 
-	if err := WriteBundleMeta(bundlePath, meta); err != nil {
+	if err := WriteBundleMeta(workPath, meta); err != nil {
 		return errors.Wrap(err, "write umoci.json metadata")
 	}
 
+	if workPath != bundlePath {
+		if err := commitTempBundle(workPath, bundlePath); err != nil {
+			return errors.Wrap(err, "move bundle into place")
+		}
+	}
+
 	log.Infof("unpacked image bundle: %s", bundlePath)
 	return nil
 }
+
+// unpackUpdate extracts the layers of manifest which are not already present
+// in the bundle described by oldMeta (subject to the given limits), and
+// removes the old mtree manifest and stat cache of the bundle. The bundle must
+// not have been modified since it was unpacked.
+func unpackUpdate(engineExt casext.Engine, bundlePath string, oldMeta UmociMeta, manifest ispec.Manifest, limits layer.UnpackLimits, paranoid bool, reporter progress.Reporter, fsEval umoci.FsEval) error {
+	// FIXME: Implement support for manifest lists.
+	if oldMeta.From.MediaType != ispec.MediaTypeImageManifest {
+		return errors.Wrap(fmt.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", oldMeta.From.MediaType), "invalid saved from descriptor")
+	}
+
+	oldMtreeName := strings.Replace(oldMeta.From.Digest.String(), "sha256:", "sha256_", 1)
+	oldMtreePath := filepath.Join(bundlePath, oldMtreeName+".mtree")
+	oldStatCachePath := filepath.Join(bundlePath, oldMtreeName+StatCacheSuffix)
+	fullRootfsPath := filepath.Join(bundlePath, layer.RootfsName)
+
+	mfh, err := os.Open(oldMtreePath)
+	if err != nil {
+		return errors.Wrap(err, "open mtree")
+	}
+	defer mfh.Close()
+
+	spec, err := mtree.ParseSpec(mfh)
+	if err != nil {
+		return errors.Wrap(err, "parse mtree")
+	}
+
+	// We can only apply the new layers if the rootfs is exactly what was
+	// unpacked, otherwise the changes would be silently mixed in.
+	log.Info("computing filesystem diff ...")
+	diffs, err := checkBundle(fullRootfsPath, spec, oldStatCachePath, paranoid, fsEval)
+	if err != nil {
+		return errors.Wrap(err, "check mtree")
+	}
+	log.Info("... done")
+
+	if len(diffs) != 0 {
+		return errors.Errorf("bundle has been modified since it was unpacked (%d changes)", len(diffs))
+	}
+
+	oldManifestBlob, err := engineExt.FromDescriptor(context.Background(), oldMeta.From)
+	if err != nil {
+		return errors.Wrap(err, "get old manifest")
+	}
+	defer oldManifestBlob.Close()
+
+	oldManifest, ok := oldManifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		// Should _never_ be reached.
+		return errors.Errorf("[internal error] unknown manifest blob type: %s", oldManifestBlob.MediaType)
+	}
+
+	log.WithFields(log.Fields{
+		"old": len(oldManifest.Layers),
+		"new": len(manifest.Layers),
+	}).Debugf("umoci: updating bundle layers")
+
+	log.Info("updating bundle ...")
+	if err := layer.UpdateManifest(context.Background(), engineExt, bundlePath, oldManifest, manifest, &layer.UnpackOptions{
+		MapOptions: oldMeta.MapOptions,
+		Filters:    oldMeta.Filters,
+		Xattrs:     oldMeta.Xattrs,
+		Limits:     limits,
+		Progress:   reporter,
+	}); err != nil {
+		return errors.Wrap(err, "update layers")
+	}
+	log.Info("... done")
+
+	// The old mtree manifest no longer describes the rootfs.
+	if err := os.Remove(oldMtreePath); err != nil {
+		return errors.Wrap(err, "remove old mtree")
+	}
+	if err := os.Remove(oldStatCachePath); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "remove old stat cache")
+	}
+	return nil
+}
+
+// createTempBundle creates a temporary directory next to bundlePath in which a
+// new bundle can be created. It fails early if bundlePath already contains a
+// bundle.
+func createTempBundle(bundlePath string) (string, error) {
+	for _, name := range []string{"config.json", layer.RootfsName, UmociMetaName} {
+		if _, err := os.Lstat(filepath.Join(bundlePath, name)); !os.IsNotExist(err) {
+			if err == nil {
+				err = fmt.Errorf("%s already exists", name)
+			}
+			return "", errors.Wrap(err, "bundle path empty")
+		}
+	}
+
+	parentPath := filepath.Dir(filepath.Clean(bundlePath))
+	if err := os.MkdirAll(parentPath, 0755); err != nil {
+		return "", errors.Wrap(err, "create bundle parent")
+	}
+	tempPath, err := ioutil.TempDir(parentPath, ".umoci-unpack-"+filepath.Base(bundlePath)+"-")
+	if err != nil {
+		return "", errors.Wrap(err, "create temporary directory")
+	}
+	if err := os.Chmod(tempPath, 0755); err != nil {
+		os.RemoveAll(tempPath)
+		return "", errors.Wrap(err, "chmod temporary directory")
+	}
+	return tempPath, nil
+}
+
+// commitTempBundle moves the completed bundle at tempPath to bundlePath. If
+// bundlePath doesn't exist (or is an empty directory), this is a single atomic
+// rename. Otherwise the contents of tempPath are moved individually, with the
+// umoci.json metadata moved last.
+func commitTempBundle(tempPath, bundlePath string) error {
+	if err := os.Rename(tempPath, bundlePath); err == nil {
+		return nil
+	}
+
+	if fi, err := os.Stat(bundlePath); err != nil {
+		return errors.Wrap(err, "stat bundle path")
+	} else if !fi.IsDir() {
+		return errors.Errorf("bundle path is not a directory: %s", bundlePath)
+	}
+
+	entries, err := ioutil.ReadDir(tempPath)
+	if err != nil {
+		return errors.Wrap(err, "read temporary bundle")
+	}
+	var names []string
+	for _, entry := range entries {
+		if _, err := os.Lstat(filepath.Join(bundlePath, entry.Name())); !os.IsNotExist(err) {
+			if err == nil {
+				err = fmt.Errorf("%s already exists", entry.Name())
+			}
+			return errors.Wrap(err, "bundle path empty")
+		}
+		if entry.Name() != UmociMetaName {
+			names = append(names, entry.Name())
+		}
+	}
+	names = append(names, UmociMetaName)
+
+	for _, name := range names {
+		if err := os.Rename(filepath.Join(tempPath, name), filepath.Join(bundlePath, name)); err != nil {
+			return errors.Wrapf(err, "move %s", name)
+		}
+	}
+	return errors.Wrap(os.Remove(tempPath), "remove temporary bundle")
+}
+
+// parseUnpackLimits parses the --max-* limit flags and the setuid and device
+// node policy flags of umoci-unpack(1).
+func parseUnpackLimits(ctx *cli.Context) (layer.UnpackLimits, error) {
+	limits := layer.UnpackLimits{
+		MaxEntries:    ctx.Int64("max-entries"),
+		MaxPathDepth:  ctx.Int("max-path-depth"),
+		MaxPathLength: ctx.Int("max-path-length"),
+		StripSetuid:   ctx.Bool("strip-setuid"),
+		NoDevices:     ctx.Bool("no-devices"),
+	}
+	if limits.MaxEntries < 0 || limits.MaxPathDepth < 0 || limits.MaxPathLength < 0 {
+		return limits, errors.Errorf("unpack limits cannot be negative")
+	}
+	if value := ctx.String("max-bytes"); value != "" {
+		size, err := units.RAMInBytes(value)
+		if err != nil || size < 0 {
+			return limits, errors.Errorf("invalid --max-bytes: %s", value)
+		}
+		limits.MaxBytes = size
+	}
+	if value := ctx.String("max-xattr-size"); value != "" {
+		size, err := units.RAMInBytes(value)
+		if err != nil || size < 0 || int64(int(size)) != size {
+			return limits, errors.Errorf("invalid --max-xattr-size: %s", value)
+		}
+		limits.MaxXattrSize = int(size)
+	}
+	return limits, nil
+}
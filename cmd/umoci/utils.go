@@ -27,7 +27,9 @@ import (
 	"strings"
 	"text/tabwriter"
 
+	"github.com/apex/log"
 	"github.com/docker/go-units"
+	"github.com/openSUSE/umoci"
 	"github.com/openSUSE/umoci/oci/casext"
 	igen "github.com/openSUSE/umoci/oci/config/generate"
 	"github.com/openSUSE/umoci/oci/layer"
@@ -82,6 +84,23 @@ type UmociMeta struct {
 	// umoci-repack(1) calls, changing them is not recommended and so the
 	// default should be that they are the same.
 	MapOptions layer.MapOptions `json:"map_options"`
+
+	// Filters is the parsed version of the --include and --exclude arguments
+	// to umoci-unpack(1). umoci-repack(1) uses the same filters, so that paths
+	// which were never unpacked are not turned into whiteouts.
+	Filters layer.PathFilters `json:"path_filters"`
+
+	// Xattrs is the parsed version of the --xattr-include and --xattr-exclude
+	// arguments to umoci-unpack(1). umoci-repack(1) uses the same filters, so
+	// that xattrs which were not applied to the rootfs are not included in new
+	// layers either.
+	Xattrs layer.XattrFilter `json:"xattr_filters"`
+
+	// MaskPaths is a list of paths whose changes are never included in the
+	// layers generated by umoci-repack(1), in addition to any given with
+	// --mask-path. umoci-unpack(1) never sets it, so it has to be added to
+	// umoci.json by hand.
+	MaskPaths []string `json:"mask_paths,omitempty"`
 }
 
 // WriteTo writes a JSON-serialised version of UmociMeta to the given io.Writer.
@@ -117,6 +136,74 @@ func ReadBundleMeta(bundle string) (UmociMeta, error) {
 	return meta, errors.Wrap(err, "decode metadata")
 }
 
+// StatCacheSuffix is the suffix of the name of the stat cache which
+// umoci-unpack(1) stores next to the mtree manifest of a bundle, which allows
+// umoci-repack(1) to skip hashing files that haven't been modified.
+const StatCacheSuffix = ".statcache"
+
+// WriteStatCache writes a JSON-serialised version of the stat cache to the
+// given path.
+func WriteStatCache(path string, cache *layer.StatCache) error {
+	fh, err := os.Create(path)
+	if err != nil {
+		return errors.Wrap(err, "create stat cache")
+	}
+	defer fh.Close()
+
+	if err := json.NewEncoder(fh).Encode(cache); err != nil {
+		return errors.Wrap(err, "write stat cache")
+	}
+	return errors.Wrap(fh.Close(), "close stat cache")
+}
+
+// ReadStatCache reads and parses the stat cache at the given path. If there
+// is no stat cache (such as in bundles unpacked by older versions of umoci),
+// a nil cache is returned.
+func ReadStatCache(path string) (*layer.StatCache, error) {
+	fh, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "open stat cache")
+	}
+	defer fh.Close()
+
+	var cache layer.StatCache
+	if err := json.NewDecoder(fh).Decode(&cache); err != nil {
+		return nil, errors.Wrap(err, "decode stat cache")
+	}
+	return &cache, nil
+}
+
+// walkBundle generates a new mtree manifest for the rootfs of a bundle, given
+// its existing manifest. Unless paranoid is set, the bundle's stat cache (if
+// there is one) is used to avoid hashing files which haven't been modified.
+func walkBundle(rootfsPath string, spec *mtree.DirectoryHierarchy, statCachePath string, paranoid bool, fsEval umoci.FsEval) (*mtree.DirectoryHierarchy, error) {
+	if paranoid {
+		log.Debugf("umoci: --paranoid given, hashing every file")
+		return mtree.Walk(rootfsPath, nil, MtreeKeywords, fsEval)
+	}
+
+	cache, err := ReadStatCache(statCachePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "read stat cache")
+	}
+	if cache == nil {
+		log.Debugf("umoci: bundle has no stat cache, hashing every file")
+	}
+	return layer.QuickWalk(rootfsPath, spec, MtreeKeywords, cache, fsEval)
+}
+
+// checkBundle returns the differences between the rootfs of a bundle and its
+// mtree manifest, using walkBundle.
+func checkBundle(rootfsPath string, spec *mtree.DirectoryHierarchy, statCachePath string, paranoid bool, fsEval umoci.FsEval) ([]mtree.InodeDelta, error) {
+	newSpec, err := walkBundle(rootfsPath, spec, statCachePath, paranoid, fsEval)
+	if err != nil {
+		return nil, err
+	}
+	return mtree.Compare(spec, newSpec, MtreeKeywords)
+}
+
 // ManifestStat has information about a given OCI manifest.
 // TODO: Implement support for manifest lists, this should also be able to
 //       contain stat information for a list of manifests.
@@ -19,9 +19,13 @@ package main
 
 import (
 	"fmt"
+	"os"
 	"regexp"
 	"strings"
+	"time"
 
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/pkg/progress"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 )
@@ -206,3 +210,98 @@ func uxLayout(cmd cli.Command) cli.Command {
 
 	return cmd
 }
+
+// uxCompress adds the --compress and --compress-level flags to the given
+// cli.Command as well as adding relevant validation logic to the .Before of
+// the command. The parsed mutate.Compressor is stored in
+// ctx.App.Metadata["--compress"] (this is always set, defaulting to
+// mutate.GzipCompressor).
+func uxCompress(cmd cli.Command) cli.Command {
+	cmd.Flags = append(cmd.Flags, []cli.Flag{
+		cli.StringFlag{
+			Name:  "compress",
+			Usage: "compression algorithm for new layers (none, gzip, zstd)",
+			Value: "gzip",
+		},
+		cli.IntFlag{
+			Name:  "compress-level",
+			Usage: "compression level for new layers (0 is the algorithm's default)",
+		},
+	}...)
+
+	oldBefore := cmd.Before
+	cmd.Before = func(ctx *cli.Context) error {
+		// Verify and parse --compress and --compress-level.
+		compressor, err := parseCompressor(ctx.String("compress"), ctx.Int("compress-level"))
+		if err != nil {
+			return errors.Wrap(err, "invalid --compress")
+		}
+		ctx.App.Metadata["--compress"] = compressor
+
+		if oldBefore != nil {
+			return oldBefore(ctx)
+		}
+		return nil
+	}
+
+	return cmd
+}
+
+// parseCompressor returns the mutate.Compressor for the given compression
+// algorithm name ("none", "gzip" or "zstd") and level.
+func parseCompressor(algo string, level int) (mutate.Compressor, error) {
+	switch algo {
+	case "none":
+		if level != 0 {
+			return nil, fmt.Errorf("cannot set compression level without compression")
+		}
+		return mutate.NoopCompressor, nil
+	case "gzip":
+		return mutate.NewGzipCompressor(level)
+	case "zstd":
+		return mutate.NewZstdCompressor(level)
+	}
+	return nil, fmt.Errorf("unknown compression algorithm: '%s'", algo)
+}
+
+// progressReporter is a progress.Reporter which has to be closed once umoci is
+// done reporting progress.
+type progressReporter interface {
+	progress.Reporter
+	Close() error
+}
+
+// progressJSONInterval is how often the progress of an operation is written
+// with --progress=json.
+const progressJSONInterval = time.Second
+
+// parseProgress returns the progressReporter for the given --progress mode
+// ("auto", "tty", "json" or "none"), which writes to the given file. "auto"
+// selects "tty" if the file is a terminal and "json" otherwise. nil is
+// returned for "none".
+func parseProgress(mode string, fh *os.File) (progressReporter, error) {
+	if mode == "auto" {
+		mode = "json"
+		if progress.IsTerminal(fh.Fd()) {
+			mode = "tty"
+		}
+	}
+	switch mode {
+	case "tty":
+		return progress.NewTerminalReporter(fh), nil
+	case "json":
+		return progress.NewJSONReporter(fh, progressJSONInterval), nil
+	case "none":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown progress mode: '%s'", mode)
+}
+
+// progressReporterFrom returns the progress.Reporter set up by --progress, or
+// nil if progress shouldn't be reported.
+func progressReporterFrom(ctx *cli.Context) progress.Reporter {
+	if reporter, ok := ctx.App.Metadata["--progress"].(progressReporter); ok {
+		return reporter
+	}
+	return nil
+}
@@ -83,7 +83,7 @@ clean() {
 	# Remove any extra files that we know we don't care about.
 	echo -n "pruning unused files, "
 	find vendor -type f -name '*_test.go' -exec rm -v '{}' ';'
-	find vendor -regextype posix-extended -type f -not '(' -regex '.*\.(c|h|go)' -or '(' "${importantfiles[@]}" ')' ')' -exec rm -v '{}' ';'
+	find vendor -regextype posix-extended -type f -not '(' -regex '.*\.(c|h|go|s)' -or '(' "${importantfiles[@]}" ')' ')' -exec rm -v '{}' ';'
 
 	# Remove self from vendor.
 	echo -n "pruning self from vendor, "
@@ -130,6 +130,9 @@ clone github.com/apex/log afb2e76037a5f36542c77e88ef8aef9f469b09f8
 clone github.com/urfave/cli v1.18.1
 clone github.com/vbatts/go-mtree 711a89aa4c4a8f148d87eb915456eba8ee7c6a0b
 clone golang.org/x/net 45e771701b814666a7eb299e6c7a57d0b1799e91 https://github.com/golang/net
+clone github.com/klauspost/compress v1.18.0
+clone github.com/ulikunitz/xz v0.5.15
+clone github.com/klauspost/pgzip v1.2.6
 
 # Clean up the vendor directory.
 clean
@@ -0,0 +1,167 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+	gzip "github.com/klauspost/pgzip"
+	"github.com/pkg/errors"
+)
+
+// Compressor is a compression algorithm that can be used to compress the
+// layers added to an image by a Mutator.
+type Compressor interface {
+	// Compress returns a reader for the compressed form of the given stream.
+	// The compression happens as the returned reader is read, and the caller
+	// must Close the returned reader once they are done with it (closing it
+	// will not close the given reader).
+	Compress(reader io.Reader) (io.ReadCloser, error)
+
+	// MediaTypeSuffix returns the suffix (without the leading "+") which is
+	// appended to the media type of layers compressed with this algorithm,
+	// such as "gzip". An empty string means that layers are not compressed.
+	MediaTypeSuffix() string
+}
+
+// Builtin compressors, using the default compression level.
+var (
+	// NoopCompressor does no compression.
+	NoopCompressor Compressor = noopCompressor{}
+
+	// GzipCompressor compresses layers with gzip, using all available CPUs.
+	// This is the default compressor.
+	GzipCompressor Compressor = gzipCompressor{level: gzip.DefaultCompression}
+
+	// ZstdCompressor compresses layers with zstd.
+	ZstdCompressor Compressor = zstdCompressor{level: zstd.SpeedDefault}
+)
+
+// NewGzipCompressor returns a gzip Compressor using the given compression
+// level, which must be between 1 (fastest) and 9 (smallest). A level of 0
+// means the default compression level.
+func NewGzipCompressor(level int) (Compressor, error) {
+	if level == 0 {
+		return GzipCompressor, nil
+	}
+	if level < gzip.BestSpeed || level > gzip.BestCompression {
+		return nil, errors.Errorf("invalid gzip compression level: %d", level)
+	}
+	return gzipCompressor{level: level}, nil
+}
+
+// NewZstdCompressor returns a zstd Compressor using the given compression
+// level, which uses the same scale as the reference zstd implementation (1
+// to 22). A level of 0 means the default compression level. Note that
+// several levels map to the same internal compression settings.
+func NewZstdCompressor(level int) (Compressor, error) {
+	if level == 0 {
+		return ZstdCompressor, nil
+	}
+	if level < 1 || level > 22 {
+		return nil, errors.Errorf("invalid zstd compression level: %d", level)
+	}
+	return zstdCompressor{level: zstd.EncoderLevelFromZstd(level)}, nil
+}
+
+// isDefaultCompressor returns whether compressor is one of the builtin
+// compressors using the default compression level. The compression level used
+// for a layer is not recorded anywhere, so layers compressed with the same
+// algorithm can only be assumed to match a compressor with default settings.
+func isDefaultCompressor(compressor Compressor) bool {
+	switch compressor {
+	case NoopCompressor, GzipCompressor, ZstdCompressor:
+		return true
+	}
+	return false
+}
+
+// layerMediaType returns the media type for a layer with the given base
+// (uncompressed) media type, compressed with the given compressor.
+func layerMediaType(base string, compressor Compressor) string {
+	if suffix := compressor.MediaTypeSuffix(); suffix != "" {
+		return base + "+" + suffix
+	}
+	return base
+}
+
+type noopCompressor struct{}
+
+func (noopCompressor) Compress(reader io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(reader), nil
+}
+
+func (noopCompressor) MediaTypeSuffix() string { return "" }
+
+type gzipCompressor struct {
+	level int
+}
+
+func (c gzipCompressor) Compress(reader io.Reader) (io.ReadCloser, error) {
+	pipeReader, pipeWriter := io.Pipe()
+
+	gzw, err := gzip.NewWriterLevel(pipeWriter, c.level)
+	if err != nil {
+		return nil, errors.Wrap(err, "create gzip writer")
+	}
+	go func() {
+		if _, err := io.Copy(gzw, reader); err != nil {
+			pipeWriter.CloseWithError(errors.Wrap(err, "compressing layer"))
+			gzw.Close()
+			return
+		}
+		if err := gzw.Close(); err != nil {
+			pipeWriter.CloseWithError(errors.Wrap(err, "close gzip writer"))
+			return
+		}
+		pipeWriter.Close()
+	}()
+	return pipeReader, nil
+}
+
+func (gzipCompressor) MediaTypeSuffix() string { return "gzip" }
+
+type zstdCompressor struct {
+	level zstd.EncoderLevel
+}
+
+func (c zstdCompressor) Compress(reader io.Reader) (io.ReadCloser, error) {
+	pipeReader, pipeWriter := io.Pipe()
+
+	zw, err := zstd.NewWriter(pipeWriter, zstd.WithEncoderLevel(c.level))
+	if err != nil {
+		return nil, errors.Wrap(err, "create zstd writer")
+	}
+	go func() {
+		if _, err := io.Copy(zw, reader); err != nil {
+			pipeWriter.CloseWithError(errors.Wrap(err, "compressing layer"))
+			zw.Close()
+			return
+		}
+		if err := zw.Close(); err != nil {
+			pipeWriter.CloseWithError(errors.Wrap(err, "close zstd writer"))
+			return
+		}
+		pipeWriter.Close()
+	}()
+	return pipeReader, nil
+}
+
+func (zstdCompressor) MediaTypeSuffix() string { return "zstd" }
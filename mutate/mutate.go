@@ -18,12 +18,12 @@
 package mutate
 
 import (
-	"compress/gzip"
 	"io"
 	"time"
 
 	"github.com/openSUSE/umoci/oci/cas"
 	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/pkg/progress"
 	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
@@ -47,6 +47,10 @@ type Mutator struct {
 	// Cached values of the configuration and manifest.
 	manifest *ispec.Manifest
 	config   *ispec.Image
+
+	// configModified is whether config has been modified since it was
+	// cached. If it hasn't, Commit re-uses the original configuration blob.
+	configModified bool
 }
 
 // Meta is a wrapper around the "safe" fields in ispec.Image, which can be
@@ -152,6 +156,19 @@ func (m *Mutator) Meta(ctx context.Context) (Meta, error) {
 	}, nil
 }
 
+// Manifest returns a copy of the current (cached) image manifest, which
+// includes any layers added or modified by the Mutator. It cannot be used to
+// modify the image.
+func (m *Mutator) Manifest(ctx context.Context) (ispec.Manifest, error) {
+	if err := m.cache(ctx); err != nil {
+		return ispec.Manifest{}, errors.Wrap(err, "getting cache failed")
+	}
+
+	manifest := *m.manifest
+	manifest.Layers = append([]ispec.Descriptor(nil), m.manifest.Layers...)
+	return manifest, nil
+}
+
 // Annotations returns the set of annotations in the current manifest. This
 // does not include the annotations set in ispec.ImageConfig.Labels. This
 // should be used as the source for any modifications of the annotations using
@@ -192,73 +209,91 @@ func (m *Mutator) Set(ctx context.Context, config ispec.ImageConfig, meta Meta,
 	history.EmptyLayer = true
 	m.config.History = append(m.config.History, history)
 
+	m.configModified = true
 	return nil
 }
 
 //
 
-// add adds the given layer to the CAS, and mutates the configuration to
-// include the diffID. The returned string is the digest of the *compressed*
-// layer (which is compressed by us).
-func (m *Mutator) add(ctx context.Context, reader io.Reader) (digest.Digest, int64, error) {
+// AddOptions are the options used by Add and AddNonDistributable.
+type AddOptions struct {
+	// Compressor is the compression algorithm used for the layer. If nil,
+	// GzipCompressor is used.
+	Compressor Compressor
+
+	// Progress, if not nil, is sent progress events (with the operation
+	// "add") as the compressed layer is written to the image. Bytes is the
+	// number of bytes of the compressed layer written so far.
+	Progress progress.Reporter
+}
+
+// add adds the given layer to the CAS (reporting its progress as the layer
+// with the given index). The returned digest is the digest of the
+// *compressed* layer (which is compressed by us), and the returned string is
+// the DiffID of the layer.
+func (m *Mutator) add(ctx context.Context, reader io.Reader, compressor Compressor, reporter progress.Reporter, idx int) (digest.Digest, int64, string, error) {
 	if err := m.cache(ctx); err != nil {
-		return "", -1, errors.Wrap(err, "getting cache failed")
+		return "", -1, "", errors.Wrap(err, "getting cache failed")
 	}
 
 	// XXX: We should not have to do this check here.
 	if cas.BlobAlgorithm != "sha256" {
-		return "", -1, errors.Errorf("unknown blob algorithm: %s", cas.BlobAlgorithm)
+		return "", -1, "", errors.Errorf("unknown blob algorithm: %s", cas.BlobAlgorithm)
 	}
 
 	diffidDigester := cas.BlobAlgorithm.Digester()
 	hashReader := io.TeeReader(reader, diffidDigester.Hash())
 
-	pipeReader, pipeWriter := io.Pipe()
-	defer pipeReader.Close()
-
-	gzw := gzip.NewWriter(pipeWriter)
-	defer gzw.Close()
-	go func() {
-		_, err := io.Copy(gzw, hashReader)
-		if err != nil {
-			pipeWriter.CloseWithError(errors.Wrap(err, "compressing layer"))
-			return
-		}
-		gzw.Close()
-		pipeWriter.Close()
-	}()
-
-	layerDigest, layerSize, err := m.engine.PutBlob(ctx, pipeReader)
+	compressed, err := compressor.Compress(hashReader)
 	if err != nil {
-		return "", -1, errors.Wrap(err, "put layer blob")
+		return "", -1, "", errors.Wrap(err, "compress layer")
 	}
+	defer compressed.Close()
 
-	// Add DiffID to configuration.
-	layerDiffID := diffidDigester.Digest()
-	m.config.RootFS.DiffIDs = append(m.config.RootFS.DiffIDs, layerDiffID.String())
+	layerDigest, layerSize, err := m.engine.PutBlob(ctx, progress.NewReader(compressed, reporter, progress.Event{
+		Operation: "add",
+		Layer:     idx,
+	}))
+	if err != nil {
+		return "", -1, "", errors.Wrap(err, "put layer blob")
+	}
+	return layerDigest, layerSize, diffidDigester.Digest().String(), nil
+}
 
-	return layerDigest, layerSize, nil
+// addOptions returns the compressor and progress reporter given in opts
+// (which may be nil).
+func addOptions(opts *AddOptions) (Compressor, progress.Reporter) {
+	compressor := GzipCompressor
+	var reporter progress.Reporter
+	if opts != nil {
+		if opts.Compressor != nil {
+			compressor = opts.Compressor
+		}
+		reporter = opts.Progress
+	}
+	return compressor, reporter
 }
 
-// Add adds a layer to the image, by reading the layer changeset blob from the
-// provided reader. The stream must not be compressed, as it is used to
-// generate the DiffIDs for the image metatadata. The provided history entry is
-// appended to the image's history and should correspond to what operations
-// were made to the configuration.
-func (m *Mutator) Add(ctx context.Context, r io.Reader, history ispec.History) error {
+// addLayer is the shared implementation of Add and AddNonDistributable, with
+// baseMediaType being the uncompressed media type of the layer.
+func (m *Mutator) addLayer(ctx context.Context, r io.Reader, history ispec.History, baseMediaType string, opts *AddOptions) error {
 	if err := m.cache(ctx); err != nil {
 		return errors.Wrap(err, "getting cache failed")
 	}
 
-	digest, size, err := m.add(ctx, r)
+	compressor, reporter := addOptions(opts)
+	digest, size, diffID, err := m.add(ctx, r, compressor, reporter, len(m.manifest.Layers))
 	if err != nil {
-		return errors.Wrap(err, "add layer")
+		return err
 	}
 
+	// Add DiffID to configuration.
+	m.config.RootFS.DiffIDs = append(m.config.RootFS.DiffIDs, diffID)
+	m.configModified = true
+
 	// Append to layers.
 	m.manifest.Layers = append(m.manifest.Layers, ispec.Descriptor{
-		// TODO: Detect whether the layer is gzip'd or not...
-		MediaType: ispec.MediaTypeImageLayerGzip,
+		MediaType: layerMediaType(baseMediaType, compressor),
 		Digest:    digest,
 		Size:      size,
 	})
@@ -269,30 +304,20 @@ func (m *Mutator) Add(ctx context.Context, r io.Reader, history ispec.History) e
 	return nil
 }
 
+// Add adds a layer to the image, by reading the layer changeset blob from the
+// provided reader. The stream must not be compressed, as it is used to
+// generate the DiffIDs for the image metatadata. The layer is compressed using
+// the compressor in opts (which may be nil). The provided history entry is
+// appended to the image's history and should correspond to what operations
+// were made to the configuration.
+func (m *Mutator) Add(ctx context.Context, r io.Reader, history ispec.History, opts *AddOptions) error {
+	return errors.Wrap(m.addLayer(ctx, r, history, ispec.MediaTypeImageLayer, opts), "add layer")
+}
+
 // AddNonDistributable is the same as Add, except it adds a non-distributable
 // layer to the image.
-func (m *Mutator) AddNonDistributable(ctx context.Context, r io.Reader, history ispec.History) error {
-	if err := m.cache(ctx); err != nil {
-		return errors.Wrap(err, "getting cache failed")
-	}
-
-	digest, size, err := m.add(ctx, r)
-	if err != nil {
-		return errors.Wrap(err, "add non-distributable layer")
-	}
-
-	// Append to layers.
-	m.manifest.Layers = append(m.manifest.Layers, ispec.Descriptor{
-		// TODO: Detect whether the layer is gzip'd or not...
-		MediaType: ispec.MediaTypeImageLayerNonDistributableGzip,
-		Digest:    digest,
-		Size:      size,
-	})
-
-	// Append history.
-	history.EmptyLayer = false
-	m.config.History = append(m.config.History, history)
-	return nil
+func (m *Mutator) AddNonDistributable(ctx context.Context, r io.Reader, history ispec.History, opts *AddOptions) error {
+	return errors.Wrap(m.addLayer(ctx, r, history, ispec.MediaTypeImageLayerNonDistributable, opts), "add non-distributable layer")
 }
 
 // Commit writes all of the temporary changes made to the configuration,
@@ -304,16 +329,20 @@ func (m *Mutator) Commit(ctx context.Context) (ispec.Descriptor, error) {
 		return ispec.Descriptor{}, errors.Wrap(err, "getting cache failed")
 	}
 
-	// We first have to commit the configuration blob.
-	configDigest, configSize, err := m.engine.PutBlobJSON(ctx, m.config)
-	if err != nil {
-		return ispec.Descriptor{}, errors.Wrap(err, "commit mutated config blob")
-	}
+	// We first have to commit the configuration blob. If it hasn't been
+	// modified we keep the original blob, because re-encoding it might
+	// change its digest.
+	if m.configModified {
+		configDigest, configSize, err := m.engine.PutBlobJSON(ctx, m.config)
+		if err != nil {
+			return ispec.Descriptor{}, errors.Wrap(err, "commit mutated config blob")
+		}
 
-	m.manifest.Config = ispec.Descriptor{
-		MediaType: m.manifest.Config.MediaType,
-		Digest:    configDigest,
-		Size:      configSize,
+		m.manifest.Config = ispec.Descriptor{
+			MediaType: m.manifest.Config.MediaType,
+			Digest:    configDigest,
+			Size:      configSize,
+		}
 	}
 
 	// Now commit the manifest.
@@ -20,13 +20,16 @@ package mutate
 import (
 	"archive/tar"
 	"bytes"
+	"compress/gzip"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
 	imeta "github.com/opencontainers/image-spec/specs-go"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"golang.org/x/net/context"
@@ -213,7 +216,7 @@ func TestMutateAdd(t *testing.T) {
 	// Add a new layer.
 	if err := mutator.Add(context.Background(), buffer, ispec.History{
 		Comment: "new layer",
-	}); err != nil {
+	}, nil); err != nil {
 		t.Fatalf("unexpected error adding layer: %+v", err)
 	}
 
@@ -293,7 +296,7 @@ func TestMutateAddNonDistributable(t *testing.T) {
 	// Add a new layer.
 	if err := mutator.AddNonDistributable(context.Background(), buffer, ispec.History{
 		Comment: "new layer",
-	}); err != nil {
+	}, nil); err != nil {
 		t.Fatalf("unexpected error adding layer: %+v", err)
 	}
 
@@ -424,3 +427,84 @@ func TestMutateSet(t *testing.T) {
 		t.Errorf("config.History[1].Comment was not set")
 	}
 }
+
+func TestMutateAddCompressor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateAddCompressor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	gzipLevel, err := NewGzipCompressor(9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zstdLevel, err := NewZstdCompressor(19)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name       string
+		compressor Compressor
+		mediaType  string
+		decompress func(io.Reader) (io.Reader, error)
+	}{
+		{"none", NoopCompressor, ispec.MediaTypeImageLayer, func(r io.Reader) (io.Reader, error) { return r, nil }},
+		{"gzip", GzipCompressor, ispec.MediaTypeImageLayerGzip, func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }},
+		{"gzip-9", gzipLevel, ispec.MediaTypeImageLayerGzip, func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }},
+		{"zstd", ZstdCompressor, casext.MediaTypeImageLayerZstd, func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) }},
+		{"zstd-19", zstdLevel, casext.MediaTypeImageLayerZstd, func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) }},
+	} {
+		mutator, err := New(engine, fromDescriptor)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data := bytes.Repeat([]byte("contents "), 1024)
+		if err := mutator.Add(context.Background(), bytes.NewReader(data), ispec.History{}, &AddOptions{
+			Compressor: test.compressor,
+		}); err != nil {
+			t.Errorf("%s: unexpected error adding layer: %+v", test.name, err)
+			continue
+		}
+
+		layer := mutator.manifest.Layers[len(mutator.manifest.Layers)-1]
+		if layer.MediaType != test.mediaType {
+			t.Errorf("%s: got layer media type %s, expected %s", test.name, layer.MediaType, test.mediaType)
+		}
+
+		blob, err := engine.GetBlob(context.Background(), layer.Digest)
+		if err != nil {
+			t.Errorf("%s: unexpected error getting layer: %+v", test.name, err)
+			continue
+		}
+		reader, err := test.decompress(blob)
+		if err != nil {
+			blob.Close()
+			t.Errorf("%s: unexpected error decompressing layer: %+v", test.name, err)
+			continue
+		}
+		got, err := ioutil.ReadAll(reader)
+		blob.Close()
+		if err != nil {
+			t.Errorf("%s: unexpected error reading layer: %+v", test.name, err)
+		} else if !bytes.Equal(got, data) {
+			t.Errorf("%s: layer contents don't match", test.name)
+		}
+	}
+
+	for _, level := range []int{-1, 10} {
+		if _, err := NewGzipCompressor(level); err == nil {
+			t.Errorf("expected error with gzip level %d", level)
+		}
+	}
+	for _, level := range []int{-1, 23} {
+		if _, err := NewZstdCompressor(level); err == nil {
+			t.Errorf("expected error with zstd level %d", level)
+		}
+	}
+}
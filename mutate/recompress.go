@@ -0,0 +1,129 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"io"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// baseLayerMediaType returns the uncompressed media type corresponding to the
+// given layer media type.
+func baseLayerMediaType(mediaType string) (string, error) {
+	if !casext.IsLayerMediaType(mediaType) {
+		return "", errors.Errorf("not a layer media type: %s", mediaType)
+	}
+	if idx := strings.LastIndex(mediaType, "+"); idx >= 0 {
+		mediaType = mediaType[:idx]
+	}
+	return mediaType, nil
+}
+
+// recompressLayer writes a copy of the given layer compressed with the
+// given compressor, returning the descriptor of the new layer. The DiffID of
+// the layer is verified against diffID while the layer is being copied.
+func (m *Mutator) recompressLayer(ctx context.Context, descriptor ispec.Descriptor, diffID string, compressor Compressor, mediaType string) (ispec.Descriptor, error) {
+	blob, err := m.engine.GetBlob(ctx, descriptor.Digest)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "get layer blob")
+	}
+	defer blob.Close()
+
+	raw, err := layer.DecompressLayer(descriptor.MediaType, blob)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "decompress layer")
+	}
+	defer raw.Close()
+
+	diffidDigester := cas.BlobAlgorithm.Digester()
+	hashReader := io.TeeReader(raw, diffidDigester.Hash())
+
+	compressed, err := compressor.Compress(hashReader)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "compress layer")
+	}
+	defer compressed.Close()
+
+	layerDigest, layerSize, err := m.engine.PutBlob(ctx, compressed)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "put layer blob")
+	}
+
+	// The new blob is left behind on mismatch, but it is unreferenced and
+	// will be removed by the next garbage collection.
+	if gotDiffID := diffidDigester.Digest().String(); gotDiffID != diffID {
+		return ispec.Descriptor{}, errors.Errorf("layer %s: diffid mismatch: got %s expected %s", descriptor.Digest, gotDiffID, diffID)
+	}
+
+	// Keep all other fields (such as annotations and urls) intact.
+	newDescriptor := descriptor
+	newDescriptor.MediaType = mediaType
+	newDescriptor.Digest = layerDigest
+	newDescriptor.Size = layerSize
+	return newDescriptor, nil
+}
+
+// Recompress rewrites every layer of the image so that it is compressed with
+// the given compressor (if nil, GzipCompressor is used). The layer
+// descriptors in the manifest are updated, but the DiffIDs and history of the
+// image are not modified (the DiffID of each layer is verified while it is
+// rewritten). If compressor uses the default compression level, layers which
+// already have the media type used by compressor are not rewritten. Otherwise
+// every layer is rewritten, because the compression level of an existing
+// layer cannot be determined.
+func (m *Mutator) Recompress(ctx context.Context, compressor Compressor) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+
+	if compressor == nil {
+		compressor = GzipCompressor
+	}
+
+	if len(m.manifest.Layers) != len(m.config.RootFS.DiffIDs) {
+		return errors.Errorf("recompress: manifest has %d layers but config has %d diffids", len(m.manifest.Layers), len(m.config.RootFS.DiffIDs))
+	}
+
+	for idx, descriptor := range m.manifest.Layers {
+		baseMediaType, err := baseLayerMediaType(descriptor.MediaType)
+		if err != nil {
+			return errors.Wrapf(err, "recompress layer %s", descriptor.Digest)
+		}
+		mediaType := layerMediaType(baseMediaType, compressor)
+		if mediaType == descriptor.MediaType && isDefaultCompressor(compressor) {
+			log.Debugf("recompress: skipping layer %s with media type %s", descriptor.Digest, mediaType)
+			continue
+		}
+
+		log.Infof("recompress layer: %s", descriptor.Digest)
+		newDescriptor, err := m.recompressLayer(ctx, descriptor, m.config.RootFS.DiffIDs[idx], compressor, mediaType)
+		if err != nil {
+			return errors.Wrapf(err, "recompress layer %s", descriptor.Digest)
+		}
+		m.manifest.Layers[idx] = newDescriptor
+	}
+	return nil
+}
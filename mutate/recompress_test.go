@@ -0,0 +1,147 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func TestMutateRecompress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateRecompress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	mutator, err := New(engine, fromDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+	// The layer created by setup() isn't actually compressed.
+	mutator.manifest.Layers[0].MediaType = ispec.MediaTypeImageLayer
+	oldConfig := mutator.manifest.Config
+	oldDiffIDs := mutator.config.RootFS.DiffIDs
+	oldHistory := mutator.config.History
+
+	// Convert to zstd.
+	if err := mutator.Recompress(context.Background(), ZstdCompressor); err != nil {
+		t.Fatalf("unexpected error recompressing: %+v", err)
+	}
+	zstdDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	mutator, err = New(engine, zstdDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+	if mutator.manifest.Layers[0].MediaType != casext.MediaTypeImageLayerZstd {
+		t.Errorf("manifest.Layers[0].MediaType is the wrong value: %s", mutator.manifest.Layers[0].MediaType)
+	}
+	if mutator.manifest.Layers[0].Digest == expectedLayerDigest {
+		t.Errorf("manifest.Layers[0].Digest was not changed")
+	}
+	// The configuration must be completely untouched.
+	if mutator.manifest.Config.Digest != oldConfig.Digest {
+		t.Errorf("manifest.Config was changed: %s != %s", mutator.manifest.Config.Digest, oldConfig.Digest)
+	}
+	if len(mutator.config.RootFS.DiffIDs) != len(oldDiffIDs) || mutator.config.RootFS.DiffIDs[0] != oldDiffIDs[0] {
+		t.Errorf("config.RootFS.DiffIDs was changed: %v", mutator.config.RootFS.DiffIDs)
+	}
+	if len(mutator.config.History) != len(oldHistory) {
+		t.Errorf("config.History was changed: %v", mutator.config.History)
+	}
+
+	// Converting to the same compression is a no-op.
+	zstdLayer := mutator.manifest.Layers[0]
+	if err := mutator.Recompress(context.Background(), ZstdCompressor); err != nil {
+		t.Fatalf("unexpected error recompressing: %+v", err)
+	}
+	if mutator.manifest.Layers[0].Digest != zstdLayer.Digest {
+		t.Errorf("layer with the same compression was rewritten")
+	}
+
+	// An explicit compression level always rewrites the layer, since the
+	// level used for the existing layer is unknown.
+	zstdLevel, err := NewZstdCompressor(1)
+	if err != nil {
+		t.Fatalf("unexpected error creating compressor: %+v", err)
+	}
+	if err := mutator.Recompress(context.Background(), zstdLevel); err != nil {
+		t.Fatalf("unexpected error recompressing: %+v", err)
+	}
+	if mutator.manifest.Layers[0].Digest == zstdLayer.Digest {
+		t.Errorf("layer was not rewritten with the new compression level")
+	}
+	if mutator.manifest.Layers[0].MediaType != zstdLayer.MediaType {
+		t.Errorf("manifest.Layers[0].MediaType is the wrong value: %s", mutator.manifest.Layers[0].MediaType)
+	}
+
+	// Uncompressed layers have the DiffID as their digest.
+	if err := mutator.Recompress(context.Background(), NoopCompressor); err != nil {
+		t.Fatalf("unexpected error recompressing: %+v", err)
+	}
+	if mutator.manifest.Layers[0].MediaType != ispec.MediaTypeImageLayer {
+		t.Errorf("manifest.Layers[0].MediaType is the wrong value: %s", mutator.manifest.Layers[0].MediaType)
+	}
+	if mutator.manifest.Layers[0].Digest.String() != oldDiffIDs[0] {
+		t.Errorf("uncompressed layer digest %s doesn't match diffid %s", mutator.manifest.Layers[0].Digest, oldDiffIDs[0])
+	}
+}
+
+func TestMutateRecompressBadDiffID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateRecompressBadDiffID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	mutator, err := New(engine, fromDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+	// The layer created by setup() isn't actually compressed.
+	mutator.manifest.Layers[0].MediaType = ispec.MediaTypeImageLayer
+	mutator.config.RootFS.DiffIDs[0] = expectedConfigDigest
+
+	if err := mutator.Recompress(context.Background(), ZstdCompressor); err == nil {
+		t.Errorf("expected an error recompressing a layer with the wrong diffid")
+	}
+}
@@ -0,0 +1,138 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package mutate
+
+import (
+	"io"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/layer"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// squashHistory returns a copy of the given history with the entries of the
+// layers in the range [start, end) (and any empty-layer entries between them)
+// replaced by the given entry. An empty history is returned unmodified.
+func squashHistory(history []ispec.History, start, end, numLayers int, entry ispec.History) ([]ispec.History, error) {
+	if len(history) == 0 {
+		return history, nil
+	}
+
+	historyStart, historyEnd, layerIdx := -1, -1, 0
+	for idx, old := range history {
+		if old.EmptyLayer {
+			continue
+		}
+		if layerIdx == start {
+			historyStart = idx
+		}
+		if layerIdx == end-1 {
+			historyEnd = idx + 1
+		}
+		layerIdx++
+	}
+	if layerIdx != numLayers {
+		return nil, errors.Errorf("history has %d non-empty entries but image has %d layers", layerIdx, numLayers)
+	}
+
+	entry.EmptyLayer = false
+	var newHistory []ispec.History
+	newHistory = append(newHistory, history[:historyStart]...)
+	newHistory = append(newHistory, entry)
+	newHistory = append(newHistory, history[historyEnd:]...)
+	return newHistory, nil
+}
+
+// Squash replaces the layers in the range [start, end) (where 0 is the lowest
+// layer of the image) with a single layer containing the merged filesystem of
+// those layers, compressed using the compressor in opts (which may be nil).
+// Files which were overwritten or removed within the range are not included
+// in the new layer, and whiteouts are only kept if there are layers below
+// the range. The layers are merged by streaming them, without extracting
+// them. The DiffIDs of the image are updated, and the history entries of the
+// squashed layers are replaced by the given history entry.
+func (m *Mutator) Squash(ctx context.Context, start, end int, history ispec.History, opts *AddOptions) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+
+	layers := m.manifest.Layers
+	diffIDs := m.config.RootFS.DiffIDs
+	if len(layers) != len(diffIDs) {
+		return errors.Errorf("squash: manifest has %d layers but config has %d diffids", len(layers), len(diffIDs))
+	}
+	if start < 0 || end > len(layers) || start >= end {
+		return errors.Errorf("squash: invalid layer range [%d, %d) for image with %d layers", start, end, len(layers))
+	}
+
+	// Check the history before doing any work.
+	newHistory, err := squashHistory(m.config.History, start, end, len(layers), history)
+	if err != nil {
+		return errors.Wrap(err, "squash history")
+	}
+
+	// Squashing a non-distributable layer must not make its contents
+	// distributable.
+	baseMediaType := ispec.MediaTypeImageLayer
+	for _, descriptor := range layers[start:end] {
+		mediaType, err := baseLayerMediaType(descriptor.MediaType)
+		if err != nil {
+			return errors.Wrapf(err, "squash layer %s", descriptor.Digest)
+		}
+		if mediaType == ispec.MediaTypeImageLayerNonDistributable {
+			baseMediaType = mediaType
+		}
+	}
+
+	log.Infof("squash layers: %d to %d", start, end-1)
+	reader, writer := io.Pipe()
+	defer reader.Close()
+	go func() {
+		err := layer.SquashLayers(ctx, m.engine, writer, layers[start:end], diffIDs[start:end], &layer.SquashOptions{
+			KeepWhiteouts: start > 0,
+		})
+		writer.CloseWithError(err)
+	}()
+
+	compressor, reporter := addOptions(opts)
+	digest, size, diffID, err := m.add(ctx, reader, compressor, reporter, start)
+	if err != nil {
+		return errors.Wrap(err, "squash layers")
+	}
+
+	var newLayers []ispec.Descriptor
+	newLayers = append(newLayers, layers[:start]...)
+	newLayers = append(newLayers, ispec.Descriptor{
+		MediaType: layerMediaType(baseMediaType, compressor),
+		Digest:    digest,
+		Size:      size,
+	})
+	newLayers = append(newLayers, layers[end:]...)
+
+	var newDiffIDs []string
+	newDiffIDs = append(newDiffIDs, diffIDs[:start]...)
+	newDiffIDs = append(newDiffIDs, diffID)
+	newDiffIDs = append(newDiffIDs, diffIDs[end:]...)
+
+	m.manifest.Layers = newLayers
+	m.config.RootFS.DiffIDs = newDiffIDs
+	m.config.History = newHistory
+	m.configModified = true
+	return nil
+}
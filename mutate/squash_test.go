@@ -0,0 +1,175 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package mutate
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+// squashTestLayer returns an uncompressed layer containing the given
+// regular files (with an empty value being a whiteout).
+func squashTestLayer(t *testing.T, files ...string) io.Reader {
+	var buffer bytes.Buffer
+	tw := tar.NewWriter(&buffer)
+	for idx := 0; idx+1 < len(files); idx += 2 {
+		data := []byte(files[idx+1])
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     files[idx],
+			Mode:     0644,
+			Typeflag: tar.TypeReg,
+			Size:     int64(len(data)),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buffer
+}
+
+// readSquashedLayer returns the contents of the regular files in the given
+// uncompressed layer.
+func readSquashedLayer(t *testing.T, mutator *Mutator, descriptor ispec.Descriptor) map[string]string {
+	blob, err := mutator.engine.GetBlob(context.Background(), descriptor.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+
+	files := map[string]string{}
+	tr := tar.NewReader(blob)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("read squashed layer: %+v", err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("read squashed layer: %+v", err)
+		}
+		files[hdr.Name] = string(data)
+	}
+	return files
+}
+
+func TestMutateSquash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateSquash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	mutator, err := New(engine, fromDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+	// The layer created by setup() isn't actually compressed.
+	mutator.manifest.Layers[0].MediaType = ispec.MediaTypeImageLayer
+
+	// Add two layers, with a configuration change between them.
+	opts := &AddOptions{Compressor: NoopCompressor}
+	if err := mutator.Add(context.Background(), squashTestLayer(t, "a", "a1", "b", "b1"), ispec.History{CreatedBy: "layer 1"}, opts); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+	config, err := mutator.Config(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := mutator.Meta(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.Set(context.Background(), config, meta, nil, ispec.History{CreatedBy: "config"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.Add(context.Background(), squashTestLayer(t, "a", "a2", ".wh.b", ""), ispec.History{CreatedBy: "layer 2"}, opts); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+	baseLayer := mutator.manifest.Layers[0]
+	baseDiffID := mutator.config.RootFS.DiffIDs[0]
+
+	// Invalid ranges are rejected.
+	for _, bad := range [][2]int{{-1, 2}, {1, 4}, {2, 2}, {2, 1}} {
+		if err := mutator.Squash(context.Background(), bad[0], bad[1], ispec.History{}, opts); err == nil {
+			t.Errorf("expected an error squashing layers [%d, %d)", bad[0], bad[1])
+		}
+	}
+
+	// Squash the two new layers, which has to keep the whiteout.
+	if err := mutator.Squash(context.Background(), 1, 3, ispec.History{CreatedBy: "squash"}, opts); err != nil {
+		t.Fatalf("unexpected error squashing layers: %+v", err)
+	}
+	if len(mutator.manifest.Layers) != 2 || len(mutator.config.RootFS.DiffIDs) != 2 {
+		t.Fatalf("expected 2 layers after squash, got %d layers and %d diffids", len(mutator.manifest.Layers), len(mutator.config.RootFS.DiffIDs))
+	}
+	if mutator.manifest.Layers[0].Digest != baseLayer.Digest || mutator.config.RootFS.DiffIDs[0] != baseDiffID {
+		t.Errorf("layer below the squashed layers was modified")
+	}
+	if mutator.manifest.Layers[1].Digest.String() != mutator.config.RootFS.DiffIDs[1] {
+		t.Errorf("uncompressed layer digest %s doesn't match diffid %s", mutator.manifest.Layers[1].Digest, mutator.config.RootFS.DiffIDs[1])
+	}
+	var createdBy []string
+	for _, history := range mutator.config.History {
+		createdBy = append(createdBy, history.CreatedBy)
+	}
+	if expected := []string{"", "squash"}; !reflect.DeepEqual(createdBy, expected) {
+		t.Errorf("unexpected history after squash: expected %v, got %v", expected, createdBy)
+	}
+	got := readSquashedLayer(t, mutator, mutator.manifest.Layers[1])
+	if expected := map[string]string{"a": "a2", ".wh.b": ""}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("unexpected squashed layer: expected %v, got %v", expected, got)
+	}
+
+	// Squash everything, which doesn't need any whiteouts.
+	if err := mutator.Squash(context.Background(), 0, 2, ispec.History{CreatedBy: "squash all"}, opts); err != nil {
+		t.Fatalf("unexpected error squashing layers: %+v", err)
+	}
+	if len(mutator.manifest.Layers) != 1 || len(mutator.config.History) != 1 {
+		t.Fatalf("expected 1 layer after squash, got %d layers and %d history entries", len(mutator.manifest.Layers), len(mutator.config.History))
+	}
+	got = readSquashedLayer(t, mutator, mutator.manifest.Layers[0])
+	if expected := map[string]string{"test": "some contents", "a": "a2"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("unexpected squashed layer: expected %v, got %v", expected, got)
+	}
+
+	// The result must be a valid image.
+	if _, err := mutator.Commit(context.Background()); err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+}
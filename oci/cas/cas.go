@@ -49,6 +49,22 @@ var (
 	// ErrClobber is returned when a requested operation would require clobbering a
 	// reference or blob which already exists.
 	ErrClobber = fmt.Errorf("operation would clobber existing object")
+
+	// ErrDigestMismatch is returned when the contents of a blob don't match
+	// the digest it was expected to have.
+	ErrDigestMismatch = fmt.Errorf("blob digest does not match expected digest")
+
+	// ErrSizeMismatch is returned when the contents of a blob don't match the
+	// size it was expected to have.
+	ErrSizeMismatch = fmt.Errorf("blob size does not match expected size")
+
+	// ErrResumedDigestMismatch is returned when the contents of a blob don't
+	// match the digest it was expected to have after resuming a previous
+	// (failed) write of the blob, and the reader could not be rewound to
+	// write the blob again from the start. The reader's data might still be
+	// valid, as the data written by the previous attempt could have been the
+	// problem, so the write can be retried.
+	ErrResumedDigestMismatch = fmt.Errorf("resumed blob digest does not match expected digest")
 )
 
 // Engine is an interface that provides methods for accessing and modifying an
@@ -56,9 +72,26 @@ var (
 type Engine interface {
 	// PutBlob adds a new blob to the image. This is idempotent; a nil error
 	// means that "the content is stored at DIGEST" without implying "because
-	// of this PutBlob() call".
+	// of this PutBlob() call". Callers can report the progress of writing the
+	// blob by wrapping reader with progress.NewReader().
 	PutBlob(ctx context.Context, reader io.Reader) (digest digest.Digest, size int64, err error)
 
+	// PutBlobWithDescriptor adds a new blob to the image, which is expected
+	// to have the digest and size given in the descriptor. This is
+	// idempotent in the same way as PutBlob(). ErrDigestMismatch or
+	// ErrSizeMismatch are returned if the blob doesn't match the descriptor,
+	// in which case the blob is not stored. If the blob is already present
+	// in the image, the reader may not be read at all.
+	//
+	// Implementations may keep the data read from a failed call around, so
+	// that a later call with the same descriptor can resume from where the
+	// previous call stopped. If reader implements io.Seeker, the skipped data
+	// will be skipped with Seek(), otherwise it is read and discarded. If a
+	// resumed blob doesn't match the descriptor, it is written again from the
+	// start if reader implements io.Seeker, otherwise
+	// ErrResumedDigestMismatch is returned.
+	PutBlobWithDescriptor(ctx context.Context, reader io.Reader, descriptor ispec.Descriptor) (digest digest.Digest, size int64, err error)
+
 	// PutBlobJSON adds a new JSON blob to the image (marshalled from the given
 	// interface). This is equivalent to calling PutBlob() with a JSON payload
 	// as the reader. Note that due to intricacies in the Go JSON
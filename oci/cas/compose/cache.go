@@ -0,0 +1,262 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"io"
+	"os"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// cacheEngine is a read-through cache, which stores copies of blobs from a
+// slow backing engine in a fast front engine. The backing engine is always
+// treated as the authoritative source of references, while blobs are served
+// from the front engine whenever possible.
+type cacheEngine struct {
+	front cas.Engine
+	back  cas.Engine
+}
+
+// Cache returns a new cas.Engine that serves blobs from front, fetching (and
+// storing) any blobs that are missing in front from back. All modifications
+// are written through to back, and references are only ever read from back.
+// Because blobs are content-addressable, front can be shared between several
+// cache engines without issue.
+//
+// Closing the returned engine will close both front and back.
+func Cache(front, back cas.Engine) cas.Engine {
+	return &cacheEngine{
+		front: front,
+		back:  back,
+	}
+}
+
+// PutBlob adds a new blob to the image. This is idempotent; a nil error
+// means that "the content is stored at DIGEST" without implying "because
+// of this PutBlob() call".
+func (e *cacheEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Digest, int64, error) {
+	// We stream the blob into both engines at the same time, so that we
+	// don't have to buffer the whole blob or read it back from back.
+	pipeReader, pipeWriter := io.Pipe()
+	defer pipeReader.Close()
+
+	type result struct {
+		digest digest.Digest
+		size   int64
+		err    error
+	}
+	frontCh := make(chan result, 1)
+	go func() {
+		var res result
+		res.digest, res.size, res.err = e.front.PutBlob(ctx, pipeReader)
+		// Make sure that we don't block the writer if front gave up early.
+		pipeReader.CloseWithError(errors.Wrap(res.err, "cache engine: put front blob"))
+		frontCh <- res
+	}()
+
+	digest, size, err := e.back.PutBlob(ctx, io.TeeReader(reader, writerNoError{pipeWriter}))
+	pipeWriter.CloseWithError(err)
+	front := <-frontCh
+	if err != nil {
+		return "", -1, errors.Wrap(err, "put back blob")
+	}
+
+	// A failure to populate the cache is not fatal, because back is the
+	// authoritative store.
+	if front.err != nil {
+		log.Warnf("cache engine: failed to cache blob %s: %v", digest, front.err)
+	} else if front.digest != digest {
+		log.Warnf("cache engine: cached blob digest mismatch: got %s expected %s", front.digest, digest)
+		if err := e.front.DeleteBlob(ctx, front.digest); err != nil {
+			log.Warnf("cache engine: failed to remove bad cached blob %s: %v", front.digest, err)
+		}
+	}
+	return digest, size, nil
+}
+
+// PutBlobWithDescriptor adds a new blob to the image, which is expected to
+// have the digest and size given in the descriptor. ErrDigestMismatch or
+// ErrSizeMismatch are returned if the blob doesn't match the descriptor.
+func (e *cacheEngine) PutBlobWithDescriptor(ctx context.Context, reader io.Reader, descriptor ispec.Descriptor) (digest.Digest, int64, error) {
+	// The blob is written to front first, so that any resumption of a failed
+	// write happens on the fast engine. Since front has verified the blob,
+	// back is then written from the copy in front (and can skip the write if
+	// it already has the blob).
+	if _, _, err := e.front.PutBlobWithDescriptor(ctx, reader, descriptor); err != nil {
+		return "", -1, errors.Wrap(err, "put front blob")
+	}
+
+	fh, err := e.front.GetBlob(ctx, descriptor.Digest)
+	if err != nil {
+		return "", -1, errors.Wrap(err, "get front blob")
+	}
+	defer fh.Close()
+
+	digest, size, err := e.back.PutBlobWithDescriptor(ctx, fh, descriptor)
+	if err != nil {
+		return "", -1, errors.Wrap(err, "put back blob")
+	}
+	return digest, size, nil
+}
+
+// PutBlobJSON adds a new JSON blob to the image (marshalled from the given
+// interface). This is equivalent to calling PutBlob() with a JSON payload
+// as the reader. Note that due to intricacies in the Go JSON
+// implementation, we cannot guarantee that two calls to PutBlobJSON() will
+// return the same digest.
+func (e *cacheEngine) PutBlobJSON(ctx context.Context, data interface{}) (digest.Digest, int64, error) {
+	// We have to go through the back engine in order to make sure that the
+	// digest we return is the digest of the blob stored in back (because
+	// PutBlobJSON is not guaranteed to be stable).
+	digest, size, err := e.back.PutBlobJSON(ctx, data)
+	if err != nil {
+		return "", -1, errors.Wrap(err, "put back json blob")
+	}
+	if err := e.fetch(ctx, digest); err != nil {
+		log.Warnf("cache engine: failed to cache blob %s: %v", digest, err)
+	}
+	return digest, size, nil
+}
+
+// PutReference adds a new reference descriptor blob to the image. This is
+// idempotent; a nil error means that "the descriptor is stored at NAME"
+// without implying "because of this PutReference() call". ErrClobber is
+// returned if there is already a descriptor stored at NAME, but does not
+// match the descriptor requested to be stored.
+func (e *cacheEngine) PutReference(ctx context.Context, name string, descriptor ispec.Descriptor) error {
+	return e.back.PutReference(ctx, name, descriptor)
+}
+
+// fetch copies the blob with the given digest from back to front, verifying
+// that the copied blob has the correct digest. It is a no-op if the blob is
+// already present in front.
+func (e *cacheEngine) fetch(ctx context.Context, digest digest.Digest) error {
+	if fh, err := e.front.GetBlob(ctx, digest); err == nil {
+		fh.Close()
+		return nil
+	} else if !os.IsNotExist(errors.Cause(err)) {
+		return errors.Wrap(err, "check front blob")
+	}
+
+	reader, err := e.back.GetBlob(ctx, digest)
+	if err != nil {
+		return errors.Wrap(err, "get back blob")
+	}
+	defer reader.Close()
+
+	gotDigest, _, err := e.front.PutBlob(ctx, reader)
+	if err != nil {
+		return errors.Wrap(err, "put front blob")
+	}
+	if gotDigest != digest {
+		// Don't leave garbage in the cache.
+		if err := e.front.DeleteBlob(ctx, gotDigest); err != nil {
+			log.Warnf("cache engine: failed to remove bad cached blob %s: %v", gotDigest, err)
+		}
+		return errors.Wrapf(cas.ErrInvalid, "cached blob digest mismatch: got %s expected %s", gotDigest, digest)
+	}
+	return nil
+}
+
+// GetBlob returns a reader for retrieving a blob from the image, which the
+// caller must Close(). Returns os.ErrNotExist if the digest is not found.
+func (e *cacheEngine) GetBlob(ctx context.Context, digest digest.Digest) (io.ReadCloser, error) {
+	if err := e.fetch(ctx, digest); err != nil {
+		// If the blob doesn't exist in back, we have to return an error that
+		// satisfies os.IsNotExist. Otherwise we fall back to reading from
+		// back directly (the cache might be read-only or broken).
+		if os.IsNotExist(errors.Cause(err)) {
+			return nil, errors.Wrap(err, "fetch blob")
+		}
+		log.Warnf("cache engine: falling back to uncached blob %s: %v", digest, err)
+		return e.back.GetBlob(ctx, digest)
+	}
+	return e.front.GetBlob(ctx, digest)
+}
+
+// GetReference returns a reference from the image. Returns os.ErrNotExist
+// if the name was not found.
+func (e *cacheEngine) GetReference(ctx context.Context, name string) (ispec.Descriptor, error) {
+	return e.back.GetReference(ctx, name)
+}
+
+// DeleteBlob removes a blob from the image. This is idempotent; a nil
+// error means "the content is not in the store" without implying "because
+// of this DeleteBlob() call".
+func (e *cacheEngine) DeleteBlob(ctx context.Context, digest digest.Digest) error {
+	if err := e.back.DeleteBlob(ctx, digest); err != nil {
+		return errors.Wrap(err, "delete back blob")
+	}
+	return errors.Wrap(e.front.DeleteBlob(ctx, digest), "delete front blob")
+}
+
+// DeleteReference removes a reference from the image. This is idempotent;
+// a nil error means "the content is not in the store" without implying
+// "because of this DeleteReference() call".
+func (e *cacheEngine) DeleteReference(ctx context.Context, name string) error {
+	return e.back.DeleteReference(ctx, name)
+}
+
+// ListBlobs returns the set of blob digests stored in the image.
+func (e *cacheEngine) ListBlobs(ctx context.Context) ([]digest.Digest, error) {
+	return e.back.ListBlobs(ctx)
+}
+
+// ListReferences returns the set of reference names stored in the image.
+func (e *cacheEngine) ListReferences(ctx context.Context) ([]string, error) {
+	return e.back.ListReferences(ctx)
+}
+
+// Clean executes a garbage collection of any non-blob garbage in the store
+// (this includes temporary files and directories not reachable from the
+// CAS interface). This MUST NOT remove any blobs or references in the
+// store.
+func (e *cacheEngine) Clean(ctx context.Context) error {
+	if err := e.back.Clean(ctx); err != nil {
+		return errors.Wrap(err, "clean back")
+	}
+	return errors.Wrap(e.front.Clean(ctx), "clean front")
+}
+
+// Close releases all references held by the engine. Subsequent operations
+// may fail.
+func (e *cacheEngine) Close() error {
+	frontErr := e.front.Close()
+	if err := e.back.Close(); err != nil {
+		return errors.Wrap(err, "close back")
+	}
+	return errors.Wrap(frontErr, "close front")
+}
+
+// writerNoError wraps an io.Writer, ignoring all errors it returns. This is
+// used to make sure that a failure to write to the cache doesn't cause the
+// write to the backing engine to fail.
+type writerNoError struct {
+	w io.Writer
+}
+
+func (w writerNoError) Write(p []byte) (int, error) {
+	w.w.Write(p)
+	return len(p), nil
+}
@@ -0,0 +1,160 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package compose provides cas.Engine wrappers that can be stacked on top of
+// any other cas.Engine implementation (such as a read-through cache or an
+// engine that collects statistics). It also registers a cas.Driver, which
+// allows for these wrappers to be expressed as URIs of the form
+//
+//	cache(<front-uri>,<back-uri>)
+//	instrument(<uri>)
+//
+// Where each of the inner URIs can be any URI supported by a registered
+// driver (including other compose URIs). For example, the URI
+// "instrument(cache(/tmp/cache,/mnt/nfs/image))" refers to an instrumented
+// read-through cache with /tmp/cache in front of /mnt/nfs/image.
+package compose
+
+import (
+	"strings"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/pkg/errors"
+)
+
+// Driver is an implementation of cas.Driver for compose URIs.
+var Driver cas.Driver = composeDriver{}
+
+type composeDriver struct{}
+
+// parseURI splits a compose URI into the name of the wrapper and the set of
+// arguments (which are themselves URIs). Commas and parentheses inside nested
+// compose URIs are handled correctly, but are not supported in any other
+// URIs.
+func parseURI(uri string) (string, []string, error) {
+	open := strings.Index(uri, "(")
+	if open <= 0 || !strings.HasSuffix(uri, ")") {
+		return "", nil, errors.Errorf("compose: invalid uri: %s", uri)
+	}
+	name, inner := uri[:open], uri[open+1:len(uri)-1]
+
+	var (
+		args  []string
+		depth int
+		last  int
+	)
+	for idx, ch := range inner {
+		switch ch {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth < 0 {
+				return "", nil, errors.Errorf("compose: unbalanced parentheses: %s", uri)
+			}
+		case ',':
+			if depth == 0 {
+				args = append(args, inner[last:idx])
+				last = idx + 1
+			}
+		}
+	}
+	if depth != 0 {
+		return "", nil, errors.Errorf("compose: unbalanced parentheses: %s", uri)
+	}
+	args = append(args, inner[last:])
+	return name, args, nil
+}
+
+// Supported returns whether the resource at the given URI is supported by the
+// driver (used for auto-detection). If two drivers support the same URI, then
+// the earliest registered driver takes precedence.
+//
+// Note that this is _not_ a validation of the URI -- if the URI refers to an
+// invalid or non-existent resource it is expected that the URI is "supported".
+func (d composeDriver) Supported(uri string) bool {
+	name, _, err := parseURI(uri)
+	if err != nil {
+		return false
+	}
+	switch name {
+	case "cache", "instrument":
+		return true
+	}
+	return false
+}
+
+// Open "opens" a new CAS engine accessor for the given URI.
+func (d composeDriver) Open(uri string) (cas.Engine, error) {
+	name, args, err := parseURI(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	switch name {
+	case "cache":
+		if len(args) != 2 {
+			return nil, errors.Errorf("compose: cache requires two uris: %s", uri)
+		}
+		front, err := cas.Open(args[0])
+		if err != nil {
+			return nil, errors.Wrap(err, "open cache front")
+		}
+		back, err := cas.Open(args[1])
+		if err != nil {
+			front.Close()
+			return nil, errors.Wrap(err, "open cache back")
+		}
+		return Cache(front, back), nil
+	case "instrument":
+		if len(args) != 1 {
+			return nil, errors.Errorf("compose: instrument requires one uri: %s", uri)
+		}
+		engine, err := cas.Open(args[0])
+		if err != nil {
+			return nil, errors.Wrap(err, "open instrumented engine")
+		}
+		return Instrument(engine), nil
+	}
+	return nil, errors.Errorf("compose: unknown wrapper: %s", name)
+}
+
+// Create creates a new image at the provided URI. Every image referenced by
+// the URI that doesn't already exist is created.
+func (d composeDriver) Create(uri string) error {
+	_, args, err := parseURI(uri)
+	if err != nil {
+		return err
+	}
+
+	for _, arg := range args {
+		// Opening the image is the only generic way of checking whether it
+		// exists already.
+		if engine, err := cas.Open(arg); err == nil {
+			engine.Close()
+			continue
+		}
+		if err := cas.Create(arg); err != nil {
+			return errors.Wrapf(err, "create %s", arg)
+		}
+	}
+	return nil
+}
+
+func init() {
+	cas.Register(Driver)
+}
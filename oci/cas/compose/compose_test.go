@@ -0,0 +1,57 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseURI(t *testing.T) {
+	for _, test := range []struct {
+		uri  string
+		name string
+		args []string
+		err  bool
+	}{
+		{"instrument(/some/path)", "instrument", []string{"/some/path"}, false},
+		{"cache(/front,/back)", "cache", []string{"/front", "/back"}, false},
+		{"instrument(cache(/a,cache(/b,/c)))", "instrument", []string{"cache(/a,cache(/b,/c))"}, false},
+		{"cache(cache(/a,/b),/c)", "cache", []string{"cache(/a,/b)", "/c"}, false},
+		{"/some/path", "", nil, true},
+		{"(/some/path)", "", nil, true},
+		{"cache(/a,/b", "", nil, true},
+		{"cache(/a,(/b)", "", nil, true},
+		{"cache(/a),/b)", "", nil, true},
+	} {
+		name, args, err := parseURI(test.uri)
+		if test.err {
+			if err == nil {
+				t.Errorf("parseURI(%q): expected error, got %q %v", test.uri, name, args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseURI(%q): unexpected error: %+v", test.uri, err)
+			continue
+		}
+		if name != test.name || !reflect.DeepEqual(args, test.args) {
+			t.Errorf("parseURI(%q): got %q %v, expected %q %v", test.uri, name, args, test.name, test.args)
+		}
+	}
+}
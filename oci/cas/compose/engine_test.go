@@ -0,0 +1,258 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	. "github.com/openSUSE/umoci/oci/cas/compose"
+	"github.com/openSUSE/umoci/oci/cas/drivers/dir"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// NOTE: These tests live in a separate package, because importing the dir
+//       driver from package compose would cause it to be registered before
+//       the compose driver (and it would then claim all compose URIs).
+
+func TestCacheEngine(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestCacheEngine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	frontPath := filepath.Join(root, "front")
+	backPath := filepath.Join(root, "back")
+	for _, path := range []string{frontPath, backPath} {
+		if err := dir.Create(path); err != nil {
+			t.Fatalf("unexpected error creating image: %+v", err)
+		}
+	}
+
+	back, err := dir.Open(backPath)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	front, err := dir.Open(frontPath)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engine := Cache(front, back)
+	defer engine.Close()
+
+	// A blob that only exists in back should be fetched into front.
+	oldData := []byte("some blob stored in the slow engine")
+	oldDigest, _, err := back.PutBlob(ctx, bytes.NewReader(oldData))
+	if err != nil {
+		t.Fatalf("put back blob: %+v", err)
+	}
+	if _, err := front.GetBlob(ctx, oldDigest); !os.IsNotExist(errors.Cause(err)) {
+		t.Fatalf("blob unexpectedly in front before read: %+v", err)
+	}
+
+	reader, err := engine.GetBlob(ctx, oldDigest)
+	if err != nil {
+		t.Fatalf("get blob through cache: %+v", err)
+	}
+	gotData, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		t.Fatalf("read blob through cache: %+v", err)
+	}
+	if !bytes.Equal(gotData, oldData) {
+		t.Errorf("got unexpected blob data: %q", gotData)
+	}
+	if reader, err := front.GetBlob(ctx, oldDigest); err != nil {
+		t.Errorf("blob not cached in front after read: %+v", err)
+	} else {
+		reader.Close()
+	}
+
+	// A blob put through the cache should end up in both engines.
+	newData := []byte("some new blob")
+	newDigest, newSize, err := engine.PutBlob(ctx, bytes.NewReader(newData))
+	if err != nil {
+		t.Fatalf("put blob through cache: %+v", err)
+	}
+	if newSize != int64(len(newData)) {
+		t.Errorf("got unexpected blob size: %d", newSize)
+	}
+	for name, e := range map[string]cas.Engine{"front": front, "back": back} {
+		reader, err := e.GetBlob(ctx, newDigest)
+		if err != nil {
+			t.Errorf("blob not stored in %s: %+v", name, err)
+			continue
+		}
+		reader.Close()
+	}
+
+	// Verified blobs should also end up in both engines.
+	verifiedData := []byte("some verified blob")
+	verified := ispec.Descriptor{
+		Digest: cas.BlobAlgorithm.FromBytes(verifiedData),
+		Size:   int64(len(verifiedData)),
+	}
+	if _, _, err := engine.PutBlobWithDescriptor(ctx, bytes.NewReader(verifiedData), verified); err != nil {
+		t.Fatalf("put verified blob through cache: %+v", err)
+	}
+	for name, e := range map[string]cas.Engine{"front": front, "back": back} {
+		reader, err := e.GetBlob(ctx, verified.Digest)
+		if err != nil {
+			t.Errorf("verified blob not stored in %s: %+v", name, err)
+			continue
+		}
+		reader.Close()
+	}
+
+	// Missing blobs must still satisfy os.IsNotExist.
+	missing := cas.BlobAlgorithm.FromBytes([]byte("this blob doesn't exist"))
+	if _, err := engine.GetBlob(ctx, missing); !os.IsNotExist(errors.Cause(err)) {
+		t.Errorf("expected os.IsNotExist for missing blob, got %+v", err)
+	}
+
+	// References are only stored in back.
+	descriptor := ispec.Descriptor{
+		MediaType: ispec.MediaTypeDescriptor,
+		Digest:    newDigest,
+		Size:      newSize,
+	}
+	if err := engine.PutReference(ctx, "ref", descriptor); err != nil {
+		t.Fatalf("put reference through cache: %+v", err)
+	}
+	if _, err := back.GetReference(ctx, "ref"); err != nil {
+		t.Errorf("reference not stored in back: %+v", err)
+	}
+	if _, err := front.GetReference(ctx, "ref"); !os.IsNotExist(errors.Cause(err)) {
+		t.Errorf("reference unexpectedly stored in front: %+v", err)
+	}
+}
+
+func TestInstrumentedEngine(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestInstrumentedEngine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	inner, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engine := Instrument(inner)
+	defer engine.Close()
+
+	data := []byte("some instrumented blob")
+	digest, _, err := engine.PutBlob(ctx, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("put blob: %+v", err)
+	}
+	for i := 0; i < 2; i++ {
+		reader, err := engine.GetBlob(ctx, digest)
+		if err != nil {
+			t.Fatalf("get blob: %+v", err)
+		}
+		ioutil.ReadAll(reader)
+		reader.Close()
+	}
+	if _, err := engine.GetReference(ctx, "nonexistent"); err == nil {
+		t.Errorf("expected error getting non-existent reference")
+	}
+
+	stats := engine.Stats()
+	if stats.PutBlob.Calls != 1 || stats.PutBlob.Bytes != int64(len(data)) {
+		t.Errorf("unexpected PutBlob stats: %+v", stats.PutBlob)
+	}
+	if stats.GetBlob.Calls != 2 || stats.GetBlob.Bytes != 2*int64(len(data)) {
+		t.Errorf("unexpected GetBlob stats: %+v", stats.GetBlob)
+	}
+	if stats.GetReference.Calls != 1 || stats.GetReference.Errors != 1 {
+		t.Errorf("unexpected GetReference stats: %+v", stats.GetReference)
+	}
+	if stats.PutReference.Calls != 0 {
+		t.Errorf("unexpected PutReference stats: %+v", stats.PutReference)
+	}
+}
+
+func TestDriver(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestDriver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	frontPath := filepath.Join(root, "front")
+	backPath := filepath.Join(root, "back")
+	uri := "instrument(cache(" + frontPath + "," + backPath + "))"
+
+	if err := cas.Create(uri); err != nil {
+		t.Fatalf("unexpected error creating compose uri: %+v", err)
+	}
+	// Creating it again should not fail, since the images already exist.
+	if err := cas.Create(uri); err != nil {
+		t.Fatalf("unexpected error re-creating compose uri: %+v", err)
+	}
+
+	engine, err := cas.Open(uri)
+	if err != nil {
+		t.Fatalf("unexpected error opening compose uri: %+v", err)
+	}
+	defer engine.Close()
+
+	instrumented, ok := engine.(*InstrumentedEngine)
+	if !ok {
+		t.Fatalf("expected *InstrumentedEngine, got %T", engine)
+	}
+
+	digest, _, err := engine.PutBlob(ctx, bytes.NewReader([]byte("driver blob")))
+	if err != nil {
+		t.Fatalf("put blob: %+v", err)
+	}
+	if instrumented.Stats().PutBlob.Calls != 1 {
+		t.Errorf("PutBlob was not instrumented: %+v", instrumented.Stats())
+	}
+
+	for _, path := range []string{frontPath, backPath} {
+		inner, err := dir.Open(path)
+		if err != nil {
+			t.Fatalf("open %s: %+v", path, err)
+		}
+		if reader, err := inner.GetBlob(ctx, digest); err != nil {
+			t.Errorf("blob not stored in %s: %+v", path, err)
+		} else {
+			reader.Close()
+		}
+		inner.Close()
+	}
+}
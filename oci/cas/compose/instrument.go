@@ -0,0 +1,252 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+// MethodStats contains the statistics collected for a single cas.Engine
+// method by an InstrumentedEngine.
+type MethodStats struct {
+	// Calls is the number of times the method was called.
+	Calls uint64 `json:"calls"`
+
+	// Errors is the number of calls to the method that returned an error.
+	Errors uint64 `json:"errors"`
+
+	// Bytes is the number of blob bytes transferred by the method. For
+	// GetBlob this only includes bytes that were actually read by the caller.
+	Bytes int64 `json:"bytes"`
+
+	// Latency is the total time spent inside the method. For GetBlob this
+	// does not include the time spent reading from the returned reader.
+	Latency time.Duration `json:"latency"`
+}
+
+// Stats is a snapshot of the statistics collected by an InstrumentedEngine.
+type Stats struct {
+	PutBlob               MethodStats `json:"put_blob"`
+	PutBlobWithDescriptor MethodStats `json:"put_blob_with_descriptor"`
+	PutBlobJSON           MethodStats `json:"put_blob_json"`
+	PutReference          MethodStats `json:"put_reference"`
+	GetBlob               MethodStats `json:"get_blob"`
+	GetReference          MethodStats `json:"get_reference"`
+	DeleteBlob            MethodStats `json:"delete_blob"`
+	DeleteReference       MethodStats `json:"delete_reference"`
+	ListBlobs             MethodStats `json:"list_blobs"`
+	ListReferences        MethodStats `json:"list_references"`
+	Clean                 MethodStats `json:"clean"`
+}
+
+// InstrumentedEngine is a cas.Engine which records statistics about each
+// call made to the wrapped engine. It is safe for concurrent use.
+type InstrumentedEngine struct {
+	engine cas.Engine
+
+	lock  sync.Mutex
+	stats Stats
+}
+
+// Instrument returns a new InstrumentedEngine that wraps the given engine.
+// Closing the returned engine will close the wrapped engine.
+func Instrument(engine cas.Engine) *InstrumentedEngine {
+	return &InstrumentedEngine{
+		engine: engine,
+	}
+}
+
+// Stats returns a snapshot of the statistics collected so far.
+func (e *InstrumentedEngine) Stats() Stats {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.stats
+}
+
+// record updates the given MethodStats in a thread-safe manner.
+func (e *InstrumentedEngine) record(stats *MethodStats, start time.Time, bytes int64, err error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	stats.Calls++
+	if err != nil {
+		stats.Errors++
+	}
+	if bytes > 0 {
+		stats.Bytes += bytes
+	}
+	stats.Latency += time.Since(start)
+}
+
+// PutBlob adds a new blob to the image. This is idempotent; a nil error
+// means that "the content is stored at DIGEST" without implying "because
+// of this PutBlob() call".
+func (e *InstrumentedEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Digest, int64, error) {
+	start := time.Now()
+	digest, size, err := e.engine.PutBlob(ctx, reader)
+	e.record(&e.stats.PutBlob, start, size, err)
+	return digest, size, err
+}
+
+// PutBlobWithDescriptor adds a new blob to the image, which is expected to
+// have the digest and size given in the descriptor. ErrDigestMismatch or
+// ErrSizeMismatch are returned if the blob doesn't match the descriptor.
+func (e *InstrumentedEngine) PutBlobWithDescriptor(ctx context.Context, reader io.Reader, descriptor ispec.Descriptor) (digest.Digest, int64, error) {
+	start := time.Now()
+	digest, size, err := e.engine.PutBlobWithDescriptor(ctx, reader, descriptor)
+	e.record(&e.stats.PutBlobWithDescriptor, start, size, err)
+	return digest, size, err
+}
+
+// PutBlobJSON adds a new JSON blob to the image (marshalled from the given
+// interface). This is equivalent to calling PutBlob() with a JSON payload
+// as the reader. Note that due to intricacies in the Go JSON
+// implementation, we cannot guarantee that two calls to PutBlobJSON() will
+// return the same digest.
+func (e *InstrumentedEngine) PutBlobJSON(ctx context.Context, data interface{}) (digest.Digest, int64, error) {
+	start := time.Now()
+	digest, size, err := e.engine.PutBlobJSON(ctx, data)
+	e.record(&e.stats.PutBlobJSON, start, size, err)
+	return digest, size, err
+}
+
+// PutReference adds a new reference descriptor blob to the image. This is
+// idempotent; a nil error means that "the descriptor is stored at NAME"
+// without implying "because of this PutReference() call". ErrClobber is
+// returned if there is already a descriptor stored at NAME, but does not
+// match the descriptor requested to be stored.
+func (e *InstrumentedEngine) PutReference(ctx context.Context, name string, descriptor ispec.Descriptor) error {
+	start := time.Now()
+	err := e.engine.PutReference(ctx, name, descriptor)
+	e.record(&e.stats.PutReference, start, 0, err)
+	return err
+}
+
+// GetBlob returns a reader for retrieving a blob from the image, which the
+// caller must Close(). Returns os.ErrNotExist if the digest is not found.
+func (e *InstrumentedEngine) GetBlob(ctx context.Context, digest digest.Digest) (io.ReadCloser, error) {
+	start := time.Now()
+	reader, err := e.engine.GetBlob(ctx, digest)
+	e.record(&e.stats.GetBlob, start, 0, err)
+	if err != nil {
+		return nil, err
+	}
+	return &countingReader{ReadCloser: reader, engine: e}, nil
+}
+
+// GetReference returns a reference from the image. Returns os.ErrNotExist
+// if the name was not found.
+func (e *InstrumentedEngine) GetReference(ctx context.Context, name string) (ispec.Descriptor, error) {
+	start := time.Now()
+	descriptor, err := e.engine.GetReference(ctx, name)
+	e.record(&e.stats.GetReference, start, 0, err)
+	return descriptor, err
+}
+
+// DeleteBlob removes a blob from the image. This is idempotent; a nil
+// error means "the content is not in the store" without implying "because
+// of this DeleteBlob() call".
+func (e *InstrumentedEngine) DeleteBlob(ctx context.Context, digest digest.Digest) error {
+	start := time.Now()
+	err := e.engine.DeleteBlob(ctx, digest)
+	e.record(&e.stats.DeleteBlob, start, 0, err)
+	return err
+}
+
+// DeleteReference removes a reference from the image. This is idempotent;
+// a nil error means "the content is not in the store" without implying
+// "because of this DeleteReference() call".
+func (e *InstrumentedEngine) DeleteReference(ctx context.Context, name string) error {
+	start := time.Now()
+	err := e.engine.DeleteReference(ctx, name)
+	e.record(&e.stats.DeleteReference, start, 0, err)
+	return err
+}
+
+// ListBlobs returns the set of blob digests stored in the image.
+func (e *InstrumentedEngine) ListBlobs(ctx context.Context) ([]digest.Digest, error) {
+	start := time.Now()
+	digests, err := e.engine.ListBlobs(ctx)
+	e.record(&e.stats.ListBlobs, start, 0, err)
+	return digests, err
+}
+
+// ListReferences returns the set of reference names stored in the image.
+func (e *InstrumentedEngine) ListReferences(ctx context.Context) ([]string, error) {
+	start := time.Now()
+	names, err := e.engine.ListReferences(ctx)
+	e.record(&e.stats.ListReferences, start, 0, err)
+	return names, err
+}
+
+// Clean executes a garbage collection of any non-blob garbage in the store
+// (this includes temporary files and directories not reachable from the
+// CAS interface). This MUST NOT remove any blobs or references in the
+// store.
+func (e *InstrumentedEngine) Clean(ctx context.Context) error {
+	start := time.Now()
+	err := e.engine.Clean(ctx)
+	e.record(&e.stats.Clean, start, 0, err)
+	return err
+}
+
+// Close releases all references held by the engine. Subsequent operations
+// may fail. The collected statistics are logged (at the debug level) and are
+// still available through Stats after Close has been called.
+func (e *InstrumentedEngine) Close() error {
+	stats := e.Stats()
+	log.WithFields(log.Fields{
+		"put_blob":      stats.PutBlob,
+		"put_blob_desc": stats.PutBlobWithDescriptor,
+		"get_blob":      stats.GetBlob,
+		"put_json":      stats.PutBlobJSON,
+		"put_ref":       stats.PutReference,
+		"get_ref":       stats.GetReference,
+		"del_blob":      stats.DeleteBlob,
+		"del_ref":       stats.DeleteReference,
+		"list_blob":     stats.ListBlobs,
+		"list_ref":      stats.ListReferences,
+		"clean":         stats.Clean,
+	}).Debugf("instrumented engine: statistics")
+	return e.engine.Close()
+}
+
+// countingReader wraps the reader returned by GetBlob, recording the number
+// of bytes read in the InstrumentedEngine's statistics.
+type countingReader struct {
+	io.ReadCloser
+	engine *InstrumentedEngine
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.engine.lock.Lock()
+		r.engine.stats.GetBlob.Bytes += int64(n)
+		r.engine.lock.Unlock()
+	}
+	return n, err
+}
@@ -22,6 +22,9 @@ package drivers
 
 // Import all official OCI drivers.
 import (
+	// Implements stackable wrapper URIs, such as read-through caches.
+	_ "github.com/openSUSE/umoci/oci/cas/compose"
+
 	// Implements directory-backed OCI layouts.
 	_ "github.com/openSUSE/umoci/oci/cas/drivers/dir"
 )
@@ -28,6 +28,7 @@ import (
 	"testing"
 
 	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
@@ -243,6 +244,265 @@ func TestEngineBlobJSON(t *testing.T) {
 	}
 }
 
+func TestEngineBlobWithDescriptor(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineBlobWithDescriptor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer engine.Close()
+
+	data := []byte("some blob with a known descriptor")
+	descriptor := ispec.Descriptor{
+		Digest: digest.FromBytes(data),
+		Size:   int64(len(data)),
+	}
+
+	for _, test := range []struct {
+		name     string
+		bytes    []byte
+		expected error
+	}{
+		{"digest", bytes.Repeat([]byte("X"), len(data)), cas.ErrDigestMismatch},
+		{"oversize", append(append([]byte{}, data...), 'X'), cas.ErrSizeMismatch},
+		{"undersize", data[:len(data)-1], cas.ErrSizeMismatch},
+	} {
+		_, _, err := engine.PutBlobWithDescriptor(ctx, bytes.NewReader(test.bytes), descriptor)
+		if errors.Cause(err) != test.expected {
+			t.Errorf("PutBlobWithDescriptor(%s): expected %v, got %+v", test.name, test.expected, err)
+		}
+		if br, err := engine.GetBlob(ctx, descriptor.Digest); !os.IsNotExist(errors.Cause(err)) {
+			if err == nil {
+				br.Close()
+			}
+			t.Errorf("PutBlobWithDescriptor(%s): blob was stored despite mismatch: %+v", test.name, err)
+		}
+	}
+
+	// The undersized blob above left a valid partial blob, so we can finish
+	// the write by only providing the missing byte.
+	gotDigest, size, err := engine.PutBlobWithDescriptor(ctx, &countingSeeker{Reader: bytes.NewReader(data)}, descriptor)
+	if err != nil {
+		t.Fatalf("PutBlobWithDescriptor: unexpected error: %+v", err)
+	}
+	if gotDigest != descriptor.Digest || size != descriptor.Size {
+		t.Errorf("PutBlobWithDescriptor: got %s (%d), expected %s (%d)", gotDigest, size, descriptor.Digest, descriptor.Size)
+	}
+
+	// Writing an existing blob shouldn't read anything.
+	if _, _, err := engine.PutBlobWithDescriptor(ctx, failReader{}, descriptor); err != nil {
+		t.Errorf("PutBlobWithDescriptor: unexpected error with existing blob: %+v", err)
+	}
+
+	blobReader, err := engine.GetBlob(ctx, descriptor.Digest)
+	if err != nil {
+		t.Fatalf("GetBlob: unexpected error: %+v", err)
+	}
+	defer blobReader.Close()
+	if gotBytes, err := ioutil.ReadAll(blobReader); err != nil {
+		t.Errorf("GetBlob: failed to ReadAll: %+v", err)
+	} else if !bytes.Equal(data, gotBytes) {
+		t.Errorf("GetBlob: bytes did not match: expected=%s got=%s", string(data), string(gotBytes))
+	}
+}
+
+func TestEngineBlobWithDescriptorResume(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineBlobWithDescriptorResume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer engine.Close()
+
+	data := bytes.Repeat([]byte("resumable blob data "), 4096)
+	descriptor := ispec.Descriptor{
+		Digest: digest.FromBytes(data),
+		Size:   int64(len(data)),
+	}
+
+	// Simulate a connection that drops halfway through.
+	half := int64(len(data) / 2)
+	reader := io.MultiReader(io.LimitReader(bytes.NewReader(data), half), failReader{})
+	if _, _, err := engine.PutBlobWithDescriptor(ctx, reader, descriptor); err == nil {
+		t.Fatalf("PutBlobWithDescriptor: expected error with failing reader")
+	}
+
+	// Garbage collection between the attempts must not remove the partial
+	// blob.
+	if err := engine.Clean(ctx); err != nil {
+		t.Fatalf("Clean: unexpected error: %+v", err)
+	}
+
+	// The next attempt must only read the second half of the blob.
+	seeker := &countingSeeker{Reader: bytes.NewReader(data)}
+	if _, _, err := engine.PutBlobWithDescriptor(ctx, seeker, descriptor); err != nil {
+		t.Fatalf("PutBlobWithDescriptor: unexpected error resuming: %+v", err)
+	}
+	if seeker.read != int64(len(data))-half {
+		t.Errorf("PutBlobWithDescriptor: expected resumed write to read %d bytes, read %d", int64(len(data))-half, seeker.read)
+	}
+
+	// The partial blob must be gone.
+	if matches, err := filepath.Glob(filepath.Join(image, partialPrefix+"*")); err != nil {
+		t.Fatal(err)
+	} else if len(matches) > 0 {
+		t.Errorf("partial blobs left over after successful write: %v", matches)
+	}
+}
+
+func TestEngineBlobWithDescriptorBadPartial(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineBlobWithDescriptorBadPartial")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer engine.Close()
+
+	data := bytes.Repeat([]byte("resumable blob data "), 4096)
+	descriptor := ispec.Descriptor{
+		Digest: digest.FromBytes(data),
+		Size:   int64(len(data)),
+	}
+	partial, err := partialPath(descriptor.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	partial = filepath.Join(image, partial)
+	garbage := bytes.Repeat([]byte("X"), len(data)/2)
+
+	// If the reader can't be rewound, we can't tell whether the reader or the
+	// previous attempt was at fault.
+	if err := ioutil.WriteFile(partial, garbage, 0644); err != nil {
+		t.Fatal(err)
+	}
+	reader := struct{ io.Reader }{bytes.NewReader(data)}
+	if _, _, err := engine.PutBlobWithDescriptor(ctx, reader, descriptor); errors.Cause(err) != cas.ErrResumedDigestMismatch {
+		t.Errorf("PutBlobWithDescriptor: expected %v with bad partial blob, got %+v", cas.ErrResumedDigestMismatch, err)
+	}
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Errorf("bad partial blob was not removed: %v", err)
+	}
+
+	// Otherwise the whole blob is read again (after the remainder was read
+	// while resuming).
+	if err := ioutil.WriteFile(partial, garbage, 0644); err != nil {
+		t.Fatal(err)
+	}
+	seeker := &countingSeeker{Reader: bytes.NewReader(data)}
+	if _, _, err := engine.PutBlobWithDescriptor(ctx, seeker, descriptor); err != nil {
+		t.Fatalf("PutBlobWithDescriptor: unexpected error with bad partial blob: %+v", err)
+	}
+	if expected := int64(len(data)-len(garbage)) + int64(len(data)); seeker.read != expected {
+		t.Errorf("PutBlobWithDescriptor: expected %d bytes to be read, read %d", expected, seeker.read)
+	}
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Errorf("partial blob left over after successful write: %v", err)
+	}
+
+	blobReader, err := engine.GetBlob(ctx, descriptor.Digest)
+	if err != nil {
+		t.Fatalf("GetBlob: unexpected error: %+v", err)
+	}
+	defer blobReader.Close()
+	if gotBytes, err := ioutil.ReadAll(blobReader); err != nil {
+		t.Errorf("GetBlob: failed to ReadAll: %+v", err)
+	} else if !bytes.Equal(data, gotBytes) {
+		t.Errorf("GetBlob: bytes did not match")
+	}
+}
+
+// TestIsCurrentFile makes sure that a partial blob which was published (or
+// removed) by another writer after we opened it is detected.
+func TestIsCurrentFile(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestIsCurrentFile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	path := filepath.Join(root, "partial")
+	fh, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+
+	if current, err := isCurrentFile(fh, path); err != nil || !current {
+		t.Errorf("isCurrentFile: expected open file to be current: %v (%+v)", current, err)
+	}
+
+	// The file has been published.
+	if err := os.Rename(path, filepath.Join(root, "blob")); err != nil {
+		t.Fatal(err)
+	}
+	if current, err := isCurrentFile(fh, path); err != nil || current {
+		t.Errorf("isCurrentFile: expected renamed file to not be current: %v (%+v)", current, err)
+	}
+
+	// A new partial blob has been created.
+	if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if current, err := isCurrentFile(fh, path); err != nil || current {
+		t.Errorf("isCurrentFile: expected replaced file to not be current: %v (%+v)", current, err)
+	}
+}
+
+// failReader is an io.Reader that always fails.
+type failReader struct{}
+
+func (failReader) Read([]byte) (int, error) {
+	return 0, errors.New("failReader")
+}
+
+// countingSeeker is an io.ReadSeeker which counts the number of bytes read.
+type countingSeeker struct {
+	*bytes.Reader
+	read int64
+}
+
+func (r *countingSeeker) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.read += int64(n)
+	return n, err
+}
+
 func TestEngineReference(t *testing.T) {
 	ctx := context.Background()
 
@@ -25,6 +25,7 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 
 	"github.com/openSUSE/umoci/oci/cas"
 	"github.com/openSUSE/umoci/pkg/system"
@@ -50,6 +51,13 @@ const (
 	// layoutFile is the file in side an OCI image the indicates what version
 	// of the OCI spec the image is.
 	layoutFile = "oci-layout"
+
+	// partialPrefix is the prefix of files inside an OCI image that contain
+	// the partially-written contents of a blob being written with
+	// PutBlobWithDescriptor. They are stored outside of the engine's temporary
+	// directory (and are skipped by Clean) so that they survive until the next
+	// attempt to write the blob.
+	partialPrefix = "partial-"
 )
 
 // blobPath returns the path to a blob given its digest, relative to the root
@@ -69,6 +77,15 @@ func blobPath(digest digest.Digest) (string, error) {
 	return filepath.Join(blobDirectory, algo.String(), hash), nil
 }
 
+// partialPath returns the path to the partially-written contents of a blob
+// given its digest, relative to the root of the OCI image.
+func partialPath(digest digest.Digest) (string, error) {
+	if _, err := blobPath(digest); err != nil {
+		return "", err
+	}
+	return partialPrefix + digest.Algorithm().String() + "-" + digest.Hex(), nil
+}
+
 // refPath returns the path to a reference given its name, relative to the r
 // oot of the OCI image.
 func refPath(name string) (string, error) {
@@ -192,6 +209,241 @@ func (e *dirEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Diges
 	return digester.Digest(), int64(size), nil
 }
 
+// PutBlobWithDescriptor adds a new blob to the image, which is expected to
+// have the digest and size given in the descriptor. If a previous call with
+// the same descriptor failed, the data it managed to write is re-used and only
+// the remainder is read from the reader.
+func (e *dirEngine) PutBlobWithDescriptor(ctx context.Context, reader io.Reader, descriptor ispec.Descriptor) (digest.Digest, int64, error) {
+	path, err := blobPath(descriptor.Digest)
+	if err != nil {
+		return "", -1, errors.Wrap(err, "compute blob name")
+	}
+	path = filepath.Join(e.path, path)
+	if descriptor.Size < 0 {
+		return "", -1, errors.Wrapf(cas.ErrInvalid, "invalid descriptor size: %d", descriptor.Size)
+	}
+
+	// Nothing to do if the blob already exists.
+	if exists, err := blobExists(path, descriptor); err != nil {
+		return "", -1, err
+	} else if exists {
+		return descriptor.Digest, descriptor.Size, nil
+	}
+
+	fh, err := e.openPartial(descriptor.Digest)
+	if err != nil {
+		return "", -1, errors.Wrap(err, "open partial blob")
+	}
+	partial := fh.Name()
+	defer fh.Close()
+
+	// Another writer might have finished writing the blob before we took the
+	// lock, in which case the partial blob we have is a new (empty) file.
+	if exists, err := blobExists(path, descriptor); err != nil {
+		return "", -1, err
+	} else if exists {
+		os.Remove(partial)
+		return descriptor.Digest, descriptor.Size, nil
+	}
+
+	// Remember where the reader starts, so that we can start again from
+	// scratch if the data written by a previous attempt turns out to be bad.
+	seeker, canSeek := reader.(io.Seeker)
+	var start int64
+	if canSeek {
+		start, err = seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return "", -1, errors.Wrap(err, "get reader offset")
+		}
+	}
+
+	resumed, err := writePartial(fh, reader, descriptor, true)
+	if errors.Cause(err) == cas.ErrDigestMismatch && resumed > 0 {
+		// We can't tell whether the reader or the previous attempt provided
+		// the bad data, so we have to read the whole blob again.
+		if !canSeek {
+			os.Remove(partial)
+			return "", -1, errors.Wrapf(cas.ErrResumedDigestMismatch, "blob resumed after %d bytes has digest mismatch", resumed)
+		}
+		if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+			return "", -1, errors.Wrap(err, "rewind reader")
+		}
+		_, err = writePartial(fh, reader, descriptor, false)
+	}
+	if err != nil {
+		// Keep the partial blob around (so the next attempt can resume)
+		// unless it was thrown away because it was garbage.
+		if fi, statErr := fh.Stat(); statErr == nil && fi.Size() == 0 {
+			os.Remove(partial)
+		}
+		return "", -1, err
+	}
+
+	// Move the blob to its correct path. This has to be done while we still
+	// hold the lock on the partial blob, otherwise another writer could start
+	// writing to the file we're publishing.
+	if err := os.Rename(partial, path); err != nil {
+		return "", -1, errors.Wrap(err, "rename partial blob")
+	}
+
+	return descriptor.Digest, descriptor.Size, nil
+}
+
+// blobExists returns whether the blob at the given path (with the given
+// descriptor) already exists. We only check the size, since the blob path is
+// the digest of the contents.
+func blobExists(path string, descriptor ispec.Descriptor) (bool, error) {
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Wrap(err, "stat existing blob")
+	}
+	if fi.Size() != descriptor.Size {
+		return false, errors.Wrapf(cas.ErrSizeMismatch, "existing blob %s has size %d, expected %d", descriptor.Digest, fi.Size(), descriptor.Size)
+	}
+	return true, nil
+}
+
+// writePartial writes the blob with the given descriptor to the (locked)
+// partial blob fh, reading it from reader. If resume is set, the data already
+// in fh is re-used and only the remainder is read from the reader (the number
+// of re-used bytes is returned), otherwise fh is truncated first. If the data
+// doesn't match the descriptor because it is garbage, fh is truncated so that
+// the next attempt starts again.
+func writePartial(fh *os.File, reader io.Reader, descriptor ispec.Descriptor, resume bool) (int64, error) {
+	// Hash whatever was written by previous attempts. If there is more data
+	// than we expected, the partial blob is garbage and we start again.
+	digester := cas.BlobAlgorithm.Digester()
+	var offset int64
+	if resume {
+		var err error
+		offset, err = io.Copy(digester.Hash(), fh)
+		if err != nil {
+			return 0, errors.Wrap(err, "hash partial blob")
+		}
+	}
+	if !resume || offset > descriptor.Size {
+		if err := truncatePartial(fh); err != nil {
+			return 0, err
+		}
+		digester = cas.BlobAlgorithm.Digester()
+		offset = 0
+	}
+
+	// Skip the part of the blob we already have.
+	if offset > 0 {
+		var err error
+		if seeker, ok := reader.(io.Seeker); ok {
+			_, err = seeker.Seek(offset, io.SeekCurrent)
+		} else {
+			_, err = io.CopyN(ioutil.Discard, reader, offset)
+		}
+		if err != nil {
+			return offset, errors.Wrap(err, "skip already written data")
+		}
+	}
+
+	// Copy the remainder, reading at most one byte more than we expect so
+	// that oversized blobs are detected without reading them in full.
+	writer := io.MultiWriter(fh, digester.Hash())
+	n, err := io.Copy(writer, io.LimitReader(reader, descriptor.Size-offset+1))
+	size := offset + n
+	if err != nil {
+		// Keep the partial blob around, so the next attempt can resume.
+		return offset, errors.Wrap(err, "copy to partial blob")
+	}
+	if size > descriptor.Size {
+		if err := truncatePartial(fh); err != nil {
+			return offset, err
+		}
+		return offset, errors.Wrapf(cas.ErrSizeMismatch, "blob is larger than expected size %d", descriptor.Size)
+	}
+	if size < descriptor.Size {
+		// The reader ended early. What we have so far might still be valid,
+		// so we keep it around for the next attempt.
+		return offset, errors.Wrapf(cas.ErrSizeMismatch, "blob has size %d, expected %d", size, descriptor.Size)
+	}
+	if digester.Digest() != descriptor.Digest {
+		if err := truncatePartial(fh); err != nil {
+			return offset, err
+		}
+		return offset, errors.Wrapf(cas.ErrDigestMismatch, "blob has digest %s, expected %s", digester.Digest(), descriptor.Digest)
+	}
+	return offset, nil
+}
+
+// truncatePartial throws away the contents of the partial blob fh.
+func truncatePartial(fh *os.File) error {
+	if err := fh.Truncate(0); err != nil {
+		return errors.Wrap(err, "truncate partial blob")
+	}
+	if _, err := fh.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrap(err, "seek partial blob")
+	}
+	return nil
+}
+
+// openPartial opens (and locks) the file storing the partially-written
+// contents of the blob with the given digest. If the file is already locked
+// by another writer, a new temporary file is used instead (which means that
+// the write cannot be resumed). The lock is released when the file is closed.
+func (e *dirEngine) openPartial(digest digest.Digest) (*os.File, error) {
+	path, err := partialPath(digest)
+	if err != nil {
+		return nil, errors.Wrap(err, "compute partial blob name")
+	}
+	path = filepath.Join(e.path, path)
+
+	for {
+		fh, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, errors.Wrap(err, "open")
+		}
+		if err := system.Flock(fh.Fd(), true); err != nil {
+			fh.Close()
+			break
+		}
+
+		// The previous holder of the lock might have renamed (or removed)
+		// the file after we opened it, in which case we have to try again
+		// with the file which is now at the path.
+		current, err := isCurrentFile(fh, path)
+		if err != nil {
+			fh.Close()
+			return nil, err
+		}
+		if current {
+			return fh, nil
+		}
+		fh.Close()
+	}
+
+	// Someone else is writing the same blob. We can't touch their partial
+	// blob, so we just write our own copy.
+	if err := e.ensureTempDir(); err != nil {
+		return nil, errors.Wrap(err, "ensure tempdir")
+	}
+	fh, err := ioutil.TempFile(e.temp, "blob-")
+	return fh, errors.Wrap(err, "create temporary blob")
+}
+
+// isCurrentFile returns whether the open file fh is still the file at the
+// given path (it may have been renamed or removed since it was opened).
+func isCurrentFile(fh *os.File, path string) (bool, error) {
+	fi, err := fh.Stat()
+	if err != nil {
+		return false, errors.Wrap(err, "stat open file")
+	}
+	pathFi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Wrap(err, "stat path")
+	}
+	return os.SameFile(fi, pathFi), nil
+}
+
 // PutBlobJSON adds a new JSON blob to the image (marshalled from the given
 // interface). This is equivalent to calling PutBlob() with a JSON payload
 // as the reader. Note that due to intricacies in the Go JSON
@@ -385,6 +637,11 @@ func (e *dirEngine) Clean(ctx context.Context) error {
 		case blobDirectory, refDirectory, layoutFile:
 			continue
 		}
+		// Partial blobs are kept so that failed writes can be resumed. They
+		// are removed once the blob has been written.
+		if strings.HasPrefix(child.Name(), partialPrefix) {
+			continue
+		}
 
 		// Try to get a lock on the directory.
 		path := filepath.Join(e.path, child.Name())
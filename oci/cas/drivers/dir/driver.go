@@ -19,6 +19,7 @@ package dir
 
 import (
 	"os"
+	"strings"
 
 	"github.com/openSUSE/umoci/oci/cas"
 )
@@ -40,13 +41,25 @@ func (d dirDriver) Supported(uri string) bool {
 	if err != nil {
 		// If we got an error, we only support it if the error is that the
 		// target doesn't exist -- Create handles creating the necessary
-		// directories.
+		// directories. Non-existent paths of the form "name(...)" are
+		// reserved for wrapper drivers (such as oci/cas/compose), which we
+		// can't rely on being registered before us.
+		if isWrapperURI(uri) {
+			return false
+		}
 		return os.IsNotExist(err)
 	}
 	// dir stands for directory
 	return fi.IsDir()
 }
 
+// isWrapperURI returns whether the given URI looks like a wrapper URI of the
+// form "name(...)".
+func isWrapperURI(uri string) bool {
+	open := strings.Index(uri, "(")
+	return open > 0 && !strings.Contains(uri[:open], "/") && strings.HasSuffix(uri, ")")
+}
+
 // Open "opens" a new CAS engine accessor for the given URI.
 func (d dirDriver) Open(uri string) (cas.Engine, error) {
 	return Open(uri)
@@ -50,6 +50,10 @@ type Blob struct {
 	// ispec.MediaTypeImageLayerGzip => io.ReadCloser
 	// ispec.MediaTypeImageLayerNonDistributable => io.ReadCloser
 	// ispec.MediaTypeImageLayerNonDistributableGzip => io.ReadCloser
+	// MediaTypeImageLayerZstd => io.ReadCloser
+	// MediaTypeImageLayerNonDistributableZstd => io.ReadCloser
+	// MediaTypeImageLayerXz => io.ReadCloser
+	// MediaTypeImageLayerNonDistributableXz => io.ReadCloser
 	// ispec.MediaTypeImageConfig => ispec.Image
 	Data interface{}
 }
@@ -62,13 +66,9 @@ func (b *Blob) load(ctx context.Context, engine cas.Engine) error {
 
 	// The layer media types are special, we don't want to do any parsing (or
 	// close the blob reference).
-	switch b.MediaType {
-	// ispec.MediaTypeImageLayer => io.ReadCloser
-	// ispec.MediaTypeImageLayerGzip => io.ReadCloser
-	// ispec.MediaTypeImageLayerNonDistributable => io.ReadCloser
-	// ispec.MediaTypeImageLayerNonDistributableGzip => io.ReadCloser
-	case ispec.MediaTypeImageLayer, ispec.MediaTypeImageLayerNonDistributable,
-		ispec.MediaTypeImageLayerGzip, ispec.MediaTypeImageLayerNonDistributableGzip:
+	// See IsLayerMediaType for the full list of layer media types, all of
+	// which map to io.ReadCloser.
+	if IsLayerMediaType(b.MediaType) {
 		// There isn't anything else we can practically do here.
 		b.Data = reader
 		return nil
@@ -125,9 +125,7 @@ func (b *Blob) load(ctx context.Context, engine cas.Engine) error {
 
 // Close cleans up all of the resources for the opened blob.
 func (b *Blob) Close() {
-	switch b.MediaType {
-	case ispec.MediaTypeImageLayer, ispec.MediaTypeImageLayerNonDistributable,
-		ispec.MediaTypeImageLayerGzip, ispec.MediaTypeImageLayerNonDistributableGzip:
+	if IsLayerMediaType(b.MediaType) {
 		if b.Data != nil {
 			b.Data.(io.Closer).Close()
 		}
@@ -0,0 +1,59 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Layer media types which are not (yet) defined by the image-spec. They
+// follow the same "+<compression>" naming scheme as the gzip media types
+// defined by the image-spec, and are used by other tools in the wild.
+const (
+	// MediaTypeImageLayerZstd is the media type used for zstd compressed
+	// layers referenced by the manifest.
+	MediaTypeImageLayerZstd = "application/vnd.oci.image.layer.v1.tar+zstd"
+
+	// MediaTypeImageLayerNonDistributableZstd is the media type for zstd
+	// compressed layers referenced by the manifest but with distribution
+	// restrictions.
+	MediaTypeImageLayerNonDistributableZstd = "application/vnd.oci.image.layer.nondistributable.v1.tar+zstd"
+
+	// MediaTypeImageLayerXz is the media type used for xz compressed layers
+	// referenced by the manifest.
+	MediaTypeImageLayerXz = "application/vnd.oci.image.layer.v1.tar+xz"
+
+	// MediaTypeImageLayerNonDistributableXz is the media type for xz
+	// compressed layers referenced by the manifest but with distribution
+	// restrictions.
+	MediaTypeImageLayerNonDistributableXz = "application/vnd.oci.image.layer.nondistributable.v1.tar+xz"
+)
+
+// IsLayerMediaType returns whether the given media type is the media type of
+// an image layer blob (compressed or otherwise). This includes both
+// distributable and non-distributable layers.
+func IsLayerMediaType(mediaType string) bool {
+	switch mediaType {
+	case ispec.MediaTypeImageLayer, ispec.MediaTypeImageLayerNonDistributable,
+		ispec.MediaTypeImageLayerGzip, ispec.MediaTypeImageLayerNonDistributableGzip,
+		MediaTypeImageLayerZstd, MediaTypeImageLayerNonDistributableZstd,
+		MediaTypeImageLayerXz, MediaTypeImageLayerNonDistributableXz:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,190 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package convert
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/openSUSE/umoci/third_party/user"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+// ToImageConfig is the inverse of MutateRuntimeSpec. It returns a copy of the
+// image configuration, updated with the changes that have been made to spec
+// since it was generated from the image with MutateRuntimeSpec (with the
+// same rootfs, image and manifest). Only the fields of spec which were changed
+// are converted back, so that the rest of the image configuration is left
+// untouched.
+//
+// process.cwd is converted to Config.WorkingDir, and process.env is converted
+// to Config.Env (without the HOME variable added by MutateRuntimeSpec).
+// process.args is converted to Config.Cmd, but if it starts with the existing
+// Config.Entrypoint then the entrypoint is kept and only the remaining
+// arguments are used for Config.Cmd (otherwise Config.Entrypoint is cleared).
+// process.user.uid and process.user.gid are converted to Config.User, using
+// the names in the passwd and group files of rootfs if possible. Annotations
+// are converted to Config.Labels, except for those which come from the
+// manifest annotations.
+//
+// All other changes to spec (such as process.user.additionalGids or mounts)
+// are ignored, because they cannot be represented in an image configuration.
+func ToImageConfig(spec rspec.Spec, rootfs string, image ispec.Image, manifest ispec.Manifest) (ispec.ImageConfig, error) {
+	orig, err := ToRuntimeSpec(rootfs, image, manifest)
+	if err != nil {
+		return ispec.ImageConfig{}, errors.Wrap(err, "generate original runtime spec")
+	}
+	config := image.Config
+
+	if spec.Process.Cwd != orig.Process.Cwd {
+		config.WorkingDir = spec.Process.Cwd
+	}
+
+	if !reflect.DeepEqual(spec.Process.Env, orig.Process.Env) {
+		env, err := toImageEnv(spec.Process.Env, orig.Process.Env, image.Config.Env)
+		if err != nil {
+			return ispec.ImageConfig{}, errors.Wrap(err, "parsing process.env")
+		}
+		config.Env = env
+	}
+
+	if !reflect.DeepEqual(spec.Process.Args, orig.Process.Args) {
+		if len(spec.Process.Args) == 0 {
+			return ispec.ImageConfig{}, errors.Errorf("process.args must not be empty")
+		}
+		config.Entrypoint, config.Cmd = splitArgs(spec.Process.Args, image.Config.Entrypoint)
+	}
+
+	if spec.Process.User.UID != orig.Process.User.UID || spec.Process.User.GID != orig.Process.User.GID {
+		userSpec, err := toUserSpec(rootfs, spec.Process.User.UID, spec.Process.User.GID)
+		if err != nil {
+			return ispec.ImageConfig{}, errors.Wrap(err, "parsing process.user")
+		}
+		config.User = userSpec
+	}
+
+	if !reflect.DeepEqual(spec.Annotations, orig.Annotations) {
+		config.Labels = toImageLabels(spec.Annotations, image.Config.Labels, manifest.Annotations)
+	}
+
+	return config, nil
+}
+
+// toImageEnv converts the environment of a runtime spec back to the
+// environment of an image. The HOME variable is removed if it was added to the
+// original environment by MutateRuntimeSpec and hasn't been changed.
+func toImageEnv(env, origEnv, imageEnv []string) ([]string, error) {
+	origHome, imageHasHome := "", false
+	for _, line := range origEnv {
+		if strings.HasPrefix(line, "HOME=") {
+			origHome = line
+		}
+	}
+	for _, line := range imageEnv {
+		if strings.HasPrefix(line, "HOME=") {
+			imageHasHome = true
+		}
+	}
+
+	var newEnv []string
+	for _, line := range env {
+		if _, _, err := parseEnv(line); err != nil {
+			return nil, err
+		}
+		if line == origHome && !imageHasHome {
+			continue
+		}
+		newEnv = append(newEnv, line)
+	}
+	return newEnv, nil
+}
+
+// splitArgs splits the arguments of a runtime spec into an entrypoint and
+// command, keeping the given entrypoint if args starts with it.
+func splitArgs(args, entrypoint []string) ([]string, []string) {
+	if len(entrypoint) == 0 || len(args) < len(entrypoint) || !reflect.DeepEqual(args[:len(entrypoint)], entrypoint) {
+		return nil, args
+	}
+	cmd := args[len(entrypoint):]
+	if len(cmd) == 0 {
+		cmd = nil
+	}
+	return entrypoint, cmd
+}
+
+// toUserSpec converts a uid and gid to a user specification for an image
+// configuration, using the names in the passwd and group files of rootfs if
+// they exist. If the gid is the primary group of the user, it is omitted (so
+// that the additional groups of the user are still used).
+func toUserSpec(rootfs string, uid, gid uint32) (string, error) {
+	userName, primaryGid := strconv.FormatUint(uint64(uid), 10), -1
+	groupName := strconv.FormatUint(uint64(gid), 10)
+	if rootfs == "" {
+		return userName + ":" + groupName, nil
+	}
+
+	users, err := user.ParsePasswdFileFilter(filepath.Join(rootfs, "/etc/passwd"), func(u user.User) bool {
+		return u.Uid == int(uid)
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return "", errors.Wrap(err, "parse passwd")
+	}
+	if len(users) > 0 {
+		userName, primaryGid = users[0].Name, users[0].Gid
+	}
+	if int(gid) == primaryGid {
+		return userName, nil
+	}
+
+	groups, err := user.ParseGroupFileFilter(filepath.Join(rootfs, "/etc/group"), func(g user.Group) bool {
+		return g.Gid == int(gid)
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return "", errors.Wrap(err, "parse group")
+	}
+	if len(groups) > 0 {
+		groupName = groups[0].Name
+	}
+	return userName + ":" + groupName, nil
+}
+
+// toImageLabels converts the annotations of a runtime spec back to the labels
+// of an image. Annotations which have the same value as a manifest annotation
+// are not labels (unless they were already labels), because MutateRuntimeSpec
+// gives manifest annotations precedence over labels.
+func toImageLabels(annotations, labels, manifestAnnotations map[string]string) map[string]string {
+	var newLabels map[string]string
+	for key, value := range annotations {
+		if manifestValue, ok := manifestAnnotations[key]; ok && manifestValue == value {
+			label, isLabel := labels[key]
+			if !isLabel {
+				continue
+			}
+			value = label
+		}
+		if newLabels == nil {
+			newLabels = map[string]string{}
+		}
+		newLabels[key] = value
+	}
+	return newLabels
+}
@@ -0,0 +1,129 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package convert
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestToImageConfig(t *testing.T) {
+	rootfs, err := ioutil.TempDir("", "umoci-TestToImageConfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootfs)
+
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "etc", "passwd"), []byte("root:x:0:0:root:/root:/bin/sh\nuser:x:1000:1000::/home/user:/bin/sh\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "etc", "group"), []byte("root:x:0:\ntty:x:5:\nuser:x:1000:\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	image := ispec.Image{
+		OS:           "linux",
+		Architecture: "amd64",
+		Config: ispec.ImageConfig{
+			Env:        []string{"PATH=/bin"},
+			Entrypoint: []string{"/bin/app"},
+			Cmd:        []string{"--flag"},
+			Labels:     map[string]string{"a": "1", "m": "label"},
+		},
+	}
+	manifest := ispec.Manifest{
+		Annotations: map[string]string{"m": "manifest"},
+	}
+
+	// An unmodified spec doesn't change anything.
+	spec, err := ToRuntimeSpec(rootfs, image, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := ToImageConfig(spec, rootfs, image, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config, image.Config) {
+		t.Errorf("unmodified spec changed config: expected %+v, got %+v", image.Config, config)
+	}
+
+	// Modify everything that can be converted back.
+	spec.Process.Cwd = "/srv"
+	spec.Process.Env = append(spec.Process.Env, "FOO=bar")
+	spec.Process.Args = []string{"/bin/app", "--other"}
+	spec.Process.User.UID = 1000
+	spec.Process.User.GID = 1000
+	delete(spec.Annotations, "a")
+	spec.Annotations["b"] = "2"
+
+	config, err = ToImageConfig(spec, rootfs, image, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ispec.ImageConfig{
+		WorkingDir: "/srv",
+		Env:        []string{"PATH=/bin", "FOO=bar"},
+		Entrypoint: []string{"/bin/app"},
+		Cmd:        []string{"--other"},
+		User:       "user",
+		Labels:     map[string]string{"b": "2", "m": "label"},
+	}
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("unexpected config: expected %+v, got %+v", expected, config)
+	}
+
+	// Arguments which don't start with the entrypoint replace it, and users
+	// and groups which don't match the passwd file are kept separate.
+	for _, test := range []struct {
+		uid, gid uint32
+		user     string
+	}{
+		{1000, 5, "user:tty"},
+		{2000, 0, "2000:root"},
+		{0, 1234, "root:1234"},
+	} {
+		spec.Process.Args = []string{"sh", "-c", "true"}
+		spec.Process.User.UID = test.uid
+		spec.Process.User.GID = test.gid
+
+		config, err = ToImageConfig(spec, rootfs, image, manifest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.Entrypoint != nil || !reflect.DeepEqual(config.Cmd, spec.Process.Args) {
+			t.Errorf("unexpected entrypoint and cmd: %v %v", config.Entrypoint, config.Cmd)
+		}
+		if config.User != test.user {
+			t.Errorf("unexpected user for %d:%d: expected %q, got %q", test.uid, test.gid, test.user, config.User)
+		}
+	}
+
+	// Invalid environment variables are rejected.
+	spec.Process.Env = append(spec.Process.Env, "INVALID")
+	if _, err := ToImageConfig(spec, rootfs, image, manifest); err == nil {
+		t.Errorf("expected an error with an invalid environment variable")
+	}
+}
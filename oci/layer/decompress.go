@@ -0,0 +1,166 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"github.com/ulikunitz/xz"
+)
+
+// Decompressor is a compression algorithm that layer blobs may be compressed
+// with. Decompressors are selected either by the media type of the layer or,
+// if the media type doesn't specify a compression algorithm, by sniffing the
+// start of the layer for the magic number of the algorithm.
+type Decompressor interface {
+	// MediaTypeSuffix returns the suffix (without the leading "+") of the
+	// media types of layers compressed with this algorithm, such as "gzip".
+	MediaTypeSuffix() string
+
+	// Magic returns the magic number found at the start of every stream
+	// compressed with this algorithm.
+	Magic() []byte
+
+	// Decompress returns a reader for the decompressed contents of the given
+	// compressed stream. The returned reader must be closed by the caller,
+	// but closing it will not close the underlying reader.
+	Decompress(reader io.Reader) (io.ReadCloser, error)
+}
+
+var (
+	dm            sync.RWMutex
+	decompressors []Decompressor
+)
+
+// RegisterDecompressor registers a new Decompressor in the global set of
+// decompressors. If two decompressors have the same media type suffix, the
+// earliest registered decompressor takes precedence.
+func RegisterDecompressor(decompressor Decompressor) {
+	dm.Lock()
+	decompressors = append(decompressors, decompressor)
+	dm.Unlock()
+}
+
+// decompressorFor returns the decompressor which handles layers of the given
+// media type. If the media type doesn't contain a compression suffix, (nil,
+// true) is returned, and if there is no decompressor registered for the suffix
+// (nil, false) is returned.
+func decompressorFor(mediaType string) (Decompressor, bool) {
+	idx := strings.LastIndex(mediaType, "+")
+	if idx < 0 {
+		return nil, true
+	}
+	suffix := mediaType[idx+1:]
+
+	dm.RLock()
+	defer dm.RUnlock()
+	for _, decompressor := range decompressors {
+		if decompressor.MediaTypeSuffix() == suffix {
+			return decompressor, true
+		}
+	}
+	return nil, false
+}
+
+// sniffDecompressor returns the decompressor whose magic number matches the
+// start of the given reader, or nil if there is no such decompressor.
+func sniffDecompressor(reader *bufio.Reader) Decompressor {
+	dm.RLock()
+	defer dm.RUnlock()
+	for _, decompressor := range decompressors {
+		magic := decompressor.Magic()
+		// An error means that the stream is shorter than the magic number.
+		if header, err := reader.Peek(len(magic)); err == nil && bytes.Equal(header, magic) {
+			return decompressor
+		}
+	}
+	return nil
+}
+
+// DecompressLayer returns a reader for the uncompressed tar stream of a layer
+// with the given media type. If the media type specifies a compression
+// algorithm then it is used, otherwise the algorithm is detected using the
+// magic number at the start of the layer (because some images in the wild
+// use the uncompressed media types for compressed layers). If no algorithm is
+// detected, the layer is assumed to be uncompressed. Closing the returned
+// reader does not close the given reader.
+func DecompressLayer(mediaType string, reader io.Reader) (io.ReadCloser, error) {
+	decompressor, ok := decompressorFor(mediaType)
+	if !ok {
+		return nil, errors.Errorf("unsupported layer compression: %s", mediaType)
+	}
+	if decompressor == nil {
+		buffered := bufio.NewReader(reader)
+		decompressor = sniffDecompressor(buffered)
+		if decompressor == nil {
+			return ioutil.NopCloser(buffered), nil
+		}
+		reader = buffered
+	}
+	return decompressor.Decompress(reader)
+}
+
+type gzipDecompressor struct{}
+
+func (gzipDecompressor) MediaTypeSuffix() string { return "gzip" }
+func (gzipDecompressor) Magic() []byte           { return []byte{0x1f, 0x8b} }
+
+func (gzipDecompressor) Decompress(reader io.Reader) (io.ReadCloser, error) {
+	gzipReader, err := gzip.NewReader(reader)
+	return gzipReader, errors.Wrap(err, "create gzip reader")
+}
+
+type zstdDecompressor struct{}
+
+func (zstdDecompressor) MediaTypeSuffix() string { return "zstd" }
+func (zstdDecompressor) Magic() []byte           { return []byte{0x28, 0xb5, 0x2f, 0xfd} }
+
+func (zstdDecompressor) Decompress(reader io.Reader) (io.ReadCloser, error) {
+	zstdReader, err := zstd.NewReader(reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "create zstd reader")
+	}
+	return zstdReader.IOReadCloser(), nil
+}
+
+type xzDecompressor struct{}
+
+func (xzDecompressor) MediaTypeSuffix() string { return "xz" }
+func (xzDecompressor) Magic() []byte           { return []byte{0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00} }
+
+func (xzDecompressor) Decompress(reader io.Reader) (io.ReadCloser, error) {
+	xzReader, err := xz.NewReader(reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "create xz reader")
+	}
+	return ioutil.NopCloser(xzReader), nil
+}
+
+func init() {
+	RegisterDecompressor(gzipDecompressor{})
+	RegisterDecompressor(zstdDecompressor{})
+	RegisterDecompressor(xzDecompressor{})
+}
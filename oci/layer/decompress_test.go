@@ -0,0 +1,136 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/ulikunitz/xz"
+)
+
+func compressGzip(t *testing.T, data []byte) []byte {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	if _, err := writer.Write(data); err != nil {
+		t.Fatalf("gzip write: %+v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("gzip close: %+v", err)
+	}
+	return buffer.Bytes()
+}
+
+func compressZstd(t *testing.T, data []byte) []byte {
+	var buffer bytes.Buffer
+	writer, err := zstd.NewWriter(&buffer)
+	if err != nil {
+		t.Fatalf("zstd writer: %+v", err)
+	}
+	if _, err := writer.Write(data); err != nil {
+		t.Fatalf("zstd write: %+v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("zstd close: %+v", err)
+	}
+	return buffer.Bytes()
+}
+
+func compressXz(t *testing.T, data []byte) []byte {
+	var buffer bytes.Buffer
+	writer, err := xz.NewWriter(&buffer)
+	if err != nil {
+		t.Fatalf("xz writer: %+v", err)
+	}
+	if _, err := writer.Write(data); err != nil {
+		t.Fatalf("xz write: %+v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("xz close: %+v", err)
+	}
+	return buffer.Bytes()
+}
+
+func TestDecompressLayer(t *testing.T) {
+	data := bytes.Repeat([]byte("some layer data which isn't really a tar archive\n"), 128)
+
+	for _, test := range []struct {
+		name      string
+		mediaType string
+		blob      []byte
+	}{
+		{"plain", ispec.MediaTypeImageLayer, data},
+		{"plain-nondistributable", ispec.MediaTypeImageLayerNonDistributable, data},
+		{"gzip", ispec.MediaTypeImageLayerGzip, compressGzip(t, data)},
+		{"gzip-nondistributable", ispec.MediaTypeImageLayerNonDistributableGzip, compressGzip(t, data)},
+		{"zstd", casext.MediaTypeImageLayerZstd, compressZstd(t, data)},
+		{"zstd-nondistributable", casext.MediaTypeImageLayerNonDistributableZstd, compressZstd(t, data)},
+		{"xz", casext.MediaTypeImageLayerXz, compressXz(t, data)},
+		{"xz-nondistributable", casext.MediaTypeImageLayerNonDistributableXz, compressXz(t, data)},
+		// Compressed layers with an uncompressed media type are detected.
+		{"sniff-gzip", ispec.MediaTypeImageLayer, compressGzip(t, data)},
+		{"sniff-zstd", ispec.MediaTypeImageLayer, compressZstd(t, data)},
+		{"sniff-xz", ispec.MediaTypeImageLayerNonDistributable, compressXz(t, data)},
+	} {
+		if !isLayerType(test.mediaType) {
+			t.Errorf("%s: isLayerType(%s) returned false", test.name, test.mediaType)
+		}
+
+		reader, err := DecompressLayer(test.mediaType, bytes.NewReader(test.blob))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %+v", test.name, err)
+			continue
+		}
+		got, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Errorf("%s: unexpected error reading: %+v", test.name, err)
+			continue
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s: decompressed data doesn't match", test.name)
+		}
+	}
+}
+
+func TestDecompressLayerUnsupported(t *testing.T) {
+	for _, mediaType := range []string{
+		"application/vnd.oci.image.layer.v1.tar+lz4",
+		"application/vnd.oci.image.layer.v1.tar+",
+	} {
+		if reader, err := DecompressLayer(mediaType, bytes.NewReader(nil)); err == nil {
+			reader.Close()
+			t.Errorf("expected error with unsupported media type %s", mediaType)
+		}
+	}
+
+	// Short uncompressed layers must not be mistaken for compressed ones.
+	reader, err := DecompressLayer(ispec.MediaTypeImageLayer, bytes.NewReader([]byte{0x1f}))
+	if err != nil {
+		t.Fatalf("unexpected error with short layer: %+v", err)
+	}
+	defer reader.Close()
+	if got, err := ioutil.ReadAll(reader); err != nil || !bytes.Equal(got, []byte{0x1f}) {
+		t.Errorf("short layer: got %v (%v)", got, err)
+	}
+}
@@ -0,0 +1,435 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// ExportManifest writes the root filesystem described by the given manifest
+// to w, as a single tar archive with all of the layers merged (and all of the
+// whiteouts applied). Nothing is written to disk, and only the metadata of the
+// paths in the image is kept in memory. The ownership of the entries is
+// mapped to the host using the mappings in opt (in the same way as
+// UnpackManifest), and paths which don't pass the path filters in opt are
+// skipped.
+//
+// The layers are read from the topmost layer down, so that the first entry
+// seen for a path is the one in the merged filesystem. As a result, entries
+// in the archive are not ordered by path (a directory's entry may come after
+// some of its children). Because the filesystem isn't actually built, symlinks
+// in the parent components of layer entries are not resolved.
+func ExportManifest(ctx context.Context, engine cas.Engine, w io.Writer, manifest ispec.Manifest, opt *UnpackOptions) error {
+	engineExt := casext.Engine{engine}
+
+	var unpackOptions UnpackOptions
+	if opt != nil {
+		unpackOptions = *opt
+	}
+
+	config, err := unpackConfig(ctx, engineExt, manifest)
+	if err != nil {
+		return err
+	}
+
+	tf := newTarFlattener(w, unpackOptions)
+	return flattenLayers(ctx, engineExt, tf, manifest.Layers, config.RootFS.DiffIDs)
+}
+
+// flattenLayers adds the given layers (which have the given DiffIDs) to tf,
+// from the topmost layer down, and then closes tf's archive.
+func flattenLayers(ctx context.Context, engineExt casext.Engine, tf *tarFlattener, layers []ispec.Descriptor, diffIDs []string) error {
+	// Layers have to be read in reverse order, but just like unpackLayers we
+	// fetch the next few layers concurrently.
+	streams := make([]*layerStream, len(layers))
+	defer func() {
+		for _, stream := range streams {
+			if stream != nil {
+				stream.Close()
+			}
+		}
+	}()
+
+	for idx := len(layers) - 1; idx >= 0; idx-- {
+		for next := idx; next >= 0 && next >= idx-unpackPrefetchLayers; next-- {
+			if streams[next] == nil {
+				streams[next] = fetchLayer(ctx, engineExt, layers[next], diffIDs[next])
+			}
+		}
+
+		log.Infof("export layer: %s", layers[idx].Digest)
+		if err := tf.addLayer(streams[idx]); err != nil {
+			return errors.Wrapf(err, "export layer %s", layers[idx].Digest)
+		}
+		// As with unpackLayers, this also verifies the DiffID.
+		if _, err := io.Copy(ioutil.Discard, streams[idx]); err != nil {
+			return errors.Wrap(err, "finish layer")
+		}
+		streams[idx].Close()
+
+		// Hardlinks to paths that are not part of the merged filesystem need
+		// the contents of their target, which we've already skipped over.
+		if len(tf.orphans) > 0 {
+			if err := exportOrphans(ctx, engineExt, tf, layers[idx], diffIDs[idx]); err != nil {
+				return errors.Wrapf(err, "export layer %s", layers[idx].Digest)
+			}
+		}
+		tf.endLayer()
+	}
+	return errors.Wrap(tf.tw.Close(), "close tar writer")
+}
+
+// exportOrphans re-reads the given layer to write the pending orphaned
+// hardlinks of tf.
+func exportOrphans(ctx context.Context, engineExt casext.Engine, tf *tarFlattener, descriptor ispec.Descriptor, diffID string) error {
+	layer := fetchLayer(ctx, engineExt, descriptor, diffID)
+	defer layer.Close()
+
+	log.Debugf("export layer: re-reading %s for %d orphaned hardlinks", descriptor.Digest, len(tf.orphans))
+	if err := tf.addOrphans(layer); err != nil {
+		return errors.Wrap(err, "export orphaned hardlinks")
+	}
+	if _, err := io.Copy(ioutil.Discard, layer); err != nil {
+		return errors.Wrap(err, "finish layer")
+	}
+	return nil
+}
+
+// tarFlattener merges a set of layers (given from the topmost layer down) into
+// a single tar archive.
+type tarFlattener struct {
+	tw         *tar.Writer
+	mapOptions MapOptions
+	filters    PathFilters
+
+	// written contains every path which has been written (or reserved by an
+	// orphaned hardlink), and whether it is a directory.
+	written map[string]bool
+
+	// parents contains the parent directories of every written path. Lower
+	// layers can only provide directories for these paths.
+	parents map[string]struct{}
+
+	// hidden and opaque contain the paths removed by whiteouts and the
+	// directories cleared by opaque whiteouts in the layers that have been
+	// completely processed.
+	hidden map[string]struct{}
+	opaque map[string]struct{}
+
+	// layerHidden and layerOpaque are the whiteouts of the current layer,
+	// which only apply to the layers below it.
+	layerHidden []string
+	layerOpaque []string
+
+	// layerWritten contains the paths written from the current layer, which
+	// are the only valid hardlink targets for entries in the current layer.
+	layerWritten map[string]struct{}
+
+	// orphans maps the targets of hardlinks in the current layer which were
+	// not written to the names of the hardlinks.
+	orphans map[string][]string
+
+	// keepWhiteouts is whether whiteouts are written to the archive, so that
+	// the paths they remove are also hidden in any layers below the layers
+	// being flattened. whiteouts contains the whiteouts which were written.
+	keepWhiteouts bool
+	whiteouts     map[string]struct{}
+}
+
+// newTarFlattener creates a tarFlattener writing to w.
+func newTarFlattener(w io.Writer, opt UnpackOptions) *tarFlattener {
+	return &tarFlattener{
+		tw:           tar.NewWriter(w),
+		mapOptions:   opt.MapOptions,
+		filters:      opt.Filters,
+		written:      make(map[string]bool),
+		parents:      make(map[string]struct{}),
+		hidden:       make(map[string]struct{}),
+		opaque:       make(map[string]struct{}),
+		layerWritten: make(map[string]struct{}),
+		orphans:      make(map[string][]string),
+		whiteouts:    make(map[string]struct{}),
+	}
+}
+
+// shadowed returns whether the entry with the given (clean) name in the
+// current layer is not part of the merged filesystem, because of a layer
+// above it (or an earlier entry in the current layer).
+func (tf *tarFlattener) shadowed(name string, isDir bool) bool {
+	if _, ok := tf.written[name]; ok {
+		return true
+	}
+	if _, ok := tf.parents[name]; ok && !isDir {
+		return true
+	}
+	for path := name; ; path = filepath.Dir(path) {
+		if _, ok := tf.hidden[path]; ok {
+			return true
+		}
+		if path != name {
+			if _, ok := tf.opaque[path]; ok {
+				return true
+			}
+			// A non-directory hides everything below it.
+			if dir, ok := tf.written[path]; ok && !dir {
+				return true
+			}
+		}
+		if path == "." {
+			break
+		}
+	}
+	return false
+}
+
+// markWritten records that the given (clean) name is part of the merged
+// filesystem.
+func (tf *tarFlattener) markWritten(name string, isDir bool) {
+	tf.written[name] = isDir
+	tf.layerWritten[name] = struct{}{}
+	for path := filepath.Dir(name); ; path = filepath.Dir(path) {
+		if _, ok := tf.parents[path]; ok {
+			break
+		}
+		tf.parents[path] = struct{}{}
+		if path == "." {
+			break
+		}
+	}
+}
+
+// writeEntry writes the given header (with the given name) and contents to
+// the archive.
+func (tf *tarFlattener) writeEntry(name string, hdr *tar.Header, r io.Reader) error {
+	var err error
+	hdr.Name, err = normalise(name, hdr.Typeflag == tar.TypeDir)
+	if err != nil {
+		return errors.Wrap(err, "normalise path")
+	}
+	if hdr.Typeflag == tar.TypeLink {
+		hdr.Linkname, err = normalise(hdr.Linkname, false)
+		if err != nil {
+			return errors.Wrap(err, "normalise linkname")
+		}
+	}
+	if err := unmapHeader(hdr, tf.mapOptions); err != nil {
+		return errors.Wrap(err, "map header")
+	}
+	if err := tf.tw.WriteHeader(hdr); err != nil {
+		return errors.Wrap(err, "write header")
+	}
+	if r != nil {
+		if n, err := io.Copy(tf.tw, r); err != nil {
+			return errors.Wrap(err, "write contents")
+		} else if n != hdr.Size {
+			return errors.Wrap(io.ErrShortWrite, "write contents")
+		}
+	}
+	return nil
+}
+
+// addLayer writes the entries of the given layer which are part of the merged
+// filesystem, and records its whiteouts.
+func (tf *tarFlattener) addLayer(layer io.Reader) error {
+	tr := tar.NewReader(layer)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "read next entry")
+		}
+		if err := tf.addEntry(hdr, tr); err != nil {
+			return errors.Wrapf(err, "export entry: %s", hdr.Name)
+		}
+	}
+	return nil
+}
+
+// addEntry handles a single entry of the current layer.
+func (tf *tarFlattener) addEntry(hdr *tar.Header, r io.Reader) error {
+	name := CleanPath(hdr.Name)
+	if !tf.filters.Allowed(whiteoutTarget(name)) {
+		log.Debugf("export entry: skipping filtered path: %s", name)
+		return nil
+	}
+
+	dir, file := filepath.Split(name)
+	if strings.HasPrefix(file, whPrefix) {
+		path, opaque := filepath.Join(dir, strings.TrimPrefix(file, whPrefix)), false
+		if file == whOpaque {
+			path, opaque = filepath.Clean(dir), true
+			tf.layerOpaque = append(tf.layerOpaque, path)
+		} else {
+			tf.layerHidden = append(tf.layerHidden, path)
+		}
+		if tf.keepWhiteouts {
+			return tf.writeWhiteout(hdr, path, opaque)
+		}
+		return nil
+	}
+
+	isDir := hdr.Typeflag == tar.TypeDir
+	if tf.shadowed(name, isDir) {
+		log.Debugf("export entry: skipping shadowed path: %s", name)
+		return nil
+	}
+
+	if hdr.Typeflag == tar.TypeLink {
+		target := CleanPath(hdr.Linkname)
+		if _, ok := tf.layerWritten[target]; !ok {
+			// The target was replaced or removed by an upper layer, so this
+			// hardlink has to be written once we have the target's contents.
+			tf.written[name] = false
+			tf.orphans[target] = append(tf.orphans[target], name)
+			return nil
+		}
+		hdr.Linkname = target
+	}
+
+	tf.markWritten(name, isDir)
+	return tf.writeEntry(name, hdr, r)
+}
+
+// whitedOut returns whether the given (clean) path in the layers below the
+// flattened layers, or only its contents if contents is set, is already hidden
+// by the layers above the current layer.
+func (tf *tarFlattener) whitedOut(name string, contents bool) bool {
+	for path := name; ; path = filepath.Dir(path) {
+		if _, ok := tf.hidden[path]; ok {
+			return true
+		}
+		if path != name || contents {
+			if _, ok := tf.opaque[path]; ok {
+				return true
+			}
+		}
+		// A non-directory replaces whatever was at its path.
+		if dir, ok := tf.written[path]; ok && !dir {
+			return true
+		}
+		if path == "." {
+			break
+		}
+	}
+	return false
+}
+
+// writeWhiteout writes a whiteout for the given (clean) path, or an opaque
+// whiteout if opaque is set, unless the path is already hidden. A whiteout
+// for a path which is a directory in the merged filesystem is written as an
+// opaque whiteout instead, because the whiteout would also remove the
+// contents of the directory which have already been written.
+func (tf *tarFlattener) writeWhiteout(hdr *tar.Header, path string, opaque bool) error {
+	if dir, ok := tf.written[path]; ok && dir {
+		opaque = true
+	}
+	if _, ok := tf.parents[path]; ok {
+		opaque = true
+	}
+	if tf.whitedOut(path, opaque) {
+		return nil
+	}
+
+	name := filepath.Join(filepath.Dir(path), whPrefix+filepath.Base(path))
+	if opaque {
+		name = filepath.Join(path, whOpaque)
+	}
+	if _, ok := tf.whiteouts[name]; ok {
+		return nil
+	}
+	tf.whiteouts[name] = struct{}{}
+
+	whHdr := *hdr
+	whHdr.Typeflag = tar.TypeReg
+	whHdr.Linkname = ""
+	whHdr.Size = 0
+	return tf.writeEntry(name, &whHdr, nil)
+}
+
+// addOrphans writes the pending orphaned hardlinks of the current layer, by
+// re-reading the layer to find their targets. The first hardlink to each
+// target becomes a copy of the target and the rest are hardlinks to it.
+func (tf *tarFlattener) addOrphans(layer io.Reader) error {
+	tr := tar.NewReader(layer)
+	for len(tf.orphans) > 0 {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "read next entry")
+		}
+		target := CleanPath(hdr.Name)
+		links, ok := tf.orphans[target]
+		if !ok || hdr.Typeflag == tar.TypeLink {
+			continue
+		}
+		delete(tf.orphans, target)
+
+		linkHdr := *hdr
+		tf.markWritten(links[0], false)
+		if err := tf.writeEntry(links[0], hdr, tr); err != nil {
+			return errors.Wrapf(err, "export entry: %s", links[0])
+		}
+		for _, link := range links[1:] {
+			linkHdr := linkHdr
+			linkHdr.Typeflag = tar.TypeLink
+			linkHdr.Linkname = links[0]
+			linkHdr.Size = 0
+			tf.markWritten(link, false)
+			if err := tf.writeEntry(link, &linkHdr, nil); err != nil {
+				return errors.Wrapf(err, "export entry: %s", link)
+			}
+		}
+	}
+	for target, links := range tf.orphans {
+		log.Warnf("export entry: skipping hardlinks to missing path: %v -> %s", links, target)
+		for _, link := range links {
+			delete(tf.written, link)
+		}
+	}
+	return nil
+}
+
+// endLayer applies the whiteouts of the current layer, before the next
+// (lower) layer is added.
+func (tf *tarFlattener) endLayer() {
+	for _, path := range tf.layerHidden {
+		tf.hidden[path] = struct{}{}
+	}
+	for _, path := range tf.layerOpaque {
+		tf.opaque[path] = struct{}{}
+	}
+	tf.layerHidden = nil
+	tf.layerOpaque = nil
+	tf.layerWritten = make(map[string]struct{})
+	tf.orphans = make(map[string][]string)
+}
@@ -0,0 +1,138 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/drivers/dir"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/net/context"
+)
+
+func TestExportManifest(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestExportManifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+
+	reg := func(name, contents string) testLayerEntry {
+		return testLayerEntry{
+			hdr:      tar.Header{Name: name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(contents))},
+			contents: contents,
+		}
+	}
+	dirEntry := func(name string) testLayerEntry {
+		return testLayerEntry{hdr: tar.Header{Name: name, Mode: 0755, Typeflag: tar.TypeDir}}
+	}
+	link := func(name, target string) testLayerEntry {
+		return testLayerEntry{hdr: tar.Header{Name: name, Mode: 0644, Typeflag: tar.TypeLink, Linkname: target}}
+	}
+
+	manifest := makeTestImageEntries(t, engine, [][]testLayerEntry{
+		{
+			dirEntry("dir/"), reg("dir/a", "a0"), reg("dir/b", "b0"),
+			reg("file", "f0"), link("link1", "file"), link("link2", "file"),
+			dirEntry("opaque/"), reg("opaque/x", "x0"),
+			dirEntry("tree/"), reg("tree/x", "x0"),
+			reg("kept", "k0"), link("keptlink", "kept"),
+		},
+		{
+			reg("dir/a", "a1"), reg(".wh.file", ""),
+			reg("opaque/.wh..wh..opq", ""), reg("opaque/y", "y1"),
+			reg("tree", "t1"),
+		},
+		{
+			dirEntry("dir/"), reg("dir/c", "c2"),
+		},
+	})
+
+	var buffer bytes.Buffer
+	if err := ExportManifest(context.Background(), engine, &buffer, manifest, &UnpackOptions{}); err != nil {
+		t.Fatalf("unexpected error exporting manifest: %+v", err)
+	}
+	checkTestLayer(t, &buffer, map[string]testTarEntry{
+		"dir/":     {typeflag: tar.TypeDir},
+		"dir/a":    {typeflag: tar.TypeReg, contents: "a1"},
+		"dir/b":    {typeflag: tar.TypeReg, contents: "b0"},
+		"dir/c":    {typeflag: tar.TypeReg, contents: "c2"},
+		"link1":    {typeflag: tar.TypeReg, contents: "f0"},
+		"link2":    {typeflag: tar.TypeLink, linkname: "link1"},
+		"opaque/":  {typeflag: tar.TypeDir},
+		"opaque/y": {typeflag: tar.TypeReg, contents: "y1"},
+		"tree":     {typeflag: tar.TypeReg, contents: "t1"},
+		"kept":     {typeflag: tar.TypeReg, contents: "k0"},
+		"keptlink": {typeflag: tar.TypeLink, linkname: "kept"},
+	})
+}
+
+func TestExportManifestOptions(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestExportManifestOptions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+
+	manifest := makeTestImage(t, engine, [][]testLayerFile{
+		{{"etc/passwd", "a"}, {"etc/group", "a"}, {"usr/bin/sh", "a"}},
+		{{"etc/passwd", "b"}},
+	})
+
+	var buffer bytes.Buffer
+	if err := ExportManifest(context.Background(), engine, &buffer, manifest, &UnpackOptions{
+		MapOptions: MapOptions{
+			UIDMappings: []rspec.IDMapping{{HostID: 1000, ContainerID: 0, Size: 1000}},
+			GIDMappings: []rspec.IDMapping{{HostID: 1000, ContainerID: 0, Size: 1000}},
+		},
+		Filters: PathFilters{
+			Include: []string{"/etc"},
+			Exclude: []string{"/etc/group"},
+		},
+	}); err != nil {
+		t.Fatalf("unexpected error exporting manifest: %+v", err)
+	}
+	checkTestLayer(t, &buffer, map[string]testTarEntry{
+		"etc/passwd": {typeflag: tar.TypeReg, contents: "b", uid: 1000, gid: 1000},
+	})
+}
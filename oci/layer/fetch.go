@@ -0,0 +1,231 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/pkg/progress"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	// unpackPrefetchLayers is the number of layers (after the layer currently
+	// being extracted) which UnpackManifest fetches and decompresses
+	// concurrently.
+	unpackPrefetchLayers = 3
+
+	// unpackChunkSize is the size of the chunks of decompressed layer data
+	// passed from a layer fetcher to the extractor.
+	unpackChunkSize = 1 << 20
+
+	// unpackBufferedChunks is the number of chunks each layer fetcher can
+	// buffer before it has to wait for the extractor. This bounds the memory
+	// used by each layer fetcher to unpackChunkSize*unpackBufferedChunks.
+	unpackBufferedChunks = 8
+)
+
+// errStreamClosed is returned by a layer fetcher which was stopped before it
+// finished reading its layer.
+var errStreamClosed = fmt.Errorf("layer stream closed")
+
+// layerStream is an io.ReadCloser for the decompressed contents of a layer,
+// which are fetched, decompressed and verified by a separate goroutine. Once
+// all of the contents have been read, Read returns an error if the contents
+// didn't match the layer's DiffID.
+type layerStream struct {
+	chunks chan []byte
+	done   chan struct{}
+	once   sync.Once
+
+	// err is set by the fetcher before chunks is closed.
+	err error
+
+	// read is the number of bytes of the layer blob read by the fetcher so
+	// far, and must be accessed atomically.
+	read int64
+
+	// cur is the remainder of the chunk currently being read.
+	cur []byte
+}
+
+// fetchLayer starts fetching the layer with the given descriptor (expected to
+// have the given DiffID) in a new goroutine. The caller must Close the
+// returned stream.
+func fetchLayer(ctx context.Context, engine casext.Engine, descriptor ispec.Descriptor, diffID string) *layerStream {
+	s := &layerStream{
+		chunks: make(chan []byte, unpackBufferedChunks),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(s.chunks)
+		s.err = s.fetch(ctx, engine, descriptor, diffID)
+	}()
+	return s
+}
+
+// fetch does the actual work of fetchLayer.
+func (s *layerStream) fetch(ctx context.Context, engine casext.Engine, descriptor ispec.Descriptor, diffID string) error {
+	layerBlob, err := engine.FromDescriptor(ctx, descriptor)
+	if err != nil {
+		return errors.Wrap(err, "get layer blob")
+	}
+	defer layerBlob.Close()
+	if !isLayerType(layerBlob.MediaType) {
+		return errors.Errorf("unpack manifest: layer %s: blob is not correct mediatype: %s", layerBlob.Digest, layerBlob.MediaType)
+	}
+	layerData, ok := layerBlob.Data.(io.ReadCloser)
+	if !ok {
+		// Should _never_ be reached.
+		return errors.Errorf("[internal error] layerBlob was not an io.ReadCloser")
+	}
+	if err := descriptor.Digest.Validate(); err != nil {
+		return errors.Wrapf(err, "unpack manifest: layer %s: invalid digest", descriptor.Digest)
+	}
+
+	// The blob itself has to match the descriptor. The size is checked as the
+	// blob is read, so that we don't read an arbitrary amount of data.
+	verifier := &blobVerifier{
+		reader:   layerData,
+		digester: descriptor.Digest.Algorithm().Digester(),
+		limit:    descriptor.Size,
+		read:     &s.read,
+	}
+
+	// We have to extract a decompressed version of the above layer. Also
+	// note that we have to check the DiffID we're extracting (which is the
+	// sha256 sum of the *uncompressed* layer).
+	layerRaw, err := DecompressLayer(layerBlob.MediaType, verifier)
+	if err != nil {
+		return errors.Wrapf(err, "unpack manifest: layer %s", layerBlob.Digest)
+	}
+	defer layerRaw.Close()
+	layerHash := sha256.New()
+
+	for {
+		chunk := make([]byte, unpackChunkSize)
+		n, err := io.ReadFull(layerRaw, chunk)
+		if n > 0 {
+			layerHash.Write(chunk[:n])
+			select {
+			case s.chunks <- chunk[:n]:
+			case <-s.done:
+				return errStreamClosed
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrapf(err, "unpack manifest: layer %s: read layer", layerBlob.Digest)
+		}
+	}
+
+	// The decompressor might not have read all of the blob (such as any
+	// trailing data after a gzip stream).
+	if _, err := io.Copy(ioutil.Discard, verifier); err != nil {
+		return errors.Wrapf(err, "unpack manifest: layer %s: read layer", layerBlob.Digest)
+	}
+	if verifier.size != descriptor.Size {
+		return errors.Wrapf(cas.ErrSizeMismatch, "unpack manifest: layer %s: got size %d expected %d", layerBlob.Digest, verifier.size, descriptor.Size)
+	}
+	if blobDigest := verifier.digester.Digest(); blobDigest != descriptor.Digest {
+		return errors.Wrapf(cas.ErrDigestMismatch, "unpack manifest: layer %s: got digest %s", layerBlob.Digest, blobDigest)
+	}
+
+	layerDigest := fmt.Sprintf("%s:%x", cas.BlobAlgorithm, layerHash.Sum(nil))
+	if layerDigest != diffID {
+		return errors.Wrapf(ErrDiffIDMismatch, "unpack manifest: layer %s: diffid mismatch: got %s expected %s", layerBlob.Digest, layerDigest, diffID)
+	}
+	return nil
+}
+
+// blobVerifier is an io.Reader which computes the digest and size of the data
+// read from the underlying reader, and fails once more than limit bytes have
+// been read. The size is also atomically stored in read, for progress
+// reporting.
+type blobVerifier struct {
+	reader   io.Reader
+	digester digest.Digester
+	size     int64
+	limit    int64
+	read     *int64
+}
+
+// Read reads from the underlying reader.
+func (v *blobVerifier) Read(p []byte) (int, error) {
+	n, err := v.reader.Read(p)
+	v.digester.Hash().Write(p[:n])
+	v.size += int64(n)
+	atomic.StoreInt64(v.read, v.size)
+	if v.size > v.limit {
+		return n, errors.Wrapf(cas.ErrSizeMismatch, "blob is larger than expected size %d", v.limit)
+	}
+	return n, err
+}
+
+// Read reads the decompressed contents of the layer.
+func (s *layerStream) Read(p []byte) (int, error) {
+	for len(s.cur) == 0 {
+		chunk, ok := <-s.chunks
+		if !ok {
+			if s.err != nil {
+				return 0, s.err
+			}
+			return 0, io.EOF
+		}
+		s.cur = chunk
+	}
+	n := copy(p, s.cur)
+	s.cur = s.cur[n:]
+	return n, nil
+}
+
+// progress returns a function which reports the progress of extracting the
+// layer (the layer with the given index and descriptor) to reporter, given the
+// number of entries extracted so far.
+func (s *layerStream) progress(reporter progress.Reporter, idx int, descriptor ispec.Descriptor) func(entries int64, done bool) {
+	return func(entries int64, done bool) {
+		progress.Report(reporter, progress.Event{
+			Operation: "unpack",
+			Layer:     idx,
+			Digest:    descriptor.Digest,
+			Bytes:     atomic.LoadInt64(&s.read),
+			Total:     descriptor.Size,
+			Entries:   entries,
+			Done:      done,
+		})
+	}
+}
+
+// Close stops the layer fetcher, if it is still running. It is safe to call
+// Close more than once.
+func (s *layerStream) Close() error {
+	s.once.Do(func() { close(s.done) })
+	return nil
+}
@@ -0,0 +1,113 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// PathFilters restricts the set of paths inside a rootfs which are unpacked
+// or repacked. Each filter is an absolute path, which may contain
+// filepath.Match globs. A filter matches a path if it matches the path itself
+// or any of its parent directories, so "/usr/share/doc" matches everything
+// inside /usr/share/doc.
+type PathFilters struct {
+	// Include, if non-empty, restricts the set of paths to those matched by
+	// one of the filters (as well as the parent directories of those paths).
+	Include []string `json:"include,omitempty"`
+
+	// Exclude is the set of paths which are never unpacked or repacked. It
+	// takes precedence over Include.
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// Empty returns whether there are no filters, and so all paths are allowed.
+func (f PathFilters) Empty() bool {
+	return len(f.Include) == 0 && len(f.Exclude) == 0
+}
+
+// Validate returns an error if any of the filters are not valid.
+func (f PathFilters) Validate() error {
+	for _, filter := range append(f.Include, f.Exclude...) {
+		if !filepath.IsAbs(filter) {
+			return errors.Errorf("path filter is not absolute: %s", filter)
+		}
+		if _, err := filepath.Match(filter, "/"); err != nil {
+			return errors.Wrapf(err, "invalid path filter: %s", filter)
+		}
+	}
+	return nil
+}
+
+// Allowed returns whether the given path (relative to the root of the rootfs)
+// passes the filters.
+func (f PathFilters) Allowed(path string) bool {
+	path = filepath.Join("/", path)
+	for _, filter := range f.Exclude {
+		if matchFilter(filter, path) {
+			return false
+		}
+	}
+	if len(f.Include) == 0 {
+		return true
+	}
+	for _, filter := range f.Include {
+		if matchFilter(filter, path) || matchFilterParent(filter, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchFilter returns whether the filter matches path or any of its parent
+// directories.
+func matchFilter(filter, path string) bool {
+	filter = filepath.Clean(filter)
+	for {
+		if ok, _ := filepath.Match(filter, path); ok {
+			return true
+		}
+		if path == "/" {
+			return false
+		}
+		path = filepath.Dir(path)
+	}
+}
+
+// matchFilterParent returns whether path could be a parent directory of a
+// path matched by the filter. Such directories have to be allowed by Include
+// filters, otherwise the matched paths could not be created.
+func matchFilterParent(filter, path string) bool {
+	if path == "/" {
+		return true
+	}
+	filterParts := strings.Split(strings.Trim(filepath.Clean(filter), "/"), "/")
+	pathParts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(pathParts) >= len(filterParts) {
+		return false
+	}
+	for idx, part := range pathParts {
+		if ok, _ := filepath.Match(filterParts[idx], part); !ok {
+			return false
+		}
+	}
+	return true
+}
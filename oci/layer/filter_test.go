@@ -0,0 +1,82 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"testing"
+)
+
+func TestPathFiltersAllowed(t *testing.T) {
+	filters := PathFilters{
+		Include: []string{"/etc", "/usr/lib/foo*"},
+		Exclude: []string{"/etc/skel", "/usr/lib/foo*/doc"},
+	}
+
+	for _, test := range []struct {
+		path    string
+		allowed bool
+	}{
+		{".", true},
+		{"/", true},
+		{"etc", true},
+		{"etc/passwd", true},
+		{"/etc/ssh/sshd_config", true},
+		{"etc/skel", false},
+		{"etc/skel/.bashrc", false},
+		{"usr", true},
+		{"usr/lib", true},
+		{"usr/lib/foo", true},
+		{"usr/lib/foobar/lib.so", true},
+		{"usr/lib/foobar/doc", false},
+		{"usr/lib/foobar/doc/README", false},
+		{"usr/lib/bar", false},
+		{"usr/share", false},
+		{"bin/sh", false},
+		{".wh.etc", false},
+	} {
+		if got := filters.Allowed(test.path); got != test.allowed {
+			t.Errorf("Allowed(%q): expected %v, got %v", test.path, test.allowed, got)
+		}
+	}
+
+	// Without any filters, everything is allowed.
+	for _, path := range []string{".", "etc", "usr/share/doc/README"} {
+		if !(PathFilters{}).Allowed(path) {
+			t.Errorf("Allowed(%q) with no filters: expected true", path)
+		}
+	}
+}
+
+func TestPathFiltersValidate(t *testing.T) {
+	for _, test := range []struct {
+		filters PathFilters
+		valid   bool
+	}{
+		{PathFilters{}, true},
+		{PathFilters{Include: []string{"/etc"}, Exclude: []string{"/usr/share/*"}}, true},
+		{PathFilters{Include: []string{"etc"}}, false},
+		{PathFilters{Exclude: []string{"/usr/[share"}}, false},
+	} {
+		err := test.filters.Validate()
+		if test.valid && err != nil {
+			t.Errorf("Validate(%v): unexpected error: %v", test.filters, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("Validate(%v): expected an error", test.filters)
+		}
+	}
+}
@@ -19,10 +19,14 @@ package layer
 
 import (
 	"io"
+	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 
 	"github.com/apex/log"
+	"github.com/openSUSE/umoci"
+	"github.com/openSUSE/umoci/pkg/progress"
 	"github.com/pkg/errors"
 	"github.com/vbatts/go-mtree"
 )
@@ -44,11 +48,12 @@ func (ids inodeDeltas) Swap(i, j int)      { ids[i], ids[j] = ids[j], ids[i] }
 // All of the mtree.Modified and mtree.Extra blobs are read relative to the
 // provided path (which should be the rootfs of the layer that was diffed). The
 // returned reader is for the *raw* tar data, it is the caller's responsibility
-// to gzip it.
-func GenerateLayer(path string, deltas []mtree.InodeDelta, opt *MapOptions) (io.ReadCloser, error) {
-	var mapOptions MapOptions
+// to gzip it. Paths which don't pass the path filters in opt are ignored.
+// Progress is reported (from another goroutine) as each delta is added.
+func GenerateLayer(path string, deltas []mtree.InodeDelta, opt *RepackOptions) (io.ReadCloser, error) {
+	var repackOptions RepackOptions
 	if opt != nil {
-		mapOptions = *opt
+		repackOptions = *opt
 	}
 
 	reader, writer := io.Pipe()
@@ -62,7 +67,25 @@ func GenerateLayer(path string, deltas []mtree.InodeDelta, opt *MapOptions) (io.
 		// We can't just dump all of the file contents into a tar file. We need
 		// to emulate a proper tar generator. Luckily there aren't that many
 		// things to emulate (and we can do them all in tar.go).
-		tg := newTarGenerator(writer, mapOptions)
+		counter := &countingWriter{writer: writer}
+		tg := newTarGenerator(counter, repackOptions.MapOptions)
+		tg.reproducible = repackOptions.Reproducible
+		tg.clampMtime = repackOptions.ClampMtime
+		tg.xattrs = repackOptions.Xattrs
+		var entries int64
+		report := func(done bool) {
+			progress.Report(repackOptions.Progress, progress.Event{
+				Operation: "repack",
+				Layer:     -1,
+				Bytes:     counter.count,
+				Entries:   entries,
+				Done:      done,
+			})
+		}
+
+		// Masked paths are dropped entirely. Their parent directories are
+		// still included if they were modified.
+		deltas = maskDeltas(deltas, repackOptions.MaskPaths)
 
 		// Sort the delta paths.
 		// FIXME: We need to add whiteouts first, otherwise we might end up
@@ -70,10 +93,42 @@ func GenerateLayer(path string, deltas []mtree.InodeDelta, opt *MapOptions) (io.
 		//        meant to modify.
 		sort.Sort(inodeDeltas(deltas))
 
+		// Directories which have had most of their contents replaced are
+		// added in full with an opaque whiteout. This isn't done with path
+		// filters, because an opaque whiteout would also hide the filtered
+		// paths (which were never unpacked).
+		var opaqueDirs []string
+		if repackOptions.Filters.Empty() {
+			var err error
+			opaqueDirs, err = findOpaqueDirs(tg.fsEval, path, deltas, repackOptions.MaskPaths)
+			if err != nil {
+				return errors.Wrap(err, "find opaque directories")
+			}
+		}
+		addedOpaque := map[string]bool{}
+
 		for _, delta := range deltas {
 			name := delta.Path()
 			fullPath := filepath.Join(path, name)
 
+			if !repackOptions.Filters.Allowed(name) {
+				log.Debugf("generate layer: skipping filtered path: %s", name)
+				continue
+			}
+
+			if opaqueDir, ok := parentDir(name, opaqueDirs); ok {
+				if !addedOpaque[opaqueDir] {
+					if err := addOpaqueDir(tg, path, opaqueDir); err != nil {
+						log.Warnf("generate layer: could not add opaque directory '%s': %s", opaqueDir, err)
+						return errors.Wrap(err, "generate opaque directory")
+					}
+					addedOpaque[opaqueDir] = true
+					entries++
+					report(false)
+				}
+				continue
+			}
+
 			// XXX: It's possible that if we unlink a hardlink, we're going to
 			//      AddFile() for no reason. Maybe we should drop nlink= from
 			//      the set of keywords we care about?
@@ -90,15 +145,218 @@ func GenerateLayer(path string, deltas []mtree.InodeDelta, opt *MapOptions) (io.
 					return errors.Wrap(err, "generate whiteout layer file")
 				}
 			}
+			entries++
+			report(false)
 		}
 
 		if err := tg.tw.Close(); err != nil {
 			log.Warnf("generate layer: could not close tar.Writer: %s", err)
 			return errors.Wrap(err, "close tar writer")
 		}
+		report(true)
 
 		return nil
 	}()
 
 	return reader, nil
 }
+
+// maskDeltas returns the deltas whose paths are not matched by any of the
+// masks (see RepackOptions.MaskPaths).
+func maskDeltas(deltas []mtree.InodeDelta, masks []string) []mtree.InodeDelta {
+	if len(masks) == 0 {
+		return deltas
+	}
+	var unmasked []mtree.InodeDelta
+	for _, delta := range deltas {
+		name := filepath.Join("/", delta.Path())
+		masked := false
+		for _, mask := range masks {
+			if matchFilter(mask, name) {
+				masked = true
+				break
+			}
+		}
+		if masked {
+			log.Debugf("generate layer: skipping masked path: %s", delta.Path())
+			continue
+		}
+		unmasked = append(unmasked, delta)
+	}
+	return unmasked
+}
+
+// containsMask returns whether dir (relative to the root) could contain a path
+// matched by any of the masks.
+func containsMask(dir string, masks []string) bool {
+	dir = filepath.Join("/", dir)
+	for _, mask := range masks {
+		if matchFilterParent(mask, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// dirsByDepth is a wrapper around []string that allows for sorting a set of
+// directory paths such that parents come before their children.
+type dirsByDepth []string
+
+func (d dirsByDepth) depth(i int) int {
+	if d[i] == "." {
+		return -1
+	}
+	return strings.Count(d[i], "/")
+}
+
+func (d dirsByDepth) Len() int      { return len(d) }
+func (d dirsByDepth) Swap(i, j int) { d[i], d[j] = d[j], d[i] }
+func (d dirsByDepth) Less(i, j int) bool {
+	if di, dj := d.depth(i), d.depth(j); di != dj {
+		return di < dj
+	}
+	return d[i] < d[j]
+}
+
+// fileInfosByName is a wrapper around []os.FileInfo that allows for sorting
+// the set of files by name.
+type fileInfosByName []os.FileInfo
+
+func (fis fileInfosByName) Len() int           { return len(fis) }
+func (fis fileInfosByName) Less(i, j int) bool { return fis[i].Name() < fis[j].Name() }
+func (fis fileInfosByName) Swap(i, j int)      { fis[i], fis[j] = fis[j], fis[i] }
+
+// parentDir returns the entry of dirs which is name or a parent of name, if
+// there is one.
+func parentDir(name string, dirs []string) (string, bool) {
+	for _, dir := range dirs {
+		if dir == "." || name == dir || strings.HasPrefix(name, dir+"/") {
+			return dir, true
+		}
+	}
+	return "", false
+}
+
+// findOpaqueDirs returns the set of directories for which an opaque whiteout
+// results in a smaller layer than individual whiteouts. This is the case when
+// a directory has been removed and recreated, or when most of its contents
+// have been replaced. Using an opaque whiteout for a directory requires all of
+// its unchanged contents to be added to the layer, so an opaque whiteout is
+// only used if there are more whiteouts under the directory than unchanged
+// paths (plus the opaque whiteout itself). Only the topmost such directories
+// are returned. Directories which could contain a path matched by one of the
+// masks are never returned, because an opaque whiteout would hide the masked
+// paths in the lower layers and their current contents would be added.
+func findOpaqueDirs(fsEval umoci.FsEval, root string, deltas []mtree.InodeDelta, masks []string) ([]string, error) {
+	changed := map[string]bool{}
+	missing := map[string]int{}
+	for _, delta := range deltas {
+		name := filepath.Clean(delta.Path())
+		switch delta.Type() {
+		case mtree.Modified, mtree.Extra:
+			changed[name] = true
+		case mtree.Missing:
+			for dir := filepath.Dir(name); ; dir = filepath.Dir(dir) {
+				missing[dir]++
+				if dir == "." || dir == "/" {
+					break
+				}
+			}
+		}
+	}
+
+	// Parents have to be considered before their children.
+	var candidates []string
+	for dir := range missing {
+		candidates = append(candidates, dir)
+	}
+	sort.Sort(dirsByDepth(candidates))
+
+	var opaqueDirs []string
+	for _, dir := range candidates {
+		if _, ok := parentDir(dir, opaqueDirs); ok {
+			continue
+		}
+		if containsMask(dir, masks) {
+			continue
+		}
+		fi, err := fsEval.Lstat(filepath.Join(root, dir))
+		if err != nil || !fi.IsDir() {
+			// The directory itself has been removed or replaced.
+			continue
+		}
+
+		// Count the unchanged paths, up to the point where an opaque whiteout
+		// would no longer be smaller.
+		limit := missing[dir] - 1
+		unchanged, err := countUnchanged(fsEval, root, dir, changed, limit)
+		if err != nil {
+			return nil, errors.Wrapf(err, "count unchanged: %s", dir)
+		}
+		if unchanged < limit {
+			opaqueDirs = append(opaqueDirs, dir)
+		}
+	}
+	return opaqueDirs, nil
+}
+
+// countUnchanged counts the paths under dir (relative to root) which are not
+// in changed, stopping once limit has been reached.
+func countUnchanged(fsEval umoci.FsEval, root, dir string, changed map[string]bool, limit int) (int, error) {
+	children, err := fsEval.Readdir(filepath.Join(root, dir))
+	if err != nil {
+		return 0, errors.Wrap(err, "readdir")
+	}
+
+	count := 0
+	for _, child := range children {
+		if count >= limit {
+			break
+		}
+		name := filepath.Join(dir, child.Name())
+		if !changed[name] {
+			count++
+		}
+		if child.IsDir() {
+			n, err := countUnchanged(fsEval, root, name, changed, limit-count)
+			if err != nil {
+				return 0, err
+			}
+			count += n
+		}
+	}
+	return count, nil
+}
+
+// addOpaqueDir adds the directory dir (relative to root) to the layer with an
+// opaque whiteout, followed by all of its contents.
+func addOpaqueDir(tg *tarGenerator, root, dir string) error {
+	if err := tg.AddFile(dir, filepath.Join(root, dir)); err != nil {
+		return errors.Wrap(err, "add directory")
+	}
+	if err := tg.AddOpaqueWhiteout(dir); err != nil {
+		return errors.Wrap(err, "add opaque whiteout")
+	}
+
+	var addContents func(dir string) error
+	addContents = func(dir string) error {
+		children, err := tg.fsEval.Readdir(filepath.Join(root, dir))
+		if err != nil {
+			return errors.Wrap(err, "readdir")
+		}
+		sort.Sort(fileInfosByName(children))
+		for _, child := range children {
+			name := filepath.Join(dir, child.Name())
+			if err := tg.AddFile(name, filepath.Join(root, name)); err != nil {
+				return errors.Wrapf(err, "add file: %s", name)
+			}
+			if child.IsDir() {
+				if err := addContents(name); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return addContents(dir)
+}
@@ -24,8 +24,11 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/openSUSE/umoci/pkg/progress"
 	"github.com/vbatts/go-mtree"
 )
 
@@ -74,7 +77,7 @@ func TestGenerate(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	reader, err := GenerateLayer(dir, diffs, &MapOptions{})
+	reader, err := GenerateLayer(dir, diffs, &RepackOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -136,6 +139,368 @@ func TestGenerate(t *testing.T) {
 	}
 }
 
+// TestGenerateOpaque makes sure that an opaque whiteout is generated for a
+// directory which has had its contents replaced.
+func TestGenerateOpaque(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateOpaque")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, "replaced"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "kept"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"replaced/a", "replaced/b", "replaced/c", "kept/a", "kept/b", "kept/c", "kept/d", "kept/e"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("old"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	initDh, err := mtree.Walk(dir, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace the contents of replaced/, and only remove one file from kept/.
+	if err := os.RemoveAll(filepath.Join(dir, "replaced")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "replaced"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "replaced", "new"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "kept", "a")); err != nil {
+		t.Fatal(err)
+	}
+
+	postDh, err := mtree.Walk(dir, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := GenerateLayer(dir, diffs, &RepackOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	got := map[string]bool{}
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		got[hdr.Name] = true
+	}
+
+	for _, name := range []string{"replaced/", filepath.Join("replaced", whOpaque), "replaced/new", "kept/" + whPrefix + "a"} {
+		if !got[name] {
+			t.Errorf("expected entry %s in layer, got %v", name, got)
+		}
+	}
+	for _, name := range []string{"replaced/" + whPrefix + "a", whOpaque, "kept/" + whOpaque, "kept/b"} {
+		if got[name] {
+			t.Errorf("unexpected entry %s in layer", name)
+		}
+	}
+}
+
+// TestGenerateFilters makes sure that filtered paths are not included in
+// generated layers.
+func TestGenerateFilters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateFilters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "doc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "doc", "old"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	initDh, err := mtree.Walk(dir, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "etc", "new"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "doc", "old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "doc", "new"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	postDh, err := mtree.Walk(dir, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := GenerateLayer(dir, diffs, &RepackOptions{
+		Filters: PathFilters{Exclude: []string{"/doc"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	gotNew := false
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if strings.HasPrefix(hdr.Name, "doc") {
+			t.Errorf("got filtered path in layer: %s", hdr.Name)
+		}
+		if hdr.Name == filepath.Join("etc", "new") {
+			gotNew = true
+		}
+	}
+	if !gotNew {
+		t.Errorf("did not get new file!")
+	}
+}
+
+func TestGenerateProgress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateProgress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	initDh, err := mtree.Walk(dir, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	postDh, err := mtree.Walk(dir, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var events []progress.Event
+	reader, err := GenerateLayer(dir, diffs, &RepackOptions{
+		Progress: progress.ReporterFunc(func(event progress.Event) {
+			events = append(events, event)
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	// The final event is only reported once the whole layer is generated.
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(events) != len(diffs)+1 {
+		t.Fatalf("expected %d events, got %d: %+v", len(diffs)+1, len(events), events)
+	}
+	last := events[len(events)-1]
+	expected := progress.Event{Operation: "repack", Layer: -1, Bytes: int64(len(data)), Entries: int64(len(diffs)), Done: true}
+	if last != expected {
+		t.Errorf("unexpected final event: expected %+v, got %+v", expected, last)
+	}
+}
+
+func TestGenerateReproducible(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateReproducible")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "old"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	initDh, err := mtree.Walk(dir, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "new"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	postDh, err := mtree.Walk(dir, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clampMtime := time.Unix(1500000000, 0)
+	generate := func() []byte {
+		reader, err := GenerateLayer(dir, diffs, &RepackOptions{
+			Reproducible: true,
+			ClampMtime:   clampMtime,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reader.Close()
+		data, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return data
+	}
+
+	layerA := generate()
+	// Accessing the rootfs and waiting for the clock to tick must not change
+	// the layer.
+	if err := os.Chtimes(filepath.Join(dir, "new"), time.Now().Add(time.Hour), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	layerB := generate()
+	if !bytes.Equal(layerA, layerB) {
+		t.Errorf("repacking the same changes twice resulted in different layers")
+	}
+
+	tr := tar.NewReader(bytes.NewReader(layerA))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !hdr.ModTime.Equal(clampMtime) {
+			t.Errorf("%s: mtime %s was not clamped to %s", hdr.Name, hdr.ModTime, clampMtime)
+		}
+		if !hdr.AccessTime.IsZero() || !hdr.ChangeTime.IsZero() || hdr.Uname != "" || hdr.Gname != "" {
+			t.Errorf("%s: host-specific metadata included in header: %+v", hdr.Name, hdr)
+		}
+	}
+}
+
+// TestGenerateMaskPaths makes sure that neither modifications nor whiteouts
+// are generated for masked paths, and that directories containing masked paths
+// are not turned into opaque whiteouts.
+func TestGenerateMaskPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateMaskPaths")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"tmp", "var/cache", "replaced/cache"} {
+		if err := os.MkdirAll(filepath.Join(dir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"tmp/old", "var/cache/old", "replaced/a", "replaced/b", "replaced/c", "replaced/d", "replaced/e", "replaced/cache/old"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("old"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	initDh, err := mtree.Walk(dir, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Modify and remove files inside the masks, and replace the contents of
+	// replaced/ (which would otherwise become an opaque whiteout).
+	for _, name := range []string{"tmp/old", "var/cache/old", "replaced/a", "replaced/b", "replaced/c", "replaced/d", "replaced/e", "replaced/cache/old"} {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"tmp/new", "var/cache/new", "replaced/new", "replaced/cache/new"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("new"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	postDh, err := mtree.Walk(dir, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := GenerateLayer(dir, diffs, &RepackOptions{
+		MaskPaths: []string{"/tmp", "/var/cache", "/replaced/cache"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	got := map[string]bool{}
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if strings.HasPrefix(hdr.Name, "tmp") || strings.HasPrefix(hdr.Name, "var/cache") || strings.HasPrefix(hdr.Name, "replaced/cache") {
+			t.Errorf("got masked path in layer: %s", hdr.Name)
+		}
+		got[hdr.Name] = true
+	}
+
+	for _, name := range []string{"replaced/", "replaced/new", "replaced/" + whPrefix + "a", "replaced/" + whPrefix + "e"} {
+		if !got[name] {
+			t.Errorf("expected entry %s in layer, got %v", name, got)
+		}
+	}
+	if got[filepath.Join("replaced", whOpaque)] {
+		t.Errorf("unexpected opaque whiteout for directory containing a masked path")
+	}
+}
+
 // Make sure that openSUSE/umoci#33 doesn't regress.
 func TestGenerateMissingFileError(t *testing.T) {
 	dir, err := ioutil.TempDir("", "umoci-TestGenerateError")
@@ -188,7 +553,7 @@ func TestGenerateMissingFileError(t *testing.T) {
 	}
 
 	// Generate a layer where the changed file is missing after the diff.
-	reader, err := GenerateLayer(dir, diffs, &MapOptions{})
+	reader, err := GenerateLayer(dir, diffs, &RepackOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -253,7 +618,7 @@ func TestGenerateWrongRootError(t *testing.T) {
 	}
 
 	// Generate a layer with the wrong root directory.
-	reader, err := GenerateLayer(filepath.Join(dir, "some"), diffs, &MapOptions{})
+	reader, err := GenerateLayer(filepath.Join(dir, "some"), diffs, &RepackOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
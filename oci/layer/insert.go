@@ -0,0 +1,189 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package layer
+
+import (
+	"archive/tar"
+	"io"
+	"path/filepath"
+	"sort"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+)
+
+// InsertOptions are the options used by GenerateInsertLayer and
+// GenerateInsertTarLayer.
+type InsertOptions struct {
+	// MapOptions are used to map the owners of the inserted files from the
+	// host to the image (in the same way as GenerateLayer).
+	MapOptions
+
+	// UID and GID, if not nil, override the owner (in the image) of every
+	// inserted path. They are applied after the owners have been mapped.
+	UID, GID *int
+}
+
+// GenerateInsertLayer creates a new OCI diff layer containing the file or
+// directory at path on the host (including all of its contents, if it is a
+// directory), placed at target inside the image. This avoids having to unpack
+// an image in order to add files to it. The parent directories of target are
+// not included in the layer, so if they don't exist in the image they are
+// created with default metadata when the layer is extracted. The returned
+// reader is for the *raw* tar data, it is the caller's responsibility to gzip
+// it.
+func GenerateInsertLayer(path, target string, opt *InsertOptions) (io.ReadCloser, error) {
+	var insertOptions InsertOptions
+	if opt != nil {
+		insertOptions = *opt
+	}
+
+	reader, writer := io.Pipe()
+
+	go func() (Err error) {
+		// Close with the returned error.
+		defer func() {
+			writer.CloseWithError(errors.Wrap(Err, "generate insert layer"))
+		}()
+
+		tg := newTarGenerator(writer, insertOptions.MapOptions)
+		tg.uid = insertOptions.UID
+		tg.gid = insertOptions.GID
+		if err := tg.addTree(insertTarget(target), path); err != nil {
+			return err
+		}
+		return tg.tw.Close()
+	}()
+
+	return reader, nil
+}
+
+// insertTarget returns the given target path inside the image, relative to
+// the root of the image.
+func insertTarget(target string) string {
+	target, _ = filepath.Rel("/", filepath.Join("/", target))
+	return target
+}
+
+// addTree adds the file at path (and everything under it, if it is a
+// directory) to the archive with the given name, in lexicographic order.
+func (tg *tarGenerator) addTree(name, path string) error {
+	log.Debugf("insert: adding %s as %s", path, name)
+	if err := tg.AddFile(name, path); err != nil {
+		return errors.Wrapf(err, "add file %s", path)
+	}
+
+	fi, err := tg.fsEval.Lstat(path)
+	if err != nil {
+		return errors.Wrap(err, "lstat")
+	}
+	if !fi.IsDir() {
+		return nil
+	}
+
+	infos, err := tg.fsEval.Readdir(path)
+	if err != nil {
+		return errors.Wrapf(err, "readdir %s", path)
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	sort.Strings(names)
+	for _, child := range names {
+		if err := tg.addTree(filepath.Join(name, child), filepath.Join(path, child)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GenerateInsertTarLayer creates a new OCI diff layer from the tar archive
+// read from r, with every entry placed under the directory target inside the
+// image. The owners of the entries are mapped from the host to the image and
+// overridden in the same way as GenerateInsertLayer. Whiteouts in the archive
+// are kept. The returned reader is for the *raw* tar data, it is the caller's
+// responsibility to gzip it.
+func GenerateInsertTarLayer(r io.Reader, target string, opt *InsertOptions) (io.ReadCloser, error) {
+	var insertOptions InsertOptions
+	if opt != nil {
+		insertOptions = *opt
+	}
+	target = insertTarget(target)
+
+	reader, writer := io.Pipe()
+
+	go func() (Err error) {
+		// Close with the returned error.
+		defer func() {
+			writer.CloseWithError(errors.Wrap(Err, "generate insert layer"))
+		}()
+
+		tg := newTarGenerator(writer, insertOptions.MapOptions)
+		tg.uid = insertOptions.UID
+		tg.gid = insertOptions.GID
+
+		tr := tar.NewReader(r)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return errors.Wrap(err, "read next entry")
+			}
+			name := hdr.Name
+			if err := tg.addHeader(target, hdr, tr); err != nil {
+				return errors.Wrapf(err, "insert entry %s", name)
+			}
+		}
+		return tg.tw.Close()
+	}()
+
+	return reader, nil
+}
+
+// addHeader adds an entry from another tar archive to the archive, with its
+// name (and the target of hardlinks) placed under the directory target.
+func (tg *tarGenerator) addHeader(target string, hdr *tar.Header, r io.Reader) error {
+	var err error
+	hdr.Name, err = normalise(filepath.Join(target, CleanPath(hdr.Name)), hdr.Typeflag == tar.TypeDir)
+	if err != nil {
+		return errors.Wrap(err, "normalise path")
+	}
+	if hdr.Typeflag == tar.TypeLink {
+		hdr.Linkname, err = normalise(filepath.Join(target, CleanPath(hdr.Linkname)), false)
+		if err != nil {
+			return errors.Wrap(err, "normalise linkname")
+		}
+	}
+
+	if err := mapHeader(hdr, tg.mapOptions); err != nil {
+		return errors.Wrap(err, "map header")
+	}
+	tg.overrideOwner(hdr)
+
+	if err := tg.tw.WriteHeader(hdr); err != nil {
+		return errors.Wrap(err, "write header")
+	}
+	if n, err := io.Copy(tg.tw, r); err != nil {
+		return errors.Wrap(err, "copy to layer")
+	} else if n != hdr.Size {
+		return errors.Wrap(io.ErrShortWrite, "copy to layer")
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestGenerateInsertLayer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateInsertLayer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "source")
+	if err := os.MkdirAll(filepath.Join(source, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(source, "bin"), []byte("binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(source, "etc", "config"), []byte("config"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(source, "bin"), filepath.Join(source, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("bin", filepath.Join(source, "symlink")); err != nil {
+		t.Fatal(err)
+	}
+
+	uid, gid := 1000, 100
+	reader, err := GenerateInsertLayer(source, "/opt/app", &InsertOptions{
+		MapOptions: MapOptions{Rootless: true},
+		UID:        &uid,
+		GID:        &gid,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	checkTestLayer(t, reader, map[string]testTarEntry{
+		"opt/app/":           {typeflag: tar.TypeDir, uid: uid, gid: gid},
+		"opt/app/bin":        {typeflag: tar.TypeReg, contents: "binary", uid: uid, gid: gid},
+		"opt/app/etc/":       {typeflag: tar.TypeDir, uid: uid, gid: gid},
+		"opt/app/etc/config": {typeflag: tar.TypeReg, contents: "config", uid: uid, gid: gid},
+		"opt/app/link":       {typeflag: tar.TypeLink, linkname: "opt/app/bin", uid: uid, gid: gid},
+		"opt/app/symlink":    {typeflag: tar.TypeSymlink, linkname: "bin", uid: uid, gid: gid},
+	})
+
+	// A single file can also be inserted.
+	reader, err = GenerateInsertLayer(filepath.Join(source, "bin"), "/usr/bin/app", &InsertOptions{
+		MapOptions: MapOptions{Rootless: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	checkTestLayer(t, reader, map[string]testTarEntry{
+		"usr/bin/app": {typeflag: tar.TypeReg, contents: "binary"},
+	})
+}
+
+func TestGenerateInsertTarLayer(t *testing.T) {
+	var buffer bytes.Buffer
+	tw := tar.NewWriter(&buffer)
+	for _, hdr := range []tar.Header{
+		{Name: "./dir/", Typeflag: tar.TypeDir, Mode: 0755, Uid: 1000, Gid: 1000},
+		{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0644, Uid: 1001, Gid: 1000, Size: 4},
+		{Name: "dir/link", Typeflag: tar.TypeLink, Linkname: "./dir/file", Uid: 1001, Gid: 1000},
+		{Name: "../../escape", Typeflag: tar.TypeSymlink, Linkname: "../etc", Uid: 1000, Gid: 1000},
+	} {
+		hdr := hdr
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			if _, err := tw.Write([]byte("data")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	gid := 5
+	reader, err := GenerateInsertTarLayer(&buffer, "/srv", &InsertOptions{
+		MapOptions: MapOptions{
+			UIDMappings: []rspec.IDMapping{{HostID: 1000, ContainerID: 0, Size: 1000}},
+			GIDMappings: []rspec.IDMapping{{HostID: 1000, ContainerID: 0, Size: 1000}},
+		},
+		GID: &gid,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	checkTestLayer(t, reader, map[string]testTarEntry{
+		"srv/dir/":     {typeflag: tar.TypeDir, uid: 0, gid: gid},
+		"srv/dir/file": {typeflag: tar.TypeReg, contents: "data", uid: 1, gid: gid},
+		"srv/dir/link": {typeflag: tar.TypeLink, linkname: "srv/dir/file", uid: 1, gid: gid},
+		"srv/escape":   {typeflag: tar.TypeSymlink, linkname: "../etc", uid: 0, gid: gid},
+	})
+
+	// Owners which can't be mapped are an error.
+	var bad bytes.Buffer
+	tw = tar.NewWriter(&bad)
+	if err := tw.WriteHeader(&tar.Header{Name: "file", Typeflag: tar.TypeReg, Mode: 0644, Uid: 5}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Close()
+	reader, err = GenerateInsertTarLayer(&bad, "/", &InsertOptions{
+		MapOptions: MapOptions{
+			UIDMappings: []rspec.IDMapping{{HostID: 1000, ContainerID: 0, Size: 1000}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if _, err := ioutil.ReadAll(reader); err == nil {
+		t.Errorf("expected an error inserting a file with an unmapped owner")
+	}
+}
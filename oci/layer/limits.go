@@ -0,0 +1,140 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"fmt"
+	"strings"
+
+	"github.com/apex/log"
+)
+
+// UnpackLimits restricts what the layers of an image may contain when they
+// are unpacked, to protect against hostile images. A zero value for any of
+// the limits means that it isn't enforced. MaxBytes and MaxEntries apply to
+// all of the layers unpacked together (such as by UnpackManifest), not to each
+// layer separately.
+type UnpackLimits struct {
+	// MaxBytes is the maximum total size of the contents of regular files.
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+
+	// MaxEntries is the maximum total number of entries (including
+	// whiteouts).
+	MaxEntries int64 `json:"max_entries,omitempty"`
+
+	// MaxPathDepth is the maximum number of components in the path of an
+	// entry.
+	MaxPathDepth int `json:"max_path_depth,omitempty"`
+
+	// MaxPathLength is the maximum length of the path of an entry, or of the
+	// target of a link.
+	MaxPathLength int `json:"max_path_length,omitempty"`
+
+	// MaxXattrSize is the maximum size of the value of an xattr.
+	MaxXattrSize int `json:"max_xattr_size,omitempty"`
+
+	// StripSetuid specifies whether the setuid and setgid bits are cleared
+	// from the mode of every entry.
+	StripSetuid bool `json:"strip_setuid,omitempty"`
+
+	// NoDevices specifies whether layers containing character or block
+	// devices are refused.
+	NoDevices bool `json:"no_devices,omitempty"`
+}
+
+// LimitError is returned when a layer being unpacked exceeds one of the
+// UnpackLimits.
+type LimitError struct {
+	// Path is the path of the entry which exceeded the limit.
+	Path string
+
+	// Limit is a description of the limit which was exceeded.
+	Limit string
+
+	// Value and Max are the value that exceeded the limit and the limit
+	// itself (if the limit is numeric).
+	Value, Max int64
+}
+
+// Error implements the error interface. The path is not included, because
+// the errors from unpacking an entry already include it.
+func (e *LimitError) Error() string {
+	if e.Max == 0 {
+		return fmt.Sprintf("unpack limits: %s", e.Limit)
+	}
+	return fmt.Sprintf("unpack limits: %s exceeded (%d > %d)", e.Limit, e.Value, e.Max)
+}
+
+// unpackUsage keeps track of the totals which are limited by UnpackLimits,
+// and is shared by the tarExtractors of the layers unpacked together.
+type unpackUsage struct {
+	bytes   int64
+	entries int64
+}
+
+// modeSetuidSetgid are the setuid and setgid bits of tar.Header.Mode.
+const modeSetuidSetgid = 04000 | 02000
+
+// checkLimits returns an error if the given entry (with a clean name) exceeds
+// the limits of the tarExtractor, and applies the setuid policy to it.
+func (te *tarExtractor) checkLimits(hdr *tar.Header) error {
+	limits := te.limits
+
+	te.usage.entries++
+	if limits.MaxEntries > 0 && te.usage.entries > limits.MaxEntries {
+		return &LimitError{Path: hdr.Name, Limit: "maximum entry count", Value: te.usage.entries, Max: limits.MaxEntries}
+	}
+
+	if limits.MaxPathLength > 0 {
+		for _, path := range []string{hdr.Name, hdr.Linkname} {
+			if len(path) > limits.MaxPathLength {
+				return &LimitError{Path: hdr.Name, Limit: "maximum path length", Value: int64(len(path)), Max: int64(limits.MaxPathLength)}
+			}
+		}
+	}
+	if limits.MaxPathDepth > 0 && hdr.Name != "." {
+		if depth := strings.Count(hdr.Name, "/") + 1; depth > limits.MaxPathDepth {
+			return &LimitError{Path: hdr.Name, Limit: "maximum path depth", Value: int64(depth), Max: int64(limits.MaxPathDepth)}
+		}
+	}
+
+	if limits.MaxXattrSize > 0 {
+		for name, value := range hdr.Xattrs {
+			if len(value) > limits.MaxXattrSize {
+				return &LimitError{Path: hdr.Name, Limit: "maximum xattr size (" + name + ")", Value: int64(len(value)), Max: int64(limits.MaxXattrSize)}
+			}
+		}
+	}
+
+	if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA || hdr.Typeflag == tar.TypeGNUSparse {
+		te.usage.bytes += hdr.Size
+		if limits.MaxBytes > 0 && te.usage.bytes > limits.MaxBytes {
+			return &LimitError{Path: hdr.Name, Limit: "maximum total size", Value: te.usage.bytes, Max: limits.MaxBytes}
+		}
+	}
+
+	if limits.NoDevices && (hdr.Typeflag == tar.TypeChar || hdr.Typeflag == tar.TypeBlock) {
+		return &LimitError{Path: hdr.Name, Limit: "device nodes are not permitted"}
+	}
+	if limits.StripSetuid && hdr.Mode&modeSetuidSetgid != 0 {
+		log.Debugf("unpack entry: stripping setuid and setgid bits: %s", hdr.Name)
+		hdr.Mode &^= modeSetuidSetgid
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/drivers/dir"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+func TestUnpackLimits(t *testing.T) {
+	file := func(name, contents string) testLayerEntry {
+		return testLayerEntry{
+			hdr:      tar.Header{Name: name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(contents))},
+			contents: contents,
+		}
+	}
+	xattrFile := file("xattr", "")
+	xattrFile.hdr.Xattrs = map[string]string{"user.big": "0123456789"}
+
+	for _, test := range []struct {
+		name    string
+		limits  UnpackLimits
+		entries []testLayerEntry
+		limit   string
+	}{
+		{"MaxBytes", UnpackLimits{MaxBytes: 10}, []testLayerEntry{file("a", "12345"), file("b", "123456")}, "maximum total size"},
+		{"MaxEntries", UnpackLimits{MaxEntries: 2}, []testLayerEntry{file("a", ""), file("b", ""), file("c", "")}, "maximum entry count"},
+		{"MaxPathDepth", UnpackLimits{MaxPathDepth: 2}, []testLayerEntry{file("a/b/c", "")}, "maximum path depth"},
+		{"MaxPathLength", UnpackLimits{MaxPathLength: 8}, []testLayerEntry{file("abcdefghi", "")}, "maximum path length"},
+		{"MaxPathLengthLink", UnpackLimits{MaxPathLength: 8}, []testLayerEntry{{hdr: tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/abcdefghi"}}}, "maximum path length"},
+		{"MaxXattrSize", UnpackLimits{MaxXattrSize: 8}, []testLayerEntry{xattrFile}, "maximum xattr size (user.big)"},
+		{"NoDevices", UnpackLimits{NoDevices: true}, []testLayerEntry{{hdr: tar.Header{Name: "null", Mode: 0666, Typeflag: tar.TypeChar, Devmajor: 1, Devminor: 3}}}, "device nodes are not permitted"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			root, err := ioutil.TempDir("", "umoci-TestUnpackLimits")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(root)
+
+			layer := makeTestLayer(t, test.entries)
+			err = UnpackLayer(root, bytes.NewReader(layer), &UnpackOptions{Limits: test.limits})
+			limitErr, ok := errors.Cause(err).(*LimitError)
+			if !ok {
+				t.Fatalf("expected a LimitError, got %+v", err)
+			}
+			if limitErr.Limit != test.limit {
+				t.Errorf("unexpected limit exceeded: expected %q, got %q", test.limit, limitErr.Limit)
+			}
+
+			// Without limits the layer must unpack.
+			if err := os.RemoveAll(root); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Mkdir(root, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if os.Geteuid() != 0 && test.name == "NoDevices" {
+				return
+			}
+			if err := UnpackLayer(root, bytes.NewReader(layer), nil); err != nil {
+				t.Errorf("unexpected error unpacking without limits: %+v", err)
+			}
+		})
+	}
+}
+
+func TestUnpackLimitsFilteredXattr(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestUnpackLimitsFilteredXattr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// Xattrs which are filtered out are never set, so they aren't limited.
+	layer := makeTestLayer(t, []testLayerEntry{
+		{hdr: tar.Header{Name: "xattr", Mode: 0644, Typeflag: tar.TypeReg, Xattrs: map[string]string{"user.big": "0123456789"}}},
+	})
+	opt := &UnpackOptions{
+		Limits: UnpackLimits{MaxXattrSize: 8},
+		Xattrs: XattrFilter{Exclude: []string{"user.*"}},
+	}
+	if err := UnpackLayer(root, bytes.NewReader(layer), opt); err != nil {
+		t.Fatalf("unexpected error unpacking layer with filtered xattr: %+v", err)
+	}
+}
+
+func TestUnpackLimitsStripSetuid(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestUnpackLimitsStripSetuid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	layer := makeTestLayer(t, []testLayerEntry{
+		{hdr: tar.Header{Name: "setuid", Mode: 04755, Typeflag: tar.TypeReg}},
+		{hdr: tar.Header{Name: "setgid", Mode: 02755, Typeflag: tar.TypeReg}},
+		{hdr: tar.Header{Name: "sticky", Mode: 01777, Typeflag: tar.TypeDir}},
+	})
+	if err := UnpackLayer(root, bytes.NewReader(layer), &UnpackOptions{Limits: UnpackLimits{StripSetuid: true}}); err != nil {
+		t.Fatalf("unexpected error unpacking layer: %+v", err)
+	}
+
+	for name, mode := range map[string]os.FileMode{
+		"setuid": 0755,
+		"setgid": 0755,
+		"sticky": 0777 | os.ModeSticky | os.ModeDir,
+	} {
+		fi, err := os.Lstat(filepath.Join(root, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode() != mode {
+			t.Errorf("unexpected mode for %s: expected %s, got %s", name, mode, fi.Mode())
+		}
+	}
+}
+
+func TestUnpackManifestLimits(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestUnpackManifestLimits")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+
+	// Each layer is within the limit, but the image isn't.
+	manifest := makeTestImage(t, engine, [][]testLayerFile{
+		{{"a", "12345"}},
+		{{"b", "12345"}},
+		{{"c", "12345"}},
+	})
+
+	bundle := filepath.Join(root, "bundle")
+	err = UnpackManifest(context.Background(), engine, bundle, manifest, &UnpackOptions{Limits: UnpackLimits{MaxBytes: 12}})
+	if limitErr, ok := errors.Cause(err).(*LimitError); !ok || limitErr.Path != "c" {
+		t.Errorf("expected a LimitError for c, got %+v", err)
+	}
+}
@@ -0,0 +1,427 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/pkg/system"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	// overlayUpperName is the name of the overlayfs upper directory inside an
+	// overlay bundle, which stores the changes made to the rootfs.
+	overlayUpperName = "upper"
+
+	// overlayWorkName is the name of the overlayfs work directory inside an
+	// overlay bundle.
+	overlayWorkName = "work"
+
+	// overlayEmptyName is the name of the (empty) layer directory inside the
+	// layer store used for images without any layers, because overlayfs
+	// requires at least one lower directory.
+	overlayEmptyName = "empty"
+)
+
+// UnpackManifestOverlay extracts all of the layers in the given manifest into
+// their own directories inside layerStore, and generates a runtime bundle
+// which mounts them as the rootfs using overlayfs. Layer directories are named
+// by the ChainID of the layer (and the mapping options), so a layerStore can
+// be shared between bundles and layers that have already been extracted are
+// re-used. Whiteouts are converted to overlayfs whiteouts, using the "user."
+// xattr namespace (which requires the "userxattr" mount option) in rootless
+// mode.
+//
+// The <bundle>/<layer.RootfsName> directory is left empty, and is used as the
+// mountpoint. Changes made to the rootfs by the container are stored in
+// <bundle>/upper, and cannot be repacked with the mutate package.
+func UnpackManifestOverlay(ctx context.Context, engine cas.Engine, bundle, layerStore string, manifest ispec.Manifest, opt *UnpackOptions) error {
+	engineExt := casext.Engine{engine}
+
+	var unpackOptions UnpackOptions
+	if opt != nil {
+		unpackOptions = *opt
+	}
+	mapOptions := unpackOptions.MapOptions
+
+	// overlayfs mount options are paths, so they must be absolute.
+	bundle, err := filepath.Abs(bundle)
+	if err != nil {
+		return errors.Wrap(err, "get absolute bundle path")
+	}
+	layerStore, err = filepath.Abs(layerStore)
+	if err != nil {
+		return errors.Wrap(err, "get absolute layer store path")
+	}
+
+	configPath := filepath.Join(bundle, "config.json")
+	rootfsPath := filepath.Join(bundle, RootfsName)
+	upperPath := filepath.Join(bundle, overlayUpperName)
+	workPath := filepath.Join(bundle, overlayWorkName)
+
+	if err := prepareBundle(bundle); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(layerStore, 0755); err != nil {
+		return errors.Wrap(err, "mkdir layer store")
+	}
+
+	config, err := unpackConfig(ctx, engineExt, manifest)
+	if err != nil {
+		return err
+	}
+
+	// Extract each layer which isn't already in the layer store. The limits
+	// on the totals apply to all of the layers being extracted.
+	usage := &unpackUsage{}
+	var layerDirs []string
+	var chainID digest.Digest
+	for idx, layerDescriptor := range manifest.Layers {
+		diffID := digest.Digest(config.RootFS.DiffIDs[idx])
+		if err := diffID.Validate(); err != nil {
+			return errors.Wrapf(err, "invalid diffid %d", idx)
+		}
+		if chainID == "" {
+			chainID = diffID
+		} else {
+			chainID = digest.FromString(chainID.String() + " " + diffID.String())
+		}
+
+		layerDir := filepath.Join(layerStore, overlayLayerName(chainID, unpackOptions))
+		if _, err := os.Lstat(layerDir); err == nil {
+			log.Infof("unpack layer: %s (already extracted)", layerDescriptor.Digest)
+		} else if os.IsNotExist(err) {
+			log.Infof("unpack layer: %s", layerDescriptor.Digest)
+			if err := unpackOverlayLayer(ctx, engineExt, layerDir, layerDirs, layerDescriptor, diffID, unpackOptions, usage); err != nil {
+				return errors.Wrap(err, "unpack layer")
+			}
+		} else {
+			return errors.Wrap(err, "stat layer directory")
+		}
+		layerDirs = append(layerDirs, layerDir)
+	}
+	if len(layerDirs) == 0 {
+		emptyDir := filepath.Join(layerStore, overlayEmptyName)
+		if err := os.MkdirAll(emptyDir, 0755); err != nil {
+			return errors.Wrap(err, "mkdir empty layer")
+		}
+		layerDirs = append(layerDirs, emptyDir)
+	}
+
+	// The root directory of the overlay mount takes its metadata from the
+	// upper directory, so it has to be set up like a normal rootfs.
+	for _, path := range []string{rootfsPath, upperPath, workPath} {
+		if err := os.Mkdir(path, 0755); err != nil {
+			return errors.Wrapf(err, "mkdir %s", filepath.Base(path))
+		}
+	}
+	if err := prepareRoot(upperPath, mapOptions); err != nil {
+		return errors.Wrap(err, "prepare upper")
+	}
+
+	// overlayfs lists the lower directories topmost first.
+	var lowerDirs []string
+	for idx := len(layerDirs) - 1; idx >= 0; idx-- {
+		lowerDirs = append(lowerDirs, layerDirs[idx])
+	}
+	for _, path := range append(lowerDirs, upperPath, workPath) {
+		if strings.ContainsAny(path, ":,") {
+			return errors.Errorf("overlay path contains ':' or ',': %s", path)
+		}
+	}
+	options := []string{
+		"lowerdir=" + strings.Join(lowerDirs, ":"),
+		"upperdir=" + upperPath,
+		"workdir=" + workPath,
+	}
+	if mapOptions.Rootless {
+		options = append(options, "userxattr")
+	}
+
+	return writeRuntimeConfig(configPath, rootfsPath, manifest, config, mapOptions, rspec.Mount{
+		Destination: "/",
+		Type:        "overlay",
+		Source:      "overlay",
+		Options:     options,
+	})
+}
+
+// overlayLayerName returns the name of the layer directory for the layer with
+// the given ChainID. The name includes a hash of the mapping options, path
+// filters, xattr filters and setuid policy if there are any, because they
+// affect the contents of the layer directory.
+func overlayLayerName(chainID digest.Digest, unpackOptions UnpackOptions) string {
+	name := chainID.Algorithm().String() + "_" + chainID.Hex()
+	mapOptions := unpackOptions.MapOptions
+	if mapOptions.Rootless || len(mapOptions.UIDMappings) > 0 || len(mapOptions.GIDMappings) > 0 || !unpackOptions.Filters.Empty() || !unpackOptions.Xattrs.Empty() || unpackOptions.Limits.StripSetuid {
+		// Only the options which affect the contents of the layer directory
+		// are included, and the xattr filters are omitted if empty so that
+		// existing layer directories keep their names. json.Marshal cannot
+		// fail for these options.
+		var xattrs *XattrFilter
+		if !unpackOptions.Xattrs.Empty() {
+			xattrs = &unpackOptions.Xattrs
+		}
+		data, _ := json.Marshal(struct {
+			MapOptions  MapOptions
+			Filters     PathFilters
+			Xattrs      *XattrFilter `json:",omitempty"`
+			StripSetuid bool         `json:",omitempty"`
+		}{mapOptions, unpackOptions.Filters, xattrs, unpackOptions.Limits.StripSetuid})
+		name += "-" + digest.FromBytes(data).Hex()[:12]
+	}
+	return name
+}
+
+// unpackOverlayLayer extracts the given layer into the new layer directory
+// layerDir. lowerDirs are the layer directories of the previous layers, in
+// order. The layer is extracted into a temporary directory which is renamed
+// into place, so that a concurrent extraction of the same layer (for another
+// bundle) cannot result in a partially extracted layer being used.
+func unpackOverlayLayer(ctx context.Context, engineExt casext.Engine, layerDir string, lowerDirs []string, descriptor ispec.Descriptor, diffID digest.Digest, unpackOptions UnpackOptions, usage *unpackUsage) error {
+	tmpDir, err := ioutil.TempDir(filepath.Dir(layerDir), ".tmp-"+filepath.Base(layerDir)+"-")
+	if err != nil {
+		return errors.Wrap(err, "create temporary layer directory")
+	}
+
+	// The temporary directory is gone once it has been renamed into place. In
+	// rootless mode it may contain directories we can't write to, so it has
+	// to be removed through the extractor's fsEval.
+	te := newTarExtractor(unpackOptions.MapOptions)
+	defer func() {
+		if err := te.fsEval.RemoveAll(tmpDir); err != nil {
+			log.Warnf("failed to remove temporary layer directory %s: %v", tmpDir, err)
+		}
+	}()
+
+	if err := os.Chmod(tmpDir, 0755); err != nil {
+		return errors.Wrap(err, "chmod temporary layer directory")
+	}
+	if err := prepareRoot(tmpDir, unpackOptions.MapOptions); err != nil {
+		return errors.Wrap(err, "prepare layer directory")
+	}
+
+	layer := fetchLayer(ctx, engineExt, descriptor, diffID.String())
+	defer layer.Close()
+
+	te.filters = unpackOptions.Filters
+	te.xattrs = unpackOptions.Xattrs
+	te.limits = unpackOptions.Limits
+	te.usage = usage
+	te.overlay = true
+	for idx := len(lowerDirs) - 1; idx >= 0; idx-- {
+		te.lowerDirs = append(te.lowerDirs, lowerDirs[idx])
+	}
+
+	// The index of the layer in the image is the number of layers below it.
+	report := layer.progress(unpackOptions.Progress, len(lowerDirs), descriptor)
+	tr := tar.NewReader(layer)
+	var entries int64
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "read next entry")
+		}
+		if err := te.unpackEntry(tmpDir, hdr, tr); err != nil {
+			return errors.Wrapf(err, "unpack entry: %s", hdr.Name)
+		}
+		entries++
+		report(entries, false)
+	}
+	// Make sure the whole layer is read, to verify the DiffID.
+	if _, err := io.Copy(ioutil.Discard, layer); err != nil {
+		return errors.Wrap(err, "finish layer")
+	}
+	report(entries, true)
+	if err := te.applyOverlayXattrs(); err != nil {
+		return errors.Wrap(err, "apply overlay xattrs")
+	}
+
+	if err := os.Rename(tmpDir, layerDir); err != nil {
+		// Someone else might have extracted the same layer in the meantime.
+		if _, err := os.Lstat(layerDir); err == nil {
+			return nil
+		}
+		return errors.Wrap(err, "rename layer directory")
+	}
+	return nil
+}
+
+// overlayXattr returns the name of the overlayfs xattr with the given name.
+// In rootless mode the "user." namespace is used, because unprivileged users
+// cannot set "trusted." xattrs.
+func (te *tarExtractor) overlayXattr(name string) string {
+	if te.mapOptions.Rootless {
+		return "user.overlay." + name
+	}
+	return "trusted.overlay." + name
+}
+
+// addOverlayXattr records that the given overlayfs xattr must be set on path
+// once the layer has been extracted.
+func (te *tarExtractor) addOverlayXattr(path, name string) {
+	if te.overlayXattrs == nil {
+		te.overlayXattrs = make(map[string][]string)
+	}
+	te.overlayXattrs[path] = append(te.overlayXattrs[path], te.overlayXattr(name))
+}
+
+// applyOverlayXattrs sets the overlayfs xattrs recorded while extracting the
+// layer.
+func (te *tarExtractor) applyOverlayXattrs() error {
+	for path, names := range te.overlayXattrs {
+		for _, name := range names {
+			if err := te.fsEval.Lsetxattr(path, name, []byte("y"), 0); err != nil {
+				return errors.Wrapf(err, "set %s: %s", name, path)
+			}
+		}
+	}
+	return nil
+}
+
+// overlayWhiteout converts the whiteout file inside dir to an overlayfs
+// whiteout. Opaque whiteouts mark dir as opaque, and other whiteouts are
+// replaced by a 0:0 character device (or an empty file with a whiteout xattr
+// in rootless mode, as unprivileged users cannot create device nodes).
+func (te *tarExtractor) overlayWhiteout(dir, file string) error {
+	if err := te.fsEval.MkdirAll(dir, 0777); err != nil {
+		return errors.Wrap(err, "mkdir parent")
+	}
+
+	if file == whOpaque {
+		te.addOverlayXattr(dir, "opaque")
+		return nil
+	}
+
+	path := filepath.Join(dir, strings.TrimPrefix(file, whPrefix))
+	if err := te.fsEval.RemoveAll(path); err != nil {
+		return errors.Wrap(err, "remove whiteout path")
+	}
+
+	if te.mapOptions.Rootless {
+		fh, err := te.fsEval.Create(path)
+		if err != nil {
+			return errors.Wrap(err, "create whiteout")
+		}
+		fh.Close()
+		te.addOverlayXattr(path, "whiteout")
+		te.addOverlayXattr(dir, "whiteouts")
+		return nil
+	}
+
+	mode := system.Tarmode(tar.TypeChar)
+	if err := te.fsEval.Mknod(path, os.FileMode(mode), system.Makedev(0, 0)); err != nil {
+		return errors.Wrap(err, "mknod whiteout")
+	}
+	return nil
+}
+
+// overlayCopyUp copies path (and any of its missing parent directories) from
+// the topmost lower layer directory containing it into root, if it doesn't
+// already exist in root. This is necessary for hardlinks to files in lower
+// layers, because hardlinks cannot cross layer directories.
+func (te *tarExtractor) overlayCopyUp(root, path string) error {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return errors.Wrap(err, "get relative path")
+	}
+
+	current := root
+	for _, component := range strings.Split(rel, string(filepath.Separator)) {
+		current = filepath.Join(current, component)
+		if _, err := te.fsEval.Lstat(current); err == nil {
+			continue
+		}
+		currentRel := strings.TrimPrefix(current, root)
+
+		var lowerPath string
+		var fi os.FileInfo
+		for _, lowerDir := range te.lowerDirs {
+			lowerPath = filepath.Join(lowerDir, currentRel)
+			if fi, err = te.fsEval.Lstat(lowerPath); err == nil {
+				break
+			}
+			fi = nil
+		}
+		if fi == nil {
+			// Let the caller deal with the missing path.
+			return nil
+		}
+
+		switch {
+		case fi.IsDir():
+			if err := te.fsEval.Mkdir(current, 0777); err != nil {
+				return errors.Wrap(err, "copy up directory")
+			}
+		case fi.Mode().IsRegular():
+			if err := te.copyUpFile(lowerPath, current); err != nil {
+				return errors.Wrap(err, "copy up file")
+			}
+		default:
+			return errors.Errorf("copy up %s: unsupported file type %s", currentRel, fi.Mode().String())
+		}
+
+		// The metadata comes from the filesystem, so it doesn't need to be
+		// mapped.
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return errors.Wrap(err, "convert fi to hdr")
+		}
+		if err := te.restoreMetadata(current, hdr); err != nil {
+			return errors.Wrap(err, "restore copied up metadata")
+		}
+	}
+	return nil
+}
+
+// copyUpFile copies the contents of the regular file src to dst.
+func (te *tarExtractor) copyUpFile(src, dst string) error {
+	in, err := te.fsEval.Open(src)
+	if err != nil {
+		return errors.Wrap(err, "open source")
+	}
+	defer in.Close()
+
+	out, err := te.fsEval.Create(dst)
+	if err != nil {
+		return errors.Wrap(err, "create destination")
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return errors.Wrap(err, "copy data")
+	}
+	return nil
+}
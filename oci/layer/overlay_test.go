@@ -0,0 +1,248 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/drivers/dir"
+	"github.com/openSUSE/umoci/pkg/system"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+func TestUnpackManifestOverlay(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating overlayfs whiteouts requires root")
+	}
+
+	root, err := ioutil.TempDir("", "umoci-TestUnpackManifestOverlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+
+	manifest := makeTestImage(t, engine, [][]testLayerFile{
+		{{"file", "a"}, {"dir/file", "a"}},
+		{{".wh.file", ""}, {"dir/" + whOpaque, ""}, {"dir/new", "b"}},
+	})
+
+	store := filepath.Join(root, "layers")
+	bundle := filepath.Join(root, "bundle")
+	if err := UnpackManifestOverlay(context.Background(), engine, bundle, store, manifest, &UnpackOptions{}); err != nil {
+		t.Fatalf("unexpected error unpacking manifest: %+v", err)
+	}
+
+	layerDirs, err := filepath.Glob(filepath.Join(store, "sha256_*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layerDirs) != 2 {
+		t.Fatalf("expected 2 layer directories, got %v", layerDirs)
+	}
+
+	// Find the upper layer, which is the one with the whiteouts.
+	lower, upper := layerDirs[0], layerDirs[1]
+	if _, err := os.Lstat(filepath.Join(lower, "dir", "new")); err == nil {
+		lower, upper = upper, lower
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(lower, "dir", "file")); err != nil || string(got) != "a" {
+		t.Errorf("lower layer has wrong dir/file: %q %v", got, err)
+	}
+
+	fi, err := os.Lstat(filepath.Join(upper, "file"))
+	if err != nil {
+		t.Fatalf("whiteout missing: %+v", err)
+	}
+	if stat, ok := fi.Sys().(*syscall.Stat_t); fi.Mode()&os.ModeCharDevice == 0 || !ok || stat.Rdev != 0 {
+		t.Errorf("whiteout is not a 0:0 character device: %s", fi.Mode())
+	}
+	if value, err := system.Lgetxattr(filepath.Join(upper, "dir"), "trusted.overlay.opaque"); err != nil || string(value) != "y" {
+		t.Errorf("opaque directory not marked as opaque: %q %v", value, err)
+	}
+	if _, err := os.Lstat(filepath.Join(upper, "dir", whOpaque)); !os.IsNotExist(err) {
+		t.Errorf("opaque whiteout was extracted: %v", err)
+	}
+
+	// Check the overlay mount in config.json.
+	configData, err := ioutil.ReadFile(filepath.Join(bundle, "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec rspec.Spec
+	if err := json.Unmarshal(configData, &spec); err != nil {
+		t.Fatal(err)
+	}
+	if len(spec.Mounts) == 0 || spec.Mounts[0].Type != "overlay" || spec.Mounts[0].Destination != "/" {
+		t.Fatalf("config.json does not start with an overlay root mount: %v", spec.Mounts)
+	}
+	options := strings.Join(spec.Mounts[0].Options, ",")
+	if !strings.Contains(options, "lowerdir="+upper+":"+lower) {
+		t.Errorf("overlay mount has wrong lowerdir: %s", options)
+	}
+	if !strings.Contains(options, "upperdir="+filepath.Join(bundle, overlayUpperName)) {
+		t.Errorf("overlay mount has wrong upperdir: %s", options)
+	}
+
+	// A second bundle must re-use the extracted layers.
+	if err := ioutil.WriteFile(filepath.Join(upper, "marker"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	bundle2 := filepath.Join(root, "bundle2")
+	if err := UnpackManifestOverlay(context.Background(), engine, bundle2, store, manifest, &UnpackOptions{}); err != nil {
+		t.Fatalf("unexpected error unpacking manifest again: %+v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(upper, "marker")); err != nil {
+		t.Errorf("layer directory was not re-used: %+v", err)
+	}
+	if layerDirs2, _ := filepath.Glob(filepath.Join(store, "*")); len(layerDirs2) != 2 {
+		t.Errorf("expected layer store to still have 2 entries, got %v", layerDirs2)
+	}
+}
+
+func TestUnpackManifestOverlayRootless(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestUnpackManifestOverlayRootless")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+
+	manifest := makeTestImage(t, engine, [][]testLayerFile{
+		{{"file", "a"}},
+		{{".wh.file", ""}},
+	})
+
+	unpackOptions := &UnpackOptions{
+		MapOptions: MapOptions{
+			UIDMappings: []rspec.IDMapping{{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1}},
+			GIDMappings: []rspec.IDMapping{{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1}},
+			Rootless:    true,
+		},
+	}
+	store := filepath.Join(root, "layers")
+	bundle := filepath.Join(root, "bundle")
+	if err := UnpackManifestOverlay(context.Background(), engine, bundle, store, manifest, unpackOptions); err != nil {
+		if os.IsPermission(errors.Cause(err)) || strings.Contains(err.Error(), "operation not supported") {
+			t.Skipf("user xattrs not supported: %v", err)
+		}
+		t.Fatalf("unexpected error unpacking manifest: %+v", err)
+	}
+
+	whiteouts, err := filepath.Glob(filepath.Join(store, "*", "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, path := range whiteouts {
+		if value, err := system.Lgetxattr(path, "user.overlay.whiteout"); err == nil && string(value) == "y" {
+			found = true
+			if fi, err := os.Lstat(path); err != nil || !fi.Mode().IsRegular() {
+				t.Errorf("rootless whiteout is not a regular file: %v", err)
+			}
+			if value, err := system.Lgetxattr(filepath.Dir(path), "user.overlay.whiteouts"); err != nil || string(value) != "y" {
+				t.Errorf("rootless whiteout parent not marked: %q %v", value, err)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("no rootless whiteout found in %v", whiteouts)
+	}
+
+	configData, err := ioutil.ReadFile(filepath.Join(bundle, "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(configData), "userxattr") {
+		t.Errorf("rootless overlay mount is missing userxattr")
+	}
+}
+
+func TestUnpackManifestOverlayRootlessCleanup(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestUnpackManifestOverlayRootlessCleanup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+
+	// The read-only directory can only be removed by a rootless-aware
+	// RemoveAll, and the last entry exceeds the entry limit.
+	manifest := makeTestImageEntries(t, engine, [][]testLayerEntry{{
+		{hdr: tar.Header{Name: "ro/", Mode: 0500, Typeflag: tar.TypeDir}},
+		{hdr: tar.Header{Name: "ro/file", Mode: 0400, Typeflag: tar.TypeReg}},
+		{hdr: tar.Header{Name: "file", Mode: 0644, Typeflag: tar.TypeReg}},
+	}})
+
+	unpackOptions := &UnpackOptions{
+		MapOptions: MapOptions{
+			UIDMappings: []rspec.IDMapping{{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1}},
+			GIDMappings: []rspec.IDMapping{{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1}},
+			Rootless:    true,
+		},
+		Limits: UnpackLimits{MaxEntries: 2},
+	}
+	store := filepath.Join(root, "layers")
+	bundle := filepath.Join(root, "bundle")
+	err = UnpackManifestOverlay(context.Background(), engine, bundle, store, manifest, unpackOptions)
+	if _, ok := errors.Cause(err).(*LimitError); !ok {
+		t.Fatalf("expected a LimitError, got %+v", err)
+	}
+
+	if leftover, err := filepath.Glob(filepath.Join(store, ".tmp-*")); err != nil {
+		t.Fatal(err)
+	} else if len(leftover) > 0 {
+		t.Errorf("temporary layer directories left behind: %v", leftover)
+	}
+}
@@ -0,0 +1,346 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// seekData and seekHole are the lseek(2) whence values used to find the
+	// data and holes in a sparse file. Filesystems which don't support them
+	// either return EINVAL or treat the whole file as data.
+	seekData = 3
+	seekHole = 4
+
+	// sparseBlockSize is the granularity with which holes are recreated when
+	// extracting a file. Blocks of zeros smaller than this are written out.
+	sparseBlockSize = 4096
+
+	// sparseCopyBufferSize is the size of the buffer used when extracting a
+	// file.
+	sparseCopyBufferSize = 32 * sparseBlockSize
+
+	// tarBlockSize is the size of a tar header, and the alignment of the
+	// contents of each entry.
+	tarBlockSize = 512
+)
+
+// sparseEntry is a fragment of data in a sparse file.
+type sparseEntry struct {
+	Offset int64
+	Length int64
+}
+
+// sparseMap returns the data fragments of the given file (which has the given
+// size), using SEEK_DATA and SEEK_HOLE. If the file doesn't have any holes (or
+// the filesystem cannot tell us where they are) nil is returned. If the file
+// ends with a hole, the last fragment is an empty fragment at the end of the
+// file (as done by GNU tar). The offset of fh is undefined afterwards.
+func sparseMap(fh *os.File, size int64) ([]sparseEntry, error) {
+	var fragments []sparseEntry
+	for offset := int64(0); offset < size; {
+		data, err := fh.Seek(offset, seekData)
+		if err != nil {
+			if errno, ok := unwrapPathError(err).(syscall.Errno); ok {
+				switch errno {
+				case syscall.ENXIO:
+					// There is no more data after offset.
+					offset = size
+					continue
+				case syscall.EINVAL:
+					// SEEK_DATA isn't supported.
+					return nil, nil
+				}
+			}
+			return nil, errors.Wrap(err, "seek data")
+		}
+		hole, err := fh.Seek(data, seekHole)
+		if err != nil {
+			return nil, errors.Wrap(err, "seek hole")
+		}
+		if hole > size {
+			hole = size
+		}
+		fragments = append(fragments, sparseEntry{Offset: data, Length: hole - data})
+		offset = hole
+	}
+
+	if len(fragments) == 1 && fragments[0].Offset == 0 && fragments[0].Length == size {
+		return nil, nil
+	}
+	if len(fragments) == 0 || fragments[len(fragments)-1].Offset+fragments[len(fragments)-1].Length != size {
+		fragments = append(fragments, sparseEntry{Offset: size, Length: 0})
+	}
+	return fragments, nil
+}
+
+// unwrapPathError returns the underlying error of an *os.PathError.
+func unwrapPathError(err error) error {
+	if perr, ok := err.(*os.PathError); ok {
+		return perr.Err
+	}
+	return err
+}
+
+// writeSparseFile writes the given header and the data fragments of fh to w,
+// using the PAX format for sparse files (GNU sparse format 1.0). This is
+// understood by GNU tar, libarchive and the Go archive/tar reader. The header
+// must already have been mapped and normalised. archive/tar doesn't allow
+// writing sparse files, so the entry is generated manually (w must be at a
+// tar entry boundary).
+func writeSparseFile(w io.Writer, hdr *tar.Header, fh *os.File, fragments []sparseEntry) error {
+	// Encode the sparse map, which is stored at the start of the entry's
+	// contents (padded to a block).
+	var sparseData bytes.Buffer
+	fmt.Fprintf(&sparseData, "%d\n", len(fragments))
+	var dataSize int64
+	for _, fragment := range fragments {
+		fmt.Fprintf(&sparseData, "%d\n%d\n", fragment.Offset, fragment.Length)
+		dataSize += fragment.Length
+	}
+	sparseData.Write(make([]byte, tarPadding(int64(sparseData.Len()))))
+	storedSize := int64(sparseData.Len()) + dataSize
+
+	records := map[string]string{
+		"GNU.sparse.major":    "1",
+		"GNU.sparse.minor":    "0",
+		"GNU.sparse.name":     hdr.Name,
+		"GNU.sparse.realsize": strconv.FormatInt(hdr.Size, 10),
+	}
+	for name, value := range hdr.Xattrs {
+		records["SCHILY.xattr."+name] = value
+	}
+
+	dir, file := path.Split(hdr.Name)
+	sparseHdr := *hdr
+	sparseHdr.Name = path.Join(dir, "GNUSparseFile.0", file)
+	sparseHdr.Size = storedSize
+	block, overflow := formatUstarHeader(&sparseHdr)
+	for key, value := range overflow {
+		records[key] = value
+	}
+
+	// The PAX extended header applies to the entry that follows it.
+	paxData := formatPAXRecords(records)
+	paxBlock, _ := formatUstarHeader(&tar.Header{
+		Name:     path.Join(dir, "PaxHeaders.0", file),
+		Mode:     0644,
+		Size:     int64(len(paxData)),
+		ModTime:  hdr.ModTime,
+		Typeflag: tar.TypeXHeader,
+	})
+	for _, data := range [][]byte{paxBlock, paxData, make([]byte, tarPadding(int64(len(paxData)))), block, sparseData.Bytes()} {
+		if _, err := w.Write(data); err != nil {
+			return errors.Wrap(err, "write sparse header")
+		}
+	}
+
+	for _, fragment := range fragments {
+		n, err := io.Copy(w, io.NewSectionReader(fh, fragment.Offset, fragment.Length))
+		if err != nil {
+			return errors.Wrap(err, "copy sparse fragment")
+		}
+		if n != fragment.Length {
+			return errors.Wrap(io.ErrShortWrite, "copy sparse fragment")
+		}
+	}
+	if _, err := w.Write(make([]byte, tarPadding(storedSize))); err != nil {
+		return errors.Wrap(err, "write sparse padding")
+	}
+	return nil
+}
+
+// tarPadding returns the number of bytes needed to pad size to a tar block.
+func tarPadding(size int64) int64 {
+	return -size & (tarBlockSize - 1)
+}
+
+// formatPAXRecords encodes a set of PAX records (sorted by key, so that the
+// output is reproducible).
+func formatPAXRecords(records map[string]string) []byte {
+	var keys []string
+	for key := range records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	for _, key := range keys {
+		// The length of a record includes the length field itself.
+		record := " " + key + "=" + records[key] + "\n"
+		size := len(record)
+		for size < len(strconv.Itoa(size))+len(record) {
+			size = len(strconv.Itoa(size)) + len(record)
+		}
+		buf.WriteString(strconv.Itoa(size) + record)
+	}
+	return buf.Bytes()
+}
+
+// formatUstarHeader encodes the given header as a ustar header block. Any
+// numeric fields or names that don't fit in the ustar header are returned as
+// PAX records (and are truncated or zeroed in the block).
+func formatUstarHeader(hdr *tar.Header) ([]byte, map[string]string) {
+	block := make([]byte, tarBlockSize)
+	overflow := map[string]string{}
+
+	putString := func(field []byte, value, key string) {
+		if len(value) > len(field) || !isASCII(value) {
+			overflow[key] = value
+		}
+		copy(field, value)
+	}
+	putOctal := func(field []byte, value int64, key string) {
+		str := strconv.FormatInt(value, 8)
+		if value < 0 || len(str) > len(field)-1 {
+			overflow[key] = strconv.FormatInt(value, 10)
+			str = "0"
+		}
+		copy(field, strings.Repeat("0", len(field)-1-len(str))+str)
+	}
+
+	name, prefix := hdr.Name, ""
+	if len(name) > 100 {
+		// Try to split the name into the prefix and name fields.
+		for idx := len(name) - 1; idx > 0; idx-- {
+			if name[idx] == '/' && idx <= 155 && len(name)-idx-1 <= 100 {
+				name, prefix = name[idx+1:], name[:idx]
+				break
+			}
+		}
+	}
+	putString(block[0:100], name, "path")
+	putOctal(block[100:108], hdr.Mode&07777, "mode")
+	putOctal(block[108:116], int64(hdr.Uid), "uid")
+	putOctal(block[116:124], int64(hdr.Gid), "gid")
+	putOctal(block[124:136], hdr.Size, "size")
+	putOctal(block[136:148], hdr.ModTime.Unix(), "mtime")
+	block[156] = hdr.Typeflag
+	putString(block[157:257], hdr.Linkname, "linkpath")
+	copy(block[257:265], "ustar\x0000")
+	putString(block[265:297], hdr.Uname, "uname")
+	putString(block[297:329], hdr.Gname, "gname")
+	putOctal(block[329:337], hdr.Devmajor, "devmajor")
+	putOctal(block[337:345], hdr.Devminor, "devminor")
+	copy(block[345:500], prefix)
+	if _, ok := overflow["path"]; ok {
+		overflow["path"] = hdr.Name
+	}
+	// Device numbers cannot be stored in PAX records.
+	delete(overflow, "devmajor")
+	delete(overflow, "devminor")
+
+	// The checksum is computed with the checksum field set to spaces.
+	copy(block[148:156], "        ")
+	var checksum int64
+	for _, b := range block {
+		checksum += int64(b)
+	}
+	copy(block[148:156], fmt.Sprintf("%06o\x00 ", checksum))
+	return block, overflow
+}
+
+// isASCII returns whether the given string only contains ASCII characters.
+func isASCII(s string) bool {
+	for _, c := range s {
+		if c >= 0x80 || c == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// isZero returns whether the given buffer only contains zeros.
+func isZero(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// copySparse copies r to fh (which must be empty), seeking over blocks of
+// zeros rather than writing them so that holes are recreated in the file. It
+// should only be used for entries which were sparse in the layer (see
+// isSparseHeader). The number of bytes read from r is returned.
+func copySparse(fh *os.File, r io.Reader) (int64, error) {
+	buf := make([]byte, sparseCopyBufferSize)
+	var total int64
+	var hole bool
+	for {
+		n, err := io.ReadFull(r, buf)
+		for start := 0; start < n; {
+			// Find the next run of data or zero blocks.
+			end := start
+			zero := isZero(buf[start:minInt(start+sparseBlockSize, n)])
+			for end < n {
+				next := minInt(end+sparseBlockSize, n)
+				if isZero(buf[end:next]) != zero {
+					break
+				}
+				end = next
+			}
+
+			if zero {
+				if _, err := fh.Seek(int64(end-start), io.SeekCurrent); err != nil {
+					return total, errors.Wrap(err, "seek over hole")
+				}
+			} else if _, err := fh.Write(buf[start:end]); err != nil {
+				return total, errors.Wrap(err, "write data")
+			}
+			hole = zero
+			total += int64(end - start)
+			start = end
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+
+	// Seeking past the end of the file doesn't change its size.
+	if hole {
+		if err := fh.Truncate(total); err != nil {
+			return total, errors.Wrap(err, "truncate to size")
+		}
+	}
+	return total, nil
+}
+
+// minInt returns the smaller of two ints.
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
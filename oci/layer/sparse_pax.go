@@ -0,0 +1,42 @@
+//go:build go1.10
+// +build go1.10
+
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+)
+
+// sparseHeadersSupported is whether isSparseHeader can detect entries which
+// were stored using the PAX sparse formats.
+const sparseHeadersSupported = true
+
+// isSparseHeader returns whether the entry with the given header was stored as
+// a sparse file in the layer, either in the old GNU format or in one of the
+// PAX sparse formats (archive/tar keeps the GNU.sparse.* records of the
+// latter, even though it expands the holes for us).
+func isSparseHeader(hdr *tar.Header) bool {
+	if hdr.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	_, major := hdr.PAXRecords["GNU.sparse.major"]
+	_, sparseMap := hdr.PAXRecords["GNU.sparse.map"]
+	return major || sparseMap
+}
@@ -0,0 +1,37 @@
+//go:build !go1.10
+// +build !go1.10
+
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+)
+
+// sparseHeadersSupported is whether isSparseHeader can detect entries which
+// were stored using the PAX sparse formats.
+const sparseHeadersSupported = false
+
+// isSparseHeader returns whether the entry with the given header was stored as
+// a sparse file in the layer. Before Go 1.10, archive/tar doesn't give us the
+// PAX records of an entry, so only the old GNU format can be detected and
+// files stored with the PAX sparse formats are extracted densely.
+func isSparseHeader(hdr *tar.Header) bool {
+	return hdr.Typeflag == tar.TypeGNUSparse
+}
@@ -0,0 +1,264 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+const testSparseSize = 16 << 20
+
+// makeSparseFile creates a file with two data fragments and a trailing hole,
+// and returns its contents. The test is skipped if the filesystem doesn't
+// support holes.
+func makeSparseFile(t *testing.T, path string) []byte {
+	expected := make([]byte, testSparseSize)
+	fh, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	for _, offset := range []int64{1 << 20, 8 << 20} {
+		data := bytes.Repeat([]byte("sparse data\n"), 1000)
+		copy(expected[offset:], data)
+		if _, err := fh.WriteAt(data, offset); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fh.Truncate(testSparseSize); err != nil {
+		t.Fatal(err)
+	}
+	if allocatedSize(t, path) >= testSparseSize/2 {
+		t.Skip("filesystem doesn't support sparse files")
+	}
+	return expected
+}
+
+// allocatedSize returns the number of bytes allocated for the given file.
+func allocatedSize(t *testing.T, path string) int64 {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Sys().(*syscall.Stat_t).Blocks * 512
+}
+
+func TestSparseMap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestSparseMap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "sparse")
+	makeSparseFile(t, path)
+
+	fh, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+
+	fragments, err := sparseMap(fh, testSparseSize)
+	if err != nil {
+		t.Fatalf("unexpected error getting sparse map: %+v", err)
+	}
+	if len(fragments) < 3 {
+		t.Fatalf("expected at least 3 fragments, got %v", fragments)
+	}
+	// The filesystem may allocate more than we wrote, but the data has to be
+	// covered and the map has to end with an empty fragment.
+	for _, offset := range []int64{1 << 20, 8 << 20} {
+		found := false
+		for _, fragment := range fragments {
+			if fragment.Offset <= offset && offset < fragment.Offset+fragment.Length {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("data at %d not covered by sparse map %v", offset, fragments)
+		}
+	}
+	if last := fragments[len(fragments)-1]; !reflect.DeepEqual(last, sparseEntry{Offset: testSparseSize, Length: 0}) {
+		t.Errorf("expected trailing empty fragment, got %v", last)
+	}
+
+	// A file without holes has no sparse map.
+	densePath := filepath.Join(dir, "dense")
+	if err := ioutil.WriteFile(densePath, []byte("dense data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dense, err := os.Open(densePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dense.Close()
+	if fragments, err := sparseMap(dense, 10); err != nil || fragments != nil {
+		t.Errorf("expected no sparse map for dense file, got %v %v", fragments, err)
+	}
+}
+
+func TestSparseRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestSparseRoundTrip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "sparse")
+	expected := makeSparseFile(t, path)
+	for _, name := range []string{"dense1", "dense2"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("dense data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Generate an archive with a dense file on either side of the sparse file.
+	var archive bytes.Buffer
+	tg := newTarGenerator(&archive, MapOptions{})
+	for _, name := range []string{"dense1", "sparse", "dense2"} {
+		if err := tg.AddFile(name, filepath.Join(dir, name)); err != nil {
+			t.Fatalf("unexpected error adding %s: %+v", name, err)
+		}
+	}
+	if err := tg.tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if archive.Len() >= testSparseSize/2 {
+		t.Errorf("sparse file was stored densely: archive is %d bytes", archive.Len())
+	}
+
+	// The archive must be readable by archive/tar.
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(archive.Bytes()))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error reading archive: %+v", err)
+		}
+		names = append(names, hdr.Name)
+		contents, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("unexpected error reading %s: %+v", hdr.Name, err)
+		}
+		if hdr.Name == "sparse" && !bytes.Equal(contents, expected) {
+			t.Errorf("sparse file contents don't match")
+		}
+	}
+	if !reflect.DeepEqual(names, []string{"dense1", "sparse", "dense2"}) {
+		t.Errorf("unexpected archive entries: %v", names)
+	}
+
+	// Extracting the archive has to recreate the holes.
+	root := filepath.Join(dir, "root")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := UnpackLayer(root, bytes.NewReader(archive.Bytes()), nil); err != nil {
+		t.Fatalf("unexpected error unpacking archive: %+v", err)
+	}
+	contents, err := ioutil.ReadFile(filepath.Join(root, "sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(contents, expected) {
+		t.Errorf("extracted sparse file contents don't match")
+	}
+	if size := allocatedSize(t, filepath.Join(root, "sparse")); sparseHeadersSupported && size >= testSparseSize/2 {
+		t.Errorf("extracted sparse file is not sparse: %d bytes allocated", size)
+	}
+}
+
+// TestUnpackDenseZeros makes sure that files which were stored densely in a
+// layer are not made sparse when they are extracted, even if they contain
+// blocks of zeros.
+func TestUnpackDenseZeros(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackDenseZeros")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Make sure the filesystem supports holes at all.
+	makeSparseFile(t, filepath.Join(dir, "sparse"))
+
+	contents := make([]byte, testSparseSize)
+	copy(contents[testSparseSize-100:], "trailing data")
+
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     "dense",
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     int64(len(contents)),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(contents); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	root := filepath.Join(dir, "root")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := UnpackLayer(root, &archive, nil); err != nil {
+		t.Fatalf("unexpected error unpacking archive: %+v", err)
+	}
+	path := filepath.Join(root, "dense")
+	if got, err := ioutil.ReadFile(path); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(got, contents) {
+		t.Errorf("extracted dense file contents don't match")
+	}
+	if size := allocatedSize(t, path); size < testSparseSize {
+		t.Errorf("extracted dense file is sparse: %d bytes allocated", size)
+	}
+
+	// Generating a layer from the extracted file must store it densely.
+	var layer bytes.Buffer
+	tg := newTarGenerator(&layer, MapOptions{})
+	if err := tg.AddFile("dense", path); err != nil {
+		t.Fatalf("unexpected error adding file: %+v", err)
+	}
+	if err := tg.tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	hdr, err := tar.NewReader(&layer).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isSparseHeader(hdr) {
+		t.Errorf("dense file was stored as a sparse file")
+	}
+}
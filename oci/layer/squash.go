@@ -0,0 +1,60 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package layer
+
+import (
+	"io"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// SquashOptions are the options used by SquashLayers.
+type SquashOptions struct {
+	// KeepWhiteouts specifies whether the whiteouts in the layers are kept
+	// in the squashed layer, so that the paths they remove are still hidden
+	// in the layers below it. This must be set unless the squashed layers are
+	// the lowest layers of an image, in which case whiteouts have no effect.
+	KeepWhiteouts bool
+}
+
+// SquashLayers writes a single layer to w which is equivalent to the given
+// layers (which have the given DiffIDs, and are given from the lowest layer
+// up) being applied in order. Only the entries of the merged filesystem are
+// included, so paths which were overwritten or removed by a later layer don't
+// take up any space. Like ExportManifest, the layers are merged as they are
+// read and nothing is written to disk, so the entries in the squashed layer
+// are not ordered by path.
+func SquashLayers(ctx context.Context, engine cas.Engine, w io.Writer, layers []ispec.Descriptor, diffIDs []string, opt *SquashOptions) error {
+	engineExt := casext.Engine{engine}
+
+	var squashOptions SquashOptions
+	if opt != nil {
+		squashOptions = *opt
+	}
+
+	if len(layers) != len(diffIDs) {
+		return errors.Wrapf(ErrLayerCountMismatch, "squash layers: got %d layers but %d diffids", len(layers), len(diffIDs))
+	}
+
+	tf := newTarFlattener(w, UnpackOptions{})
+	tf.keepWhiteouts = squashOptions.KeepWhiteouts
+	return errors.Wrap(flattenLayers(ctx, engineExt, tf, layers, diffIDs), "squash layers")
+}
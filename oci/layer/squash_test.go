@@ -0,0 +1,131 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/drivers/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	"golang.org/x/net/context"
+)
+
+func TestSquashLayers(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestSquashLayers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+
+	reg := func(name, contents string) testLayerEntry {
+		return testLayerEntry{
+			hdr:      tar.Header{Name: name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(contents))},
+			contents: contents,
+		}
+	}
+	dirEntry := func(name string) testLayerEntry {
+		return testLayerEntry{hdr: tar.Header{Name: name, Mode: 0755, Typeflag: tar.TypeDir}}
+	}
+
+	manifest := makeTestImageEntries(t, engine, [][]testLayerEntry{
+		{
+			dirEntry("dir/"), reg("dir/a", "a0"), reg("dir/b", "b0"),
+			reg("gone", "g0"), dirEntry("tree/"), reg("tree/x", "x0"),
+			dirEntry("replaced/"), reg("replaced/x", "x0"),
+			dirEntry("opaque/"), reg("opaque/x", "x0"),
+		},
+		{
+			reg("dir/a", "a1"), reg(".wh.gone", ""),
+			reg("opaque/.wh..wh..opq", ""), reg("opaque/y", "y1"),
+			reg(".wh.tree", ""), dirEntry("tree/"), reg("tree/y", "y1"),
+		},
+		{
+			reg("dir/.wh.b", ""), reg("dir/c", "c2"), reg("opaque/y", "y2"),
+			reg("replaced/y", "y2"), reg(".wh.replaced", ""),
+		},
+	})
+	config, err := unpackConfig(context.Background(), casext.Engine{engine}, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name          string
+		start         int
+		keepWhiteouts bool
+		expected      map[string]testTarEntry
+	}{
+		// Squashing all of the layers results in the merged filesystem,
+		// without any whiteouts.
+		{"All", 0, false, map[string]testTarEntry{
+			"dir/":       {typeflag: tar.TypeDir},
+			"dir/a":      {typeflag: tar.TypeReg, contents: "a1"},
+			"dir/c":      {typeflag: tar.TypeReg, contents: "c2"},
+			"opaque/":    {typeflag: tar.TypeDir},
+			"opaque/y":   {typeflag: tar.TypeReg, contents: "y2"},
+			"tree/":      {typeflag: tar.TypeDir},
+			"tree/y":     {typeflag: tar.TypeReg, contents: "y1"},
+			"replaced/y": {typeflag: tar.TypeReg, contents: "y2"},
+		}},
+		// Squashing the upper layers has to keep the whiteouts. A whiteout
+		// of a directory which has already been written becomes opaque, so
+		// that it doesn't remove the directory's new contents.
+		{"Upper", 1, true, map[string]testTarEntry{
+			"dir/a":                 {typeflag: tar.TypeReg, contents: "a1"},
+			"dir/c":                 {typeflag: tar.TypeReg, contents: "c2"},
+			"dir/.wh.b":             {typeflag: tar.TypeReg},
+			".wh.gone":              {typeflag: tar.TypeReg},
+			"opaque/.wh..wh..opq":   {typeflag: tar.TypeReg},
+			"opaque/y":              {typeflag: tar.TypeReg, contents: "y2"},
+			".wh.tree":              {typeflag: tar.TypeReg},
+			"tree/":                 {typeflag: tar.TypeDir},
+			"tree/y":                {typeflag: tar.TypeReg, contents: "y1"},
+			"replaced/.wh..wh..opq": {typeflag: tar.TypeReg},
+			"replaced/y":            {typeflag: tar.TypeReg, contents: "y2"},
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var buffer bytes.Buffer
+			if err := SquashLayers(context.Background(), engine, &buffer, manifest.Layers[test.start:], config.RootFS.DiffIDs[test.start:], &SquashOptions{
+				KeepWhiteouts: test.keepWhiteouts,
+			}); err != nil {
+				t.Fatalf("unexpected error squashing layers: %+v", err)
+			}
+			checkTestLayer(t, &buffer, test.expected)
+		})
+	}
+
+	// The number of DiffIDs has to match.
+	if err := SquashLayers(context.Background(), engine, ioutil.Discard, manifest.Layers, config.RootFS.DiffIDs[1:], nil); err == nil {
+		t.Errorf("expected an error with mismatched diffids")
+	}
+}
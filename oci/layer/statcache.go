@@ -0,0 +1,218 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package layer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci"
+	"github.com/pkg/errors"
+	"github.com/vbatts/go-mtree"
+)
+
+// StatCache records the stat(2) data of the regular files in a root
+// filesystem, so that QuickCheck can tell which files might have been modified
+// without reading their contents.
+type StatCache struct {
+	// Time is when the stat data was recorded. Files which were changed less
+	// than a second before Time are always treated as modified, because a
+	// later change within the timestamp granularity of the filesystem might
+	// not have changed their stat data.
+	Time time.Time `json:"time"`
+
+	// Files contains the stat data of each regular file, keyed by its path
+	// relative to the root filesystem (in the same form as the paths in an
+	// mtree manifest).
+	Files map[string]StatCacheEntry `json:"files"`
+}
+
+// StatCacheEntry is the stat(2) data of a single regular file. If any of it
+// has changed, the contents of the file might have changed as well.
+type StatCacheEntry struct {
+	Inode uint64 `json:"ino"`
+	Size  int64  `json:"size"`
+
+	// Mtime and Ctime are in nanoseconds since the epoch.
+	Mtime int64 `json:"mtime"`
+	Ctime int64 `json:"ctime"`
+}
+
+// GenerateStatCache records the stat(2) data of every regular file inside
+// root. It must be called before the mtree manifest of root is generated, so
+// that any changes made while the manifest is being generated are noticed by
+// QuickCheck.
+func GenerateStatCache(root string, fsEval umoci.FsEval) (*StatCache, error) {
+	cache := &StatCache{
+		Time:  time.Now(),
+		Files: map[string]StatCacheEntry{},
+	}
+	if err := cache.addTree(fsEval, root, "."); err != nil {
+		return nil, err
+	}
+	return cache, nil
+}
+
+// addTree adds the regular files inside the directory root/name to the cache.
+func (sc *StatCache) addTree(fsEval umoci.FsEval, root, name string) error {
+	infos, err := fsEval.Readdir(filepath.Join(root, name))
+	if err != nil {
+		return errors.Wrapf(err, "readdir %s", name)
+	}
+	for _, info := range infos {
+		path := filepath.Join(name, info.Name())
+		switch {
+		case info.IsDir():
+			if err := sc.addTree(fsEval, root, path); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			entry, err := statCacheEntry(info)
+			if err != nil {
+				return errors.Wrapf(err, "stat %s", path)
+			}
+			sc.Files[path] = entry
+		}
+	}
+	return nil
+}
+
+// unchanged returns whether the file at the given path (with the given stat
+// data) certainly hasn't been modified since the cache was generated.
+func (sc *StatCache) unchanged(path string, info os.FileInfo) bool {
+	cached, ok := sc.Files[path]
+	if !ok {
+		return false
+	}
+	entry, err := statCacheEntry(info)
+	if err != nil || entry != cached {
+		return false
+	}
+	racy := sc.Time.Truncate(time.Second).UnixNano()
+	return entry.Mtime < racy && entry.Ctime < racy
+}
+
+// sha256Keyword is the mtree keyword which QuickCheck avoids computing.
+const sha256Keyword mtree.Keyword = "sha256digest"
+
+// QuickCheck is equivalent to mtree.Check, except that files whose stat(2)
+// data hasn't changed since cache was generated are not read. Instead, their
+// digests are taken from spec. If cache is nil (or sha256digest isn't one of
+// the keywords), this is the same as mtree.Check.
+func QuickCheck(root string, spec *mtree.DirectoryHierarchy, keywords []mtree.Keyword, cache *StatCache, fsEval umoci.FsEval) ([]mtree.InodeDelta, error) {
+	newSpec, err := QuickWalk(root, spec, keywords, cache, fsEval)
+	if err != nil {
+		return nil, err
+	}
+	return mtree.Compare(spec, newSpec, keywords)
+}
+
+// QuickWalk is equivalent to mtree.Walk, except that files whose stat(2) data
+// hasn't changed since cache was generated are not read. Instead, their
+// digests are taken from spec (which must be the manifest that cache was
+// generated for). If cache is nil (or sha256digest isn't one of the
+// keywords), this is the same as mtree.Walk.
+func QuickWalk(root string, spec *mtree.DirectoryHierarchy, keywords []mtree.Keyword, cache *StatCache, fsEval umoci.FsEval) (*mtree.DirectoryHierarchy, error) {
+	if cache == nil || !mtree.InKeywordSlice(sha256Keyword, keywords) {
+		return mtree.Walk(root, nil, keywords, fsEval)
+	}
+
+	var walkKeywords []mtree.Keyword
+	for _, keyword := range keywords {
+		if keyword != sha256Keyword {
+			walkKeywords = append(walkKeywords, keyword)
+		}
+	}
+	newSpec, err := mtree.Walk(root, nil, walkKeywords, fsEval)
+	if err != nil {
+		return nil, errors.Wrap(err, "walk rootfs")
+	}
+
+	oldDigests := map[string]mtree.KeyVal{}
+	for _, entry := range spec.Entries {
+		if entry.Type != mtree.RelativeType && entry.Type != mtree.FullType {
+			continue
+		}
+		path, err := entry.Path()
+		if err != nil {
+			return nil, errors.Wrap(err, "get old entry path")
+		}
+		if digest := mtree.HasKeyword(entry.AllKeys(), sha256Keyword); digest != "" {
+			oldDigests[path] = digest
+		}
+	}
+
+	// Fill in the digests of the new manifest, only hashing the files which
+	// might have changed. The keywords comment has to be fixed up as well, so
+	// that the manifest is the same as one generated by mtree.Walk.
+	var hashed int
+	hashFunc := fsEval.KeywordFunc(mtree.KeywordFuncs[sha256Keyword])
+	for idx := range newSpec.Entries {
+		entry := &newSpec.Entries[idx]
+		if entry.Type == mtree.CommentType && entry.Raw == keywordsComment(walkKeywords) {
+			entry.Raw = keywordsComment(keywords)
+			continue
+		}
+		if entry.Type != mtree.RelativeType && entry.Type != mtree.FullType {
+			continue
+		}
+		path, err := entry.Path()
+		if err != nil {
+			return nil, errors.Wrap(err, "get new entry path")
+		}
+		fullPath := filepath.Join(root, path)
+		info, err := fsEval.Lstat(fullPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "lstat")
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+
+		digest, ok := oldDigests[path]
+		if !ok || !cache.unchanged(path, info) {
+			digest, err = hashFile(hashFunc, fsEval, fullPath, info)
+			if err != nil {
+				return nil, errors.Wrapf(err, "hash %s", path)
+			}
+			hashed++
+		}
+		entry.Keywords = append(entry.Keywords, digest)
+	}
+	log.Debugf("quick check: hashed %d files", hashed)
+	return newSpec, nil
+}
+
+// keywordsComment returns the comment listing the keywords of a manifest, in
+// the same format as mtree.Walk.
+func keywordsComment(keywords []mtree.Keyword) string {
+	return fmt.Sprintf("#%16s%s", "keywords: ", strings.Join(mtree.FromKeywords(keywords), ","))
+}
+
+// hashFile computes the sha256digest keyword of the given regular file.
+func hashFile(hashFunc mtree.KeywordFunc, fsEval umoci.FsEval, path string, info os.FileInfo) (mtree.KeyVal, error) {
+	fh, err := fsEval.Open(path)
+	if err != nil {
+		return "", errors.Wrap(err, "open")
+	}
+	defer fh.Close()
+	return hashFunc(path, info, fh)
+}
@@ -0,0 +1,221 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package layer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/openSUSE/umoci"
+	"github.com/vbatts/go-mtree"
+)
+
+// deltaPaths returns the sorted paths of the given deltas.
+func deltaPaths(deltas []mtree.InodeDelta) []string {
+	var paths []string
+	for _, delta := range deltas {
+		paths = append(paths, delta.Path())
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func TestQuickCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestQuickCheck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, file := range []string{"unchanged", "changed", "sneaky", "deleted", "dir/nested"} {
+		path := filepath.Join(dir, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte("contents of "+file), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keywords := append(mtree.DefaultKeywords, "sha256digest")
+	fsEval := umoci.DefaultFsEval
+
+	cache, err := GenerateStatCache(dir, fsEval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec, err := mtree.Walk(dir, nil, keywords, fsEval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"unchanged", "changed", "sneaky", "deleted", "dir/nested"} {
+		if _, ok := cache.Files[file]; !ok {
+			t.Errorf("missing stat cache entry for %s", file)
+		}
+	}
+	if _, ok := cache.Files["dir"]; ok {
+		t.Errorf("unexpected stat cache entry for directory")
+	}
+
+	// Pretend the cache was generated a while after the files were last
+	// changed, so that they aren't racy.
+	cache.Time = time.Now().Add(2 * time.Second)
+
+	// Modify the rootfs without changing any sizes.
+	if err := ioutil.WriteFile(filepath.Join(dir, "changed"), []byte("contents of CHANGE"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "deleted")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "dir", "added"), []byte("added"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	expected, err := mtree.Check(dir, spec, keywords, fsEval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := QuickCheck(dir, spec, keywords, cache, fsEval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expectedPaths, gotPaths := deltaPaths(expected), deltaPaths(got); len(expectedPaths) == 0 || !reflect.DeepEqual(expectedPaths, gotPaths) {
+		t.Errorf("unexpected quick check diff: expected %v, got %v", expectedPaths, gotPaths)
+	}
+
+	// If the stat data of a file matches the cache, its contents are
+	// trusted (even though they have been changed behind our back here).
+	sneakyPath := filepath.Join(dir, "sneaky")
+	sneakyInfo, err := os.Lstat(sneakyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(sneakyPath, []byte("contents of SNEAKY"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(sneakyPath, sneakyInfo.ModTime(), sneakyInfo.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	sneakyCache, err := GenerateStatCache(dir, fsEval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sneakyCache.Time = time.Now().Add(2 * time.Second)
+
+	got, err = QuickCheck(dir, spec, keywords, sneakyCache, fsEval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range deltaPaths(got) {
+		if path == "sneaky" {
+			t.Errorf("expected sneaky to be trusted with a matching stat cache")
+		}
+	}
+
+	// ... but not if the file was changed too close to when the cache was
+	// generated, or if there is no cache.
+	sneakyCache.Time = time.Now()
+	for _, cache := range []*StatCache{sneakyCache, nil} {
+		got, err = QuickCheck(dir, spec, keywords, cache, fsEval)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for _, path := range deltaPaths(got) {
+			if path == "sneaky" {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("expected sneaky to be re-hashed (cache=%v)", cache != nil)
+		}
+	}
+}
+
+// specLines returns the lines of the given manifest, without the comments
+// which differ between walks (such as the date).
+func specLines(t *testing.T, spec *mtree.DirectoryHierarchy) []string {
+	var buf bytes.Buffer
+	if _, err := spec.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(line, "#") && !strings.Contains(line, "keywords:") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestQuickWalk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestQuickWalk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, file := range []string{"a", "b", "dir/c"} {
+		path := filepath.Join(dir, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte("contents of "+file), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keywords := append(mtree.DefaultKeywords, "sha256digest")
+	fsEval := umoci.DefaultFsEval
+
+	cache, err := GenerateStatCache(dir, fsEval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Time = time.Now().Add(2 * time.Second)
+	spec, err := mtree.Walk(dir, nil, keywords, fsEval)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "b"), []byte("new contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The manifest must be the same as a full walk, so that it can be used as
+	// the manifest of a bundle.
+	expected, err := mtree.Walk(dir, nil, keywords, fsEval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := QuickWalk(dir, spec, keywords, cache, fsEval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expectedLines, gotLines := specLines(t, expected), specLines(t, got); !reflect.DeepEqual(expectedLines, gotLines) {
+		t.Errorf("unexpected quick walk manifest:\nexpected %q\ngot      %q", expectedLines, gotLines)
+	}
+}
@@ -39,6 +39,36 @@ type tarExtractor struct {
 
 	// fsEval is an umoci.FsEval used for extraction.
 	fsEval umoci.FsEval
+
+	// overlay indicates that the layer is being extracted into its own
+	// overlayfs layer directory, so whiteouts are converted to overlayfs
+	// whiteouts rather than removing paths.
+	overlay bool
+
+	// lowerDirs are the overlayfs layer directories of the previous layers,
+	// topmost first. They are used to copy up the targets of hardlinks.
+	lowerDirs []string
+
+	// overlayXattrs are the overlayfs xattrs to set on each path once the
+	// layer has been extracted. They have to be set last, because restoring
+	// the metadata of a directory (or its parent) clears its xattrs.
+	overlayXattrs map[string][]string
+
+	// filters restricts the set of paths which are extracted.
+	filters PathFilters
+
+	// xattrs restricts the set of xattrs which are applied.
+	xattrs XattrFilter
+
+	// upperPaths is the set of paths (and their parent directories) which
+	// have been extracted from the current layer. Opaque whiteouts only
+	// remove paths from lower layers, so these are kept.
+	upperPaths map[string]struct{}
+
+	// limits restricts what the layer may contain, and usage keeps track of
+	// the totals used by all of the layers being unpacked.
+	limits UnpackLimits
+	usage  *unpackUsage
 }
 
 // newTarExtractor creates a new tarExtractor.
@@ -51,6 +81,8 @@ func newTarExtractor(opt MapOptions) *tarExtractor {
 	return &tarExtractor{
 		mapOptions: opt,
 		fsEval:     fsEval,
+		upperPaths: make(map[string]struct{}),
+		usage:      &unpackUsage{},
 	}
 }
 
@@ -100,11 +132,15 @@ func (te *tarExtractor) restoreMetadata(path string, hdr *tar.Header) error {
 
 	// Apply xattrs. In order to make sure that we *only* have the xattr set we
 	// want, we first clear the set of xattrs from the file then apply the ones
-	// set in the tar.Header.
+	// set in the tar.Header (which pass the xattr filters).
 	if err := te.fsEval.Lclearxattrs(path); err != nil {
 		return errors.Wrapf(err, "clear xattr metadata: %s", path)
 	}
 	for name, value := range hdr.Xattrs {
+		if !te.xattrs.Allowed(name) {
+			log.Debugf("restoreMetadata: skipping filtered xattr: %s", name)
+			continue
+		}
 		if err := te.fsEval.Lsetxattr(path, name, []byte(value), 0); err != nil {
 			// In rootless mode, some xattrs will fail (security.capability).
 			// This is _fine_ as long as we're not running as root (in which
@@ -148,6 +184,29 @@ func (te *tarExtractor) unpackEntry(root string, hdr *tar.Header, r io.Reader) (
 	hdr.Name = CleanPath(hdr.Name)
 	root = filepath.Clean(root)
 
+	// Skip entries which don't pass the path filters. Hardlinks to paths which
+	// were skipped cannot be created, so they have to be skipped as well.
+	if !te.filters.Allowed(whiteoutTarget(hdr.Name)) {
+		log.Debugf("unpack entry: skipping filtered path: %s", hdr.Name)
+		return nil
+	}
+	if hdr.Typeflag == tar.TypeLink && !te.filters.Allowed(CleanPath(hdr.Linkname)) {
+		log.Warnf("unpack entry: skipping hardlink to filtered path: %s -> %s", hdr.Name, hdr.Linkname)
+		return nil
+	}
+
+	// Drop the xattrs which don't pass the xattr filters before anything else
+	// looks at them, so that they are neither limited nor id-mapped.
+	for name := range hdr.Xattrs {
+		if !te.xattrs.Allowed(name) {
+			log.Debugf("unpack entry: skipping filtered xattr: %s: %s", hdr.Name, name)
+			delete(hdr.Xattrs, name)
+		}
+	}
+	if err := te.checkLimits(hdr); err != nil {
+		return err
+	}
+
 	log.WithFields(log.Fields{
 		"root": root,
 		"path": hdr.Name,
@@ -207,6 +266,13 @@ func (te *tarExtractor) unpackEntry(root string, hdr *tar.Header, r io.Reader) (
 	// Typeflag, expecting that the path is the only thing that matters in a
 	// whiteout entry.
 	if strings.HasPrefix(file, whPrefix) {
+		if te.overlay {
+			return errors.Wrap(te.overlayWhiteout(dir, file), "overlay whiteout")
+		}
+		if file == whOpaque {
+			return errors.Wrap(te.opaqueWhiteout(root, dir), "opaque whiteout")
+		}
+
 		file = strings.TrimPrefix(file, whPrefix)
 		path = filepath.Join(dir, file)
 
@@ -224,6 +290,12 @@ func (te *tarExtractor) unpackEntry(root string, hdr *tar.Header, r io.Reader) (
 		return nil
 	}
 
+	// Mark the path as being part of this layer, so that opaque whiteouts
+	// (which may come later in the archive) don't remove it.
+	for upper := path; upper != root && strings.HasPrefix(upper, root); upper = filepath.Dir(upper) {
+		te.upperPaths[upper] = struct{}{}
+	}
+
 	// Get information about the path. This has to be done after we've dealt
 	// with whiteouts because it turns out that lstat(2) will return EPERM if
 	// you try to stat a whiteout on AUFS.
@@ -263,7 +335,7 @@ func (te *tarExtractor) unpackEntry(root string, hdr *tar.Header, r io.Reader) (
 	// will fix all of that for us.
 	switch hdr.Typeflag {
 	// regular file
-	case tar.TypeReg, tar.TypeRegA:
+	case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
 		// Truncate file, then just copy the data.
 		fh, err := te.fsEval.Create(path)
 		if err != nil {
@@ -271,10 +343,20 @@ func (te *tarExtractor) unpackEntry(root string, hdr *tar.Header, r io.Reader) (
 		}
 		defer fh.Close()
 
-		// We need to make sure that we copy all of the bytes.
-		if n, err := io.Copy(fh, r); err != nil {
+		// We need to make sure that we copy all of the bytes. If the file was
+		// sparse in the layer, blocks of zeros are recreated as holes. Other
+		// files are written densely, because they might have been stored that
+		// way on purpose (and holes would make the file sparse the next time
+		// it is repacked).
+		var n int64
+		if isSparseHeader(hdr) {
+			n, err = copySparse(fh, r)
+		} else {
+			n, err = io.Copy(fh, r)
+		}
+		if err != nil {
 			return err
-		} else if int64(n) != hdr.Size {
+		} else if n != hdr.Size {
 			return errors.Wrap(io.ErrShortWrite, "unpack to regular file")
 		}
 
@@ -312,6 +394,14 @@ func (te *tarExtractor) unpackEntry(root string, hdr *tar.Header, r io.Reader) (
 				return errors.Wrap(err, "sanitise hardlink target in root")
 			}
 			linkname = filepath.Join(dir, file)
+
+			// With overlayfs layers the target may be in a lower layer, in
+			// which case it has to be copied into this layer.
+			if te.overlay {
+				if err := te.overlayCopyUp(root, linkname); err != nil {
+					return errors.Wrap(err, "copy up hardlink target")
+				}
+			}
 		case tar.TypeSymlink:
 			linkFn = te.fsEval.Symlink
 		}
@@ -386,3 +476,56 @@ out:
 
 	return nil
 }
+
+// opaqueWhiteout applies an opaque whiteout for dir, which removes every path
+// inside dir that came from a lower layer. Paths that have been extracted from
+// the current layer (before the opaque whiteout entry) are kept, as the
+// whiteout only applies to lower layers.
+func (te *tarExtractor) opaqueWhiteout(root, dir string) error {
+	fi, err := te.fsEval.Lstat(dir)
+	if os.IsNotExist(err) {
+		// Nothing to hide.
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "lstat opaque directory")
+	}
+	if !fi.IsDir() {
+		return errors.Errorf("opaque whiteout parent is not a directory: %s", strings.TrimPrefix(dir, root))
+	}
+
+	children, err := te.fsEval.Readdir(dir)
+	if err != nil {
+		return errors.Wrap(err, "readdir opaque directory")
+	}
+	for _, child := range children {
+		path := filepath.Join(dir, child.Name())
+		if _, ok := te.upperPaths[path]; !ok {
+			if err := te.fsEval.RemoveAll(path); err != nil {
+				return errors.Wrap(err, "remove lower path")
+			}
+			continue
+		}
+		// Directories from this layer (or the parents of paths from this
+		// layer) may still contain paths from lower layers.
+		if child.IsDir() {
+			if err := te.opaqueWhiteout(root, path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// whiteoutTarget returns the path affected by the entry with the given name.
+// For whiteouts this is the path being removed (or the directory, for opaque
+// whiteouts), for all other entries it is the name itself.
+func whiteoutTarget(name string) string {
+	dir, file := filepath.Split(name)
+	switch {
+	case file == whOpaque:
+		return filepath.Clean(dir)
+	case strings.HasPrefix(file, whPrefix):
+		return filepath.Join(dir, strings.TrimPrefix(file, whPrefix))
+	}
+	return name
+}
@@ -27,7 +27,9 @@ import (
 	"testing"
 	"time"
 
+	"github.com/openSUSE/umoci/pkg/system"
 	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
 )
 
 // TODO: Test the parent directory metadata is kept the same when unpacking.
@@ -307,6 +309,64 @@ func TestUnpackEntryWhiteout(t *testing.T) {
 	}(t)
 }
 
+// TestUnpackEntryOpaqueWhiteout checks that opaque whiteouts remove the
+// contents of a directory from lower layers, but not the paths from the layer
+// containing the opaque whiteout.
+func TestUnpackEntryOpaqueWhiteout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackEntryOpaqueWhiteout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Create the lower layer contents.
+	for _, path := range []string{"opaque/lower", "opaque/sub/lower", "opaque/lowerdir/file", "other/lower"} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(path)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, path), []byte("lower"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	te := newTarExtractor(MapOptions{})
+	for _, hdr := range []*tar.Header{
+		{Name: "opaque/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "opaque/sub/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "opaque/upper", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "opaque/" + whOpaque, Typeflag: tar.TypeReg},
+		{Name: "opaque/sub/upper", Typeflag: tar.TypeReg, Mode: 0644},
+	} {
+		hdr.Uid = os.Getuid()
+		hdr.Gid = os.Getgid()
+		if err := te.unpackEntry(dir, hdr, bytes.NewBuffer(nil)); err != nil {
+			t.Fatalf("unexpected error in unpackEntry(%s): %s", hdr.Name, err)
+		}
+	}
+
+	for _, test := range []struct {
+		path   string
+		exists bool
+	}{
+		{"opaque", true},
+		{"opaque/upper", true},
+		{"opaque/sub", true},
+		{"opaque/sub/upper", true},
+		{"opaque/lower", false},
+		{"opaque/sub/lower", false},
+		{"opaque/lowerdir", false},
+		{"opaque/" + whOpaque, false},
+		{"other/lower", true},
+	} {
+		_, err := os.Lstat(filepath.Join(dir, test.path))
+		if test.exists && err != nil {
+			t.Errorf("expected %s to exist: %s", test.path, err)
+		} else if !test.exists && !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed: %v", test.path, err)
+		}
+	}
+}
+
 // TestUnpackHardlink makes sure that hardlinks are correctly unpacked in all
 // cases. In particular when it comes to hardlinks to symlinks.
 func TestUnpackHardlink(t *testing.T) {
@@ -618,3 +678,44 @@ func TestUnpackEntryMap(t *testing.T) {
 		}
 	}(t)
 }
+
+// TestUnpackXattrFilter makes sure that only the xattrs which pass the xattr
+// filters are applied when unpacking.
+func TestUnpackXattrFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackXattrFilter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	te := newTarExtractor(MapOptions{})
+	te.xattrs = XattrFilter{Exclude: []string{"user.drop*"}}
+	hdr := &tar.Header{
+		Name:     "file",
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Uid:      os.Getuid(),
+		Gid:      os.Getgid(),
+		Xattrs: map[string]string{
+			"user.keep":    "kept",
+			"user.drop":    "dropped",
+			"user.dropped": "dropped",
+		},
+	}
+	if err := te.unpackEntry(dir, hdr, bytes.NewBuffer(nil)); err != nil {
+		if errors.Cause(err) == syscall.ENOTSUP {
+			t.Skipf("user xattrs not supported: %v", err)
+		}
+		t.Fatalf("unexpected error in unpackEntry(%s): %s", hdr.Name, err)
+	}
+
+	path := filepath.Join(dir, "file")
+	if value, err := system.Lgetxattr(path, "user.keep"); err != nil || string(value) != "kept" {
+		t.Errorf("expected user.keep to be applied: got %q (%v)", value, err)
+	}
+	for _, name := range []string{"user.drop", "user.dropped"} {
+		if value, err := system.Lgetxattr(path, name); err == nil {
+			t.Errorf("expected %s to be filtered: got %q", name, value)
+		}
+	}
+}
@@ -28,24 +28,16 @@ import (
 	"github.com/pkg/errors"
 )
 
-// ignoreXattrList is a list of xattr names that should be ignored when
-// creating a new image layer, because they are host-specific and/or would be a
-// bad idea to unpack.
-// XXX: Maybe we should make this configurable so users can manually blacklist
-//      (or even whitelist) xattrs that they actually want included? Like how
-//      GNU tar's xattr setup works.
-var ignoreXattrList = map[string]struct{}{
-	// SELinux doesn't allow you to set SELinux policies generically. They're
-	// also host-specific. So just ignore them during extraction.
-	"security.selinux": {},
-}
-
 // tarGenerator is a helper for generating layer diff tars. It should be noted
 // that when using tarGenerator.Add{Path,Whiteout} it is recommended to do it
 // in lexicographic order.
 type tarGenerator struct {
 	tw *tar.Writer
 
+	// w is the writer underlying tw, which sparse files are written to
+	// directly (see writeSparseFile).
+	w io.Writer
+
 	// mapOptions is the set of mapping options for modifying entries before
 	// they're added to the layer.
 	mapOptions MapOptions
@@ -56,6 +48,18 @@ type tarGenerator struct {
 	// fsEval is an umoci.FsEval used for extraction.
 	fsEval umoci.FsEval
 
+	// reproducible and clampMtime are the reproducibility options from
+	// RepackOptions (see normaliseHeader).
+	reproducible bool
+	clampMtime   time.Time
+
+	// uid and gid, if not nil, override the owner of every entry (see
+	// InsertOptions).
+	uid, gid *int
+
+	// xattrs restricts the set of xattrs which are included in the layer.
+	xattrs XattrFilter
+
 	// XXX: Should we add a saftey check to make sure we don't generate two of
 	//      the same path in a tar archive? This is not permitted by the spec.
 }
@@ -70,12 +74,73 @@ func newTarGenerator(w io.Writer, opt MapOptions) *tarGenerator {
 
 	return &tarGenerator{
 		tw:         tar.NewWriter(w),
+		w:          w,
 		mapOptions: opt,
 		inodes:     map[uint64]string{},
 		fsEval:     fsEval,
 	}
 }
 
+// normaliseHeader removes the host-specific metadata from a header generated
+// from the filesystem if the tarGenerator is generating a reproducible layer.
+// The mtime is clamped to clampMtime (if set) and truncated to a second, and
+// the atime, ctime and user and group names are dropped, so that the format
+// chosen for each header only depends on the contents of the rootfs.
+func (tg *tarGenerator) normaliseHeader(hdr *tar.Header) {
+	if !tg.reproducible {
+		return
+	}
+	if !tg.clampMtime.IsZero() && hdr.ModTime.After(tg.clampMtime) {
+		hdr.ModTime = tg.clampMtime
+	}
+	hdr.ModTime = hdr.ModTime.Truncate(time.Second)
+	hdr.AccessTime = time.Time{}
+	hdr.ChangeTime = time.Time{}
+	hdr.Uname = ""
+	hdr.Gname = ""
+}
+
+// overrideOwner applies the owner overrides of the tarGenerator (if any) to
+// the given header. The user and group names are dropped, because they would
+// no longer match the owner.
+func (tg *tarGenerator) overrideOwner(hdr *tar.Header) {
+	if tg.uid != nil {
+		hdr.Uid = *tg.uid
+		hdr.Uname = ""
+	}
+	if tg.gid != nil {
+		hdr.Gid = *tg.gid
+		hdr.Gname = ""
+	}
+}
+
+// whiteoutTime returns the timestamp used for whiteouts. For reproducible
+// layers this is clampMtime (or the epoch if it is not set).
+func (tg *tarGenerator) whiteoutTime() time.Time {
+	if !tg.reproducible {
+		return time.Now()
+	}
+	if !tg.clampMtime.IsZero() {
+		return tg.clampMtime.Truncate(time.Second)
+	}
+	return time.Unix(0, 0)
+}
+
+// whiteoutHeader returns the header for a whiteout with the given name.
+func (tg *tarGenerator) whiteoutHeader(name string) *tar.Header {
+	timestamp := tg.whiteoutTime()
+	hdr := &tar.Header{
+		Name:    name,
+		Size:    0,
+		ModTime: timestamp,
+	}
+	if !tg.reproducible {
+		hdr.AccessTime = timestamp
+		hdr.ChangeTime = timestamp
+	}
+	return hdr
+}
+
 // normalise converts the provided pathname to a POSIX-compliant pathname. It also will provide an error if a path looks unsafe.
 func normalise(rawPath string, isDir bool) (string, error) {
 	// Clean up the path.
@@ -157,8 +222,9 @@ func (tg *tarGenerator) AddFile(name, path string) error {
 	for _, name := range names {
 		// Some xattrs need to be skipped for sanity reasons, such as
 		// security.selinux, because they are very much host-specific and
-		// carrying them to other hosts would be a really bad idea.
-		if _, ignore := ignoreXattrList[name]; ignore {
+		// carrying them to other hosts would be a really bad idea. The set of
+		// skipped xattrs is configured with an XattrFilter.
+		if !tg.xattrs.Allowed(name) {
 			continue
 		}
 
@@ -190,24 +256,45 @@ func (tg *tarGenerator) AddFile(name, path string) error {
 		tg.inodes[ino] = name
 	}
 
-	// XXX: What about xattrs.
-
-	// Apply any header mappings.
+	// Apply any header mappings (including the ids inside xattrs).
 	if err := mapHeader(hdr, tg.mapOptions); err != nil {
 		return errors.Wrap(err, "map header")
 	}
-	if err := tg.tw.WriteHeader(hdr); err != nil {
-		return errors.Wrap(err, "write header")
-	}
+	tg.overrideOwner(hdr)
+	tg.normaliseHeader(hdr)
 
-	// Write the contents of regular files.
+	// Regular files with holes are stored as sparse files, so that the holes
+	// don't take up space in the layer.
+	var fh *os.File
 	if hdr.Typeflag == tar.TypeReg {
-		fh, err := tg.fsEval.Open(path)
+		fh, err = tg.fsEval.Open(path)
 		if err != nil {
 			return errors.Wrap(err, "open file")
 		}
 		defer fh.Close()
 
+		fragments, err := sparseMap(fh, hdr.Size)
+		if err != nil {
+			return errors.Wrap(err, "get sparse map")
+		}
+		if fragments != nil {
+			// Pad the previous entry, so that we can write to tg.w.
+			if err := tg.tw.Flush(); err != nil {
+				return errors.Wrap(err, "flush tar writer")
+			}
+			return errors.Wrap(writeSparseFile(tg.w, hdr, fh, fragments), "write sparse file")
+		}
+		if _, err := fh.Seek(0, io.SeekStart); err != nil {
+			return errors.Wrap(err, "seek file")
+		}
+	}
+
+	if err := tg.tw.WriteHeader(hdr); err != nil {
+		return errors.Wrap(err, "write header")
+	}
+
+	// Write the contents of regular files.
+	if hdr.Typeflag == tar.TypeReg {
 		n, err := io.Copy(tg.tw, fh)
 		if err != nil {
 			return errors.Wrap(err, "copy to layer")
@@ -220,7 +307,14 @@ func (tg *tarGenerator) AddFile(name, path string) error {
 	return nil
 }
 
-const whPrefix = ".wh."
+const (
+	// whPrefix is the prefix of whiteout files in a layer.
+	whPrefix = ".wh."
+
+	// whOpaque is the name of the opaque whiteout, which indicates that the
+	// directory containing it replaces the directory in lower layers.
+	whOpaque = whPrefix + whPrefix + ".opq"
+)
 
 // AddWhiteout adds a whiteout file for the given name inside the tar archive.
 // It's not recommended to add a file with AddFile and then white it out.
@@ -233,18 +327,31 @@ func (tg *tarGenerator) AddWhiteout(name string) error {
 	// Create the explicit whiteout for the file.
 	dir, file := filepath.Split(name)
 	whiteout := filepath.Join(dir, whPrefix+file)
-	timestamp := time.Now()
 
 	// Add a dummy header for the whiteout file.
-	if err := tg.tw.WriteHeader(&tar.Header{
-		Name:       whiteout,
-		Size:       0,
-		ModTime:    timestamp,
-		AccessTime: timestamp,
-		ChangeTime: timestamp,
-	}); err != nil {
+	if err := tg.tw.WriteHeader(tg.whiteoutHeader(whiteout)); err != nil {
 		return errors.Wrap(err, "write whiteout header")
 	}
 
 	return nil
 }
+
+// AddOpaqueWhiteout adds an opaque whiteout for the given directory inside the
+// tar archive, which hides all of the contents of the directory in lower
+// layers. The directory itself (and any of its contents which should be kept)
+// must be added separately.
+func (tg *tarGenerator) AddOpaqueWhiteout(name string) error {
+	name, err := normalise(name, false)
+	if err != nil {
+		return errors.Wrap(err, "normalise path")
+	}
+
+	whiteout := filepath.Join(name, whOpaque)
+
+	// Add a dummy header for the whiteout file.
+	if err := tg.tw.WriteHeader(tg.whiteoutHeader(whiteout)); err != nil {
+		return errors.Wrap(err, "write opaque whiteout header")
+	}
+
+	return nil
+}
@@ -26,8 +26,12 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
+
+	"github.com/openSUSE/umoci/pkg/system"
+	"github.com/pkg/errors"
 )
 
 func TestTarGenerateAddFileNormal(t *testing.T) {
@@ -377,3 +381,47 @@ func TestTarGenerateAddWhiteout(t *testing.T) {
 		t.Errorf("not all paths had a whiteout entry generated (only read %d, expected %d)!", idx, len(paths))
 	}
 }
+
+// TestTarGenerateXattrFilter makes sure that only the xattrs which pass the
+// xattr filters are included in generated layers.
+func TestTarGenerateXattrFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestTarGenerateXattrFilter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"user.keep", "user.drop"} {
+		if err := system.Lsetxattr(path, name, []byte("value"), 0); err != nil {
+			if errors.Cause(err) == syscall.ENOTSUP {
+				t.Skipf("user xattrs not supported: %v", err)
+			}
+			t.Fatalf("unexpected error setting xattr %s: %s", name, err)
+		}
+	}
+
+	var archive bytes.Buffer
+	tg := newTarGenerator(&archive, MapOptions{})
+	tg.xattrs = XattrFilter{Exclude: []string{"user.drop"}}
+	if err := tg.AddFile("file", path); err != nil {
+		t.Fatalf("AddFile: unexpected error: %s", err)
+	}
+	if err := tg.tw.Close(); err != nil {
+		t.Fatalf("tw.Close: unexpected error: %s", err)
+	}
+
+	hdr, err := tar.NewReader(&archive).Next()
+	if err != nil {
+		t.Fatalf("reading tar archive: %s", err)
+	}
+	if value, ok := hdr.Xattrs["user.keep"]; !ok || value != "value" {
+		t.Errorf("expected user.keep to be included: got %q", value)
+	}
+	if value, ok := hdr.Xattrs["user.drop"]; ok {
+		t.Errorf("expected user.drop to be filtered: got %q", value)
+	}
+}
@@ -59,3 +59,16 @@ func getInode(fi os.FileInfo) (uint64, error) {
 	}
 	return s.Ino, nil
 }
+
+func statCacheEntry(fi os.FileInfo) (StatCacheEntry, error) {
+	s, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return StatCacheEntry{}, fmt.Errorf("failed to cast fileinfo to *syscall.stat_t")
+	}
+	return StatCacheEntry{
+		Inode: s.Ino,
+		Size:  s.Size,
+		Mtime: s.Mtim.Nano(),
+		Ctime: s.Ctim.Nano(),
+	}, nil
+}
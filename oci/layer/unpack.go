@@ -19,10 +19,9 @@ package layer
 
 import (
 	"archive/tar"
-	"compress/gzip"
-	"crypto/sha256"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -33,6 +32,7 @@ import (
 	"github.com/openSUSE/umoci/oci/casext"
 	iconv "github.com/openSUSE/umoci/oci/config/convert"
 	"github.com/openSUSE/umoci/pkg/idtools"
+	"github.com/openSUSE/umoci/pkg/progress"
 	"github.com/openSUSE/umoci/pkg/system"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	rspec "github.com/opencontainers/runtime-spec/specs-go"
@@ -41,17 +41,54 @@ import (
 	"golang.org/x/net/context"
 )
 
+// Exposed errors. The compressed contents of a layer not matching its
+// descriptor results in cas.ErrDigestMismatch or cas.ErrSizeMismatch.
+var (
+	// ErrDiffIDMismatch is returned when the uncompressed contents of a layer
+	// don't match its DiffID in the image configuration.
+	ErrDiffIDMismatch = fmt.Errorf("layer diffid does not match image configuration")
+
+	// ErrLayerCountMismatch is returned when the number of layers in a
+	// manifest doesn't match the number of DiffIDs in the image
+	// configuration.
+	ErrLayerCountMismatch = fmt.Errorf("number of layers does not match number of diffids")
+)
+
 // UnpackLayer unpacks the tar stream representing an OCI layer at the given
 // root. It ensures that the state of the root is as close as possible to the
 // state used to create the layer. If an error is returned, the state of root
-// is undefined (unpacking is not guaranteed to be atomic).
-func UnpackLayer(root string, layer io.Reader, opt *MapOptions) error {
-	var mapOptions MapOptions
+// is undefined (unpacking is not guaranteed to be atomic). Paths which don't
+// pass the path filters in opt are skipped, and an error is returned if the
+// layer exceeds the limits in opt.
+func UnpackLayer(root string, layer io.Reader, opt *UnpackOptions) error {
+	var unpackOptions UnpackOptions
 	if opt != nil {
-		mapOptions = *opt
+		unpackOptions = *opt
+	}
+	counter := &countingReader{reader: layer}
+	report := func(entries int64, done bool) {
+		progress.Report(unpackOptions.Progress, progress.Event{
+			Operation: "unpack",
+			Layer:     -1,
+			Bytes:     counter.count,
+			Entries:   entries,
+			Done:      done,
+		})
 	}
-	te := newTarExtractor(mapOptions)
+	return unpackLayer(root, counter, unpackOptions, &unpackUsage{}, report)
+}
+
+// unpackLayer does the actual work of UnpackLayer, counting the usage of the
+// layer towards the given totals. report is called with the number of entries
+// extracted after each entry, and once more (with done set) at the end.
+func unpackLayer(root string, layer io.Reader, unpackOptions UnpackOptions, usage *unpackUsage, report func(entries int64, done bool)) error {
+	te := newTarExtractor(unpackOptions.MapOptions)
+	te.filters = unpackOptions.Filters
+	te.xattrs = unpackOptions.Xattrs
+	te.limits = unpackOptions.Limits
+	te.usage = usage
 	tr := tar.NewReader(layer)
+	var entries int64
 	for {
 		hdr, err := tr.Next()
 		if err == io.EOF {
@@ -63,7 +100,10 @@ func UnpackLayer(root string, layer io.Reader, opt *MapOptions) error {
 		if err := te.unpackEntry(root, hdr, tr); err != nil {
 			return errors.Wrapf(err, "unpack entry: %s", hdr.Name)
 		}
+		entries++
+		report(entries, false)
 	}
+	report(entries, true)
 	return nil
 }
 
@@ -74,8 +114,7 @@ const RootfsName = "rootfs"
 // isLayerType returns if the given MediaType is the media type of an image
 // layer blob. This includes both distributable and non-distributable images.
 func isLayerType(mediaType string) bool {
-	return mediaType == ispec.MediaTypeImageLayer || mediaType == ispec.MediaTypeImageLayerNonDistributable ||
-		mediaType == ispec.MediaTypeImageLayerGzip || mediaType == ispec.MediaTypeImageLayerNonDistributableGzip
+	return casext.IsLayerMediaType(mediaType)
 }
 
 // UnpackManifest extracts all of the layers in the given manifest, as well as
@@ -84,17 +123,99 @@ func isLayerType(mediaType string) bool {
 // extraction.
 //
 // FIXME: This interface is ugly.
-func UnpackManifest(ctx context.Context, engine cas.Engine, bundle string, manifest ispec.Manifest, opt *MapOptions) error {
+func UnpackManifest(ctx context.Context, engine cas.Engine, bundle string, manifest ispec.Manifest, opt *UnpackOptions) error {
+	engineExt := casext.Engine{engine}
+
+	var unpackOptions UnpackOptions
+	if opt != nil {
+		unpackOptions = *opt
+	}
+	mapOptions := unpackOptions.MapOptions
+
+	configPath := filepath.Join(bundle, "config.json")
+	rootfsPath := filepath.Join(bundle, RootfsName)
+
+	if err := prepareBundle(bundle); err != nil {
+		return err
+	}
+
+	if err := os.Mkdir(rootfsPath, 0755); err != nil {
+		return errors.Wrap(err, "mkdir rootfs")
+	}
+	if err := prepareRoot(rootfsPath, mapOptions); err != nil {
+		return errors.Wrap(err, "prepare rootfs")
+	}
+
+	config, err := unpackConfig(ctx, engineExt, manifest)
+	if err != nil {
+		return err
+	}
+	if err := unpackLayers(ctx, engineExt, rootfsPath, manifest, config, 0, opt); err != nil {
+		return err
+	}
+	return writeRuntimeConfig(configPath, rootfsPath, manifest, config, mapOptions)
+}
+
+// UpdateManifest updates a bundle previously extracted (with UnpackManifest)
+// from oldManifest so that it matches newManifest. The layers of newManifest
+// must be the layers of oldManifest followed by zero or more additional
+// layers, and only those additional layers are extracted on top of the
+// existing <bundle>/<layer.RootfsName>. The config.json is regenerated from
+// newManifest. It is up to the caller to ensure that the rootfs has not been
+// modified since it was extracted.
+func UpdateManifest(ctx context.Context, engine cas.Engine, bundle string, oldManifest, newManifest ispec.Manifest, opt *UnpackOptions) error {
 	engineExt := casext.Engine{engine}
 
-	var mapOptions MapOptions
+	var unpackOptions UnpackOptions
 	if opt != nil {
-		mapOptions = *opt
+		unpackOptions = *opt
+	}
+	mapOptions := unpackOptions.MapOptions
+
+	configPath := filepath.Join(bundle, "config.json")
+	rootfsPath := filepath.Join(bundle, RootfsName)
+
+	if fi, err := os.Lstat(rootfsPath); err != nil {
+		return errors.Wrap(err, "update manifest: stat rootfs")
+	} else if !fi.IsDir() {
+		return errors.Errorf("update manifest: %s is not a directory", RootfsName)
+	}
+
+	// Only appending layers to the old image is supported, anything else
+	// would require us to remove files from the rootfs.
+	if len(newManifest.Layers) < len(oldManifest.Layers) {
+		return errors.Errorf("update manifest: new manifest has fewer layers (%d) than old manifest (%d)", len(newManifest.Layers), len(oldManifest.Layers))
+	}
+	for idx, oldLayer := range oldManifest.Layers {
+		if newLayer := newManifest.Layers[idx]; newLayer.Digest != oldLayer.Digest {
+			return errors.Errorf("update manifest: layer %d differs between manifests: %s != %s", idx, oldLayer.Digest, newLayer.Digest)
+		}
 	}
 
-	// Create the bundle directory. We only error out if config.json or rootfs/
-	// already exists, because we cannot be sure that the user intended us to
-	// extract over an existing bundle.
+	oldConfig, err := unpackConfig(ctx, engineExt, oldManifest)
+	if err != nil {
+		return errors.Wrap(err, "old manifest")
+	}
+	config, err := unpackConfig(ctx, engineExt, newManifest)
+	if err != nil {
+		return err
+	}
+	for idx, oldDiffID := range oldConfig.RootFS.DiffIDs {
+		if diffID := config.RootFS.DiffIDs[idx]; diffID != oldDiffID {
+			return errors.Errorf("update manifest: diffid %d differs between configs: %s != %s", idx, oldDiffID, diffID)
+		}
+	}
+
+	if err := unpackLayers(ctx, engineExt, rootfsPath, newManifest, config, len(oldManifest.Layers), opt); err != nil {
+		return err
+	}
+	return writeRuntimeConfig(configPath, rootfsPath, newManifest, config, mapOptions)
+}
+
+// prepareBundle creates the bundle directory. We only error out if
+// config.json or rootfs/ already exists, because we cannot be sure that the
+// user intended us to extract over an existing bundle.
+func prepareBundle(bundle string) error {
 	if err := os.MkdirAll(bundle, 0755); err != nil {
 		return errors.Wrap(err, "mkdir bundle")
 	}
@@ -115,22 +236,23 @@ func UnpackManifest(ctx context.Context, engine cas.Engine, bundle string, manif
 		}
 		return errors.Wrap(err, "bundle path empty")
 	}
+	return nil
+}
 
-	if err := os.Mkdir(rootfsPath, 0755); err != nil {
-		return errors.Wrap(err, "mkdir rootfs")
-	}
-
+// prepareRoot sets the owner and times of a newly created root directory,
+// before any layers are extracted into it.
+func prepareRoot(path string, mapOptions MapOptions) error {
 	// Make sure that the owner is correct.
-	rootUID, err := idtools.ToHost(0, opt.UIDMappings)
+	rootUID, err := idtools.ToHost(0, mapOptions.UIDMappings)
 	if err != nil {
 		return errors.Wrap(err, "ensure rootuid has mapping")
 	}
-	rootGID, err := idtools.ToHost(0, opt.GIDMappings)
+	rootGID, err := idtools.ToHost(0, mapOptions.GIDMappings)
 	if err != nil {
 		return errors.Wrap(err, "ensure rootgid has mapping")
 	}
-	if err := os.Lchown(rootfsPath, rootUID, rootGID); err != nil {
-		return errors.Wrap(err, "chown rootfs")
+	if err := os.Lchown(path, rootUID, rootGID); err != nil {
+		return errors.Wrap(err, "chown root")
 	}
 
 	// Currently, many different images in the wild don't specify what the
@@ -139,74 +261,101 @@ func UnpackManifest(ctx context.Context, engine cas.Engine, bundle string, manif
 	// this, we first set the mtime of the root directory to the Unix epoch
 	// (which is as good of an arbitrary choice as any).
 	epoch := time.Unix(0, 0)
-	if err := system.Lutimes(rootfsPath, epoch, epoch); err != nil {
+	if err := system.Lutimes(path, epoch, epoch); err != nil {
 		return errors.Wrap(err, "set initial root time")
 	}
+	return nil
+}
 
+// unpackConfig fetches and validates the image configuration referenced by
+// the given manifest.
+func unpackConfig(ctx context.Context, engineExt casext.Engine, manifest ispec.Manifest) (ispec.Image, error) {
 	// In order to verify the DiffIDs as we extract layers, we have to get the
 	// .Config blob first. But we can't extract it (generate the runtime
 	// config) until after we have the full rootfs generated.
 	configBlob, err := engineExt.FromDescriptor(ctx, manifest.Config)
 	if err != nil {
-		return errors.Wrap(err, "get config blob")
+		return ispec.Image{}, errors.Wrap(err, "get config blob")
 	}
 	defer configBlob.Close()
 	if configBlob.MediaType != ispec.MediaTypeImageConfig {
-		return errors.Errorf("unpack manifest: config blob is not correct mediatype %s: %s", ispec.MediaTypeImageConfig, configBlob.MediaType)
+		return ispec.Image{}, errors.Errorf("unpack manifest: config blob is not correct mediatype %s: %s", ispec.MediaTypeImageConfig, configBlob.MediaType)
 	}
 	config, ok := configBlob.Data.(ispec.Image)
 	if !ok {
 		// Should _never_ be reached.
-		return errors.Errorf("[internal error] unknown config blob type: %s", configBlob.MediaType)
+		return ispec.Image{}, errors.Errorf("[internal error] unknown config blob type: %s", configBlob.MediaType)
 	}
 
 	// We can't understand non-layer images.
 	if config.RootFS.Type != "layers" {
-		return errors.Errorf("unpack manifest: config: unsupported rootfs.type: %s", config.RootFS.Type)
+		return ispec.Image{}, errors.Errorf("unpack manifest: config: unsupported rootfs.type: %s", config.RootFS.Type)
 	}
 
-	// Layer extraction.
-	for idx, layerDescriptor := range manifest.Layers {
-		layerDiffID := config.RootFS.DiffIDs[idx]
-		log.Infof("unpack layer: %s", layerDescriptor.Digest)
+	if len(manifest.Layers) != len(config.RootFS.DiffIDs) {
+		return ispec.Image{}, errors.Wrapf(ErrLayerCountMismatch, "unpack manifest: manifest has %d layers but config has %d diffids", len(manifest.Layers), len(config.RootFS.DiffIDs))
+	}
+	return config, nil
+}
 
-		layerBlob, err := engineExt.FromDescriptor(ctx, layerDescriptor)
-		if err != nil {
-			return errors.Wrap(err, "get layer blob")
-		}
-		defer layerBlob.Close()
-		if !isLayerType(layerBlob.MediaType) {
-			return errors.Errorf("unpack manifest: layer %s: blob is not correct mediatype: %s", layerBlob.Digest, layerBlob.MediaType)
-		}
-		layerGzip, ok := layerBlob.Data.(io.ReadCloser)
-		if !ok {
-			// Should _never_ be reached.
-			return errors.Errorf("[internal error] layerBlob was not an io.ReadCloser")
+// unpackLayers extracts manifest.Layers[start:] on top of rootfsPath, in
+// order, verifying each layer against the DiffIDs in config.
+func unpackLayers(ctx context.Context, engineExt casext.Engine, rootfsPath string, manifest ispec.Manifest, config ispec.Image, start int, opt *UnpackOptions) error {
+	var unpackOptions UnpackOptions
+	if opt != nil {
+		unpackOptions = *opt
+	}
+	// The limits on the totals apply to all of the layers.
+	usage := &unpackUsage{}
+
+	// Layer extraction. Layers have to be extracted in order, but the
+	// following layers are fetched, decompressed and verified concurrently
+	// (see fetchLayer) while each layer is extracted.
+	streams := make([]*layerStream, len(manifest.Layers))
+	defer func() {
+		for _, stream := range streams {
+			if stream != nil {
+				stream.Close()
+			}
 		}
-
-		// We have to extract a gzip'd version of the above layer. Also note
-		// that we have to check the DiffID we're extracting (which is the
-		// sha256 sum of the *uncompressed* layer).
-		layerRaw, err := gzip.NewReader(layerGzip)
-		if err != nil {
-			return errors.Wrap(err, "create gzip reader")
+	}()
+	for idx := start; idx < len(manifest.Layers); idx++ {
+		for next := idx; next < len(manifest.Layers) && next <= idx+unpackPrefetchLayers; next++ {
+			if streams[next] == nil {
+				streams[next] = fetchLayer(ctx, engineExt, manifest.Layers[next], config.RootFS.DiffIDs[next])
+			}
 		}
-		layerHash := sha256.New()
-		layer := io.TeeReader(layerRaw, layerHash)
 
-		if err := UnpackLayer(rootfsPath, layer, opt); err != nil {
+		log.Infof("unpack layer: %s", manifest.Layers[idx].Digest)
+		layer := streams[idx]
+		report := layer.progress(unpackOptions.Progress, idx, manifest.Layers[idx])
+		var entries int64
+		if err := unpackLayer(rootfsPath, layer, unpackOptions, usage, func(n int64, done bool) {
+			// The layer is only done once it has been verified (below).
+			entries = n
+			if !done {
+				report(n, false)
+			}
+		}); err != nil {
 			return errors.Wrap(err, "unpack layer")
 		}
-		layerGzip.Close()
-
-		layerDigest := fmt.Sprintf("%s:%x", cas.BlobAlgorithm, layerHash.Sum(nil))
-		if layerDigest != layerDiffID {
-			return errors.Errorf("unpack manifest: layer %s: diffid mismatch: got %s expected %s", layerDescriptor.Digest, layerDigest, layerDiffID)
+		// The tar reader stops at the end-of-archive marker, but the layer
+		// may contain trailing padding which is included in the DiffID. This
+		// also returns any error from verifying the DiffID.
+		if _, err := io.Copy(ioutil.Discard, layer); err != nil {
+			return errors.Wrap(err, "finish layer")
 		}
+		report(entries, true)
+		layer.Close()
 	}
+	return nil
+}
 
-	// Generate a runtime configuration file from ispec.Image.
-	log.Infof("unpack configuration: %s", configBlob.Digest)
+// writeRuntimeConfig generates a runtime configuration file from the given
+// ispec.Image and writes it to configPath, replacing any existing file. Any
+// rootMounts are added before the other mounts of the configuration.
+func writeRuntimeConfig(configPath, rootfsPath string, manifest ispec.Manifest, config ispec.Image, mapOptions MapOptions, rootMounts ...rspec.Mount) error {
+	log.Infof("unpack configuration: %s", manifest.Config.Digest)
 
 	g := rgen.New()
 	if err := iconv.MutateRuntimeSpec(g, rootfsPath, config, manifest); err != nil {
@@ -229,6 +378,9 @@ func UnpackManifest(ctx context.Context, engine cas.Engine, bundle string, manif
 		ToRootless(g.Spec())
 		g.AddBindMount("/etc/resolv.conf", "/etc/resolv.conf", []string{"bind", "ro"})
 	}
+	if len(rootMounts) > 0 {
+		g.Spec().Mounts = append(rootMounts, g.Spec().Mounts...)
+	}
 
 	// Save the config.json.
 	if err := g.SaveToFile(configPath, rgen.ExportOptions{}); err != nil {
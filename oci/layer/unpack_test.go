@@ -0,0 +1,546 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/cas/drivers/dir"
+	"github.com/openSUSE/umoci/pkg/progress"
+	"github.com/opencontainers/go-digest"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+type testLayerFile struct {
+	name     string
+	contents string
+}
+
+// makeTestImage creates an image with one layer for each set of files, and
+// returns the manifest of the image. The layers alternate between being
+// gzip compressed and uncompressed.
+func makeTestImage(t *testing.T, engine cas.Engine, layers [][]testLayerFile) ispec.Manifest {
+	var entryLayers [][]testLayerEntry
+	for _, files := range layers {
+		var entries []testLayerEntry
+		for _, file := range files {
+			entries = append(entries, testLayerEntry{
+				hdr: tar.Header{
+					Name:     file.name,
+					Mode:     0644,
+					Typeflag: tar.TypeReg,
+					Size:     int64(len(file.contents)),
+				},
+				contents: file.contents,
+			})
+		}
+		entryLayers = append(entryLayers, entries)
+	}
+	return makeTestImageEntries(t, engine, entryLayers)
+}
+
+type testLayerEntry struct {
+	hdr      tar.Header
+	contents string
+}
+
+// makeTestLayer creates an uncompressed layer with the given entries.
+func makeTestLayer(t *testing.T, entries []testLayerEntry) []byte {
+	var buffer bytes.Buffer
+	tw := tar.NewWriter(&buffer)
+	for _, entry := range entries {
+		hdr := entry.hdr
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatalf("write tar header: %+v", err)
+		}
+		if _, err := tw.Write([]byte(entry.contents)); err != nil {
+			t.Fatalf("write tar data: %+v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close tar writer: %+v", err)
+	}
+	return buffer.Bytes()
+}
+
+// readTestLayer reads every entry of the given tar archive, returning the
+// header and contents of each entry by name.
+func readTestLayer(t *testing.T, r io.Reader) (map[string]*tar.Header, map[string]string) {
+	headers := make(map[string]*tar.Header)
+	contents := make(map[string]string)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("read tar header: %+v", err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("read tar data: %+v", err)
+		}
+		if _, ok := headers[hdr.Name]; ok {
+			t.Errorf("duplicate entry in tar archive: %s", hdr.Name)
+		}
+		headers[hdr.Name] = hdr
+		contents[hdr.Name] = string(data)
+	}
+	return headers, contents
+}
+
+// testTarEntry is the expected state of an entry read by readTestLayer.
+type testTarEntry struct {
+	typeflag byte
+	contents string
+	linkname string
+	uid, gid int
+}
+
+// checkTestLayer checks that the given tar archive contains exactly the
+// expected entries. Only the fields in testTarEntry are compared.
+func checkTestLayer(t *testing.T, r io.Reader, expected map[string]testTarEntry) {
+	headers, contents := readTestLayer(t, r)
+	got := make(map[string]testTarEntry)
+	for name, hdr := range headers {
+		got[name] = testTarEntry{
+			typeflag: hdr.Typeflag,
+			contents: contents[name],
+			linkname: hdr.Linkname,
+			uid:      hdr.Uid,
+			gid:      hdr.Gid,
+		}
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("tar archive doesn't match expected:\n got: %v\nwant: %v", got, expected)
+	}
+}
+
+// makeTestImageEntries is like makeTestImage, but each layer is given as a
+// list of arbitrary tar entries.
+func makeTestImageEntries(t *testing.T, engine cas.Engine, layers [][]testLayerEntry) ispec.Manifest {
+	ctx := context.Background()
+
+	var diffIDs []string
+	var descriptors []ispec.Descriptor
+	for idx, entries := range layers {
+		blob := makeTestLayer(t, entries)
+		diffIDs = append(diffIDs, digest.FromBytes(blob).String())
+
+		mediaType := ispec.MediaTypeImageLayer
+		if idx%2 == 0 {
+			var compressed bytes.Buffer
+			gzw := gzip.NewWriter(&compressed)
+			gzw.Write(blob)
+			gzw.Close()
+			mediaType = ispec.MediaTypeImageLayerGzip
+			blob = compressed.Bytes()
+		}
+
+		layerDigest, layerSize, err := engine.PutBlob(ctx, bytes.NewReader(blob))
+		if err != nil {
+			t.Fatalf("put layer: %+v", err)
+		}
+		descriptors = append(descriptors, ispec.Descriptor{
+			MediaType: mediaType,
+			Digest:    layerDigest,
+			Size:      layerSize,
+		})
+	}
+
+	configDigest, configSize, err := engine.PutBlobJSON(ctx, ispec.Image{
+		OS:           "linux",
+		Architecture: "amd64",
+		RootFS: ispec.RootFS{
+			Type:    "layers",
+			DiffIDs: diffIDs,
+		},
+	})
+	if err != nil {
+		t.Fatalf("put config: %+v", err)
+	}
+
+	return ispec.Manifest{
+		Versioned: imeta.Versioned{
+			SchemaVersion: 2,
+		},
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: descriptors,
+	}
+}
+
+func TestUnpackManifest(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestUnpackManifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+
+	// Use more layers than are prefetched, as well as a layer larger than
+	// the buffers used by the layer fetchers.
+	big := strings.Repeat("big layer data\n", (unpackChunkSize*unpackBufferedChunks)/8)
+	var layers [][]testLayerFile
+	for idx := 0; idx < 2*unpackPrefetchLayers+1; idx++ {
+		layers = append(layers, []testLayerFile{
+			{"file", strings.Repeat("x", idx)},
+			{"layer" + strings.Repeat("_", idx), "layer"},
+		})
+	}
+	layers[1] = append(layers[1], testLayerFile{"big", big})
+	manifest := makeTestImage(t, engine, layers)
+
+	bundle := filepath.Join(root, "bundle")
+	if err := UnpackManifest(context.Background(), engine, bundle, manifest, &UnpackOptions{}); err != nil {
+		t.Fatalf("unexpected error unpacking manifest: %+v", err)
+	}
+
+	// Later layers must have been applied after earlier layers.
+	last := len(layers) - 1
+	if got, err := ioutil.ReadFile(filepath.Join(bundle, RootfsName, "file")); err != nil {
+		t.Errorf("unexpected error reading file: %+v", err)
+	} else if string(got) != strings.Repeat("x", last) {
+		t.Errorf("file has contents %q, expected those of layer %d", got, last)
+	}
+	for idx := range layers {
+		if _, err := os.Lstat(filepath.Join(bundle, RootfsName, "layer"+strings.Repeat("_", idx))); err != nil {
+			t.Errorf("file from layer %d missing: %+v", idx, err)
+		}
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(bundle, RootfsName, "big")); err != nil {
+		t.Errorf("unexpected error reading big file: %+v", err)
+	} else if string(got) != big {
+		t.Errorf("big file has the wrong contents")
+	}
+	if _, err := os.Lstat(filepath.Join(bundle, "config.json")); err != nil {
+		t.Errorf("config.json missing: %+v", err)
+	}
+}
+
+func TestUnpackManifestProgress(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestUnpackManifestProgress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+
+	manifest := makeTestImage(t, engine, [][]testLayerFile{
+		{{"a", "a"}, {"b", "b"}},
+		{{"c", "c"}},
+	})
+
+	var events []progress.Event
+	reporter := progress.ReporterFunc(func(event progress.Event) {
+		events = append(events, event)
+	})
+	bundle := filepath.Join(root, "bundle")
+	if err := UnpackManifest(context.Background(), engine, bundle, manifest, &UnpackOptions{Progress: reporter}); err != nil {
+		t.Fatalf("unexpected error unpacking manifest: %+v", err)
+	}
+
+	// Each entry is reported, followed by the layer being done.
+	expected := []struct {
+		layer   int
+		entries int64
+		done    bool
+	}{
+		{0, 1, false},
+		{0, 2, false},
+		{0, 2, true},
+		{1, 1, false},
+		{1, 1, true},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events, got %d: %+v", len(expected), len(events), events)
+	}
+	for idx, event := range events {
+		descriptor := manifest.Layers[expected[idx].layer]
+		if event.Operation != "unpack" || event.Layer != expected[idx].layer || event.Digest != descriptor.Digest || event.Total != descriptor.Size {
+			t.Errorf("event %d is for the wrong layer: %+v", idx, event)
+		}
+		if event.Entries != expected[idx].entries || event.Done != expected[idx].done {
+			t.Errorf("unexpected event %d: expected %+v, got %+v", idx, expected[idx], event)
+		}
+		if event.Done && event.Bytes != event.Total {
+			t.Errorf("layer %d is done with only %d of %d bytes read", event.Layer, event.Bytes, event.Total)
+		}
+	}
+}
+
+func TestUnpackManifestBadDiffID(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestUnpackManifestBadDiffID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+
+	// Swap the second and third layers, so the DiffIDs don't match (while
+	// the following layers are still being fetched).
+	var layers [][]testLayerFile
+	for idx := 0; idx < 2*unpackPrefetchLayers; idx++ {
+		layers = append(layers, []testLayerFile{{"file", strings.Repeat("x", idx)}})
+	}
+	manifest := makeTestImage(t, engine, layers)
+	manifest.Layers[1], manifest.Layers[2] = manifest.Layers[2], manifest.Layers[1]
+
+	bundle := filepath.Join(root, "bundle")
+	err = UnpackManifest(context.Background(), engine, bundle, manifest, &UnpackOptions{})
+	if err == nil {
+		t.Fatalf("expected an error unpacking manifest with bad diffids")
+	}
+	if !strings.Contains(err.Error(), "diffid mismatch") || errors.Cause(err) != ErrDiffIDMismatch {
+		t.Errorf("expected a diffid mismatch error, got %+v", err)
+	}
+}
+
+func TestUnpackManifestBadDescriptor(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestUnpackManifestBadDescriptor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+
+	layers := [][]testLayerFile{
+		{{"file", "a"}},
+		{{"file", "b"}},
+		{{"file", "c"}},
+	}
+	for _, test := range []struct {
+		name     string
+		mutate   func(t *testing.T, manifest *ispec.Manifest)
+		expected error
+	}{
+		{"SizeShort", func(t *testing.T, manifest *ispec.Manifest) {
+			manifest.Layers[1].Size--
+		}, cas.ErrSizeMismatch},
+		{"SizeLong", func(t *testing.T, manifest *ispec.Manifest) {
+			manifest.Layers[1].Size++
+		}, cas.ErrSizeMismatch},
+		{"LayerCount", func(t *testing.T, manifest *ispec.Manifest) {
+			manifest.Layers = append(manifest.Layers, manifest.Layers[0])
+		}, ErrLayerCountMismatch},
+		{"Digest", func(t *testing.T, manifest *ispec.Manifest) {
+			// Replace the contents of the third layer's blob with the first
+			// layer (which has the same size and compression). This has to be
+			// the last case, as the blobs are shared between the cases.
+			blob := func(desc ispec.Descriptor) string {
+				return filepath.Join(image, "blobs", desc.Digest.Algorithm().String(), desc.Digest.Hex())
+			}
+			if manifest.Layers[0].Size != manifest.Layers[2].Size {
+				t.Fatalf("test layers have different sizes")
+			}
+			data, err := ioutil.ReadFile(blob(manifest.Layers[0]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := blob(manifest.Layers[2])
+			if err := os.Remove(path); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(path, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}, cas.ErrDigestMismatch},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			manifest := makeTestImage(t, engine, layers)
+			test.mutate(t, &manifest)
+
+			bundle, err := ioutil.TempDir(root, "bundle")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Remove(bundle); err != nil {
+				t.Fatal(err)
+			}
+			err = UnpackManifest(context.Background(), engine, bundle, manifest, &UnpackOptions{})
+			if errors.Cause(err) != test.expected {
+				t.Errorf("expected %v, got %+v", test.expected, err)
+			}
+		})
+	}
+}
+
+func TestUpdateManifest(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestUpdateManifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+
+	layers := [][]testLayerFile{
+		{{"file", "a"}, {"old", "old"}},
+		{{"file", "b"}},
+		{{"file", "c"}, {"new", "new"}},
+	}
+	oldManifest := makeTestImage(t, engine, layers[:2])
+	newManifest := makeTestImage(t, engine, layers)
+
+	bundle := filepath.Join(root, "bundle")
+	if err := UnpackManifest(context.Background(), engine, bundle, oldManifest, &UnpackOptions{}); err != nil {
+		t.Fatalf("unexpected error unpacking manifest: %+v", err)
+	}
+
+	// Removing a file from an old layer lets us check that the old layers
+	// are not extracted again.
+	if err := os.Remove(filepath.Join(bundle, RootfsName, "old")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A manifest which doesn't share the old layers must be rejected.
+	badManifest := makeTestImage(t, engine, layers[1:])
+	if err := UpdateManifest(context.Background(), engine, bundle, oldManifest, badManifest, &UnpackOptions{}); err == nil {
+		t.Errorf("expected an error updating to a manifest with different layers")
+	}
+
+	if err := UpdateManifest(context.Background(), engine, bundle, oldManifest, newManifest, &UnpackOptions{}); err != nil {
+		t.Fatalf("unexpected error updating manifest: %+v", err)
+	}
+
+	if got, err := ioutil.ReadFile(filepath.Join(bundle, RootfsName, "file")); err != nil {
+		t.Errorf("unexpected error reading file: %+v", err)
+	} else if string(got) != "c" {
+		t.Errorf("file has contents %q, expected those of the new layer", got)
+	}
+	if _, err := os.Lstat(filepath.Join(bundle, RootfsName, "new")); err != nil {
+		t.Errorf("file from new layer missing: %+v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(bundle, RootfsName, "old")); !os.IsNotExist(err) {
+		t.Errorf("old layer was extracted again: %+v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(bundle, "config.json")); err != nil {
+		t.Errorf("config.json missing: %+v", err)
+	}
+}
+
+func TestUnpackManifestFilters(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestUnpackManifestFilters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+
+	manifest := makeTestImage(t, engine, [][]testLayerFile{
+		{{"etc/passwd", "root"}, {"etc/skel/.bashrc", "bash"}, {"usr/share/doc/README", "doc"}},
+		{{"etc/.wh.passwd", ""}, {"etc/group", "root"}, {"usr/.wh.share", ""}},
+	})
+
+	bundle := filepath.Join(root, "bundle")
+	if err := UnpackManifest(context.Background(), engine, bundle, manifest, &UnpackOptions{
+		Filters: PathFilters{
+			Include: []string{"/etc"},
+			Exclude: []string{"/etc/skel"},
+		},
+	}); err != nil {
+		t.Fatalf("unexpected error unpacking manifest: %+v", err)
+	}
+
+	for _, test := range []struct {
+		path   string
+		exists bool
+	}{
+		{"etc/group", true},
+		{"etc/passwd", false},
+		{"etc/skel", false},
+		{"usr", false},
+	} {
+		_, err := os.Lstat(filepath.Join(bundle, RootfsName, test.path))
+		if test.exists && err != nil {
+			t.Errorf("expected %s to exist: %s", test.path, err)
+		} else if !test.exists && !os.IsNotExist(err) {
+			t.Errorf("expected %s to be filtered: %v", test.path, err)
+		}
+	}
+}
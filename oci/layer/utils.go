@@ -19,10 +19,13 @@ package layer
 
 import (
 	"archive/tar"
+	"io"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/openSUSE/umoci/pkg/idtools"
+	"github.com/openSUSE/umoci/pkg/progress"
 	rspec "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/pkg/errors"
 )
@@ -39,6 +42,71 @@ type MapOptions struct {
 	Rootless bool `json:"rootless"`
 }
 
+// UnpackOptions specifies the options used when unpacking layers.
+type UnpackOptions struct {
+	// MapOptions are the UID and GID mappings used when unpacking.
+	MapOptions MapOptions
+
+	// Filters restricts the set of paths which are extracted.
+	Filters PathFilters
+
+	// Xattrs restricts the set of xattrs which are applied to the extracted
+	// paths.
+	Xattrs XattrFilter
+
+	// Limits restricts what the layers may contain.
+	Limits UnpackLimits
+
+	// Progress, if not nil, is sent progress events (with the operation
+	// "unpack") as each layer is unpacked. Bytes is the number of bytes of
+	// the (compressed) layer blob which have been read.
+	Progress progress.Reporter
+}
+
+// RepackOptions specifies the options used when generating layers.
+type RepackOptions struct {
+	// MapOptions are the UID and GID mappings used when repacking.
+	MapOptions MapOptions
+
+	// Filters restricts the set of paths which are included in the layer. It
+	// should be the same as the filters used when unpacking, so that paths
+	// which were never extracted are not turned into whiteouts.
+	Filters PathFilters
+
+	// Xattrs restricts the set of xattrs which are included in the layer.
+	Xattrs XattrFilter
+
+	// MaskPaths is a set of paths (in the same format as the paths in
+	// PathFilters) whose changes are never included in the layer, such as
+	// temporary directories or the targets of bind-mounts. Unlike the
+	// Filters, masks only apply to repacking. Neither modifications nor
+	// whiteouts are generated for a masked path or anything inside it.
+	MaskPaths []string
+
+	// Progress, if not nil, is sent progress events (with the operation
+	// "repack") as the layer is generated. Bytes is the number of bytes of
+	// the (uncompressed) layer which have been generated.
+	Progress progress.Reporter
+
+	// Reproducible specifies whether the layer should only depend on the
+	// contents of the rootfs, so that repacking the same changes results in
+	// the same layer. Host-specific metadata (such as atimes, ctimes and user
+	// names) is dropped and whiteouts are given a fixed timestamp.
+	Reproducible bool
+
+	// ClampMtime is the latest mtime of the entries in a reproducible layer
+	// (later mtimes are replaced with it), and is used as the timestamp of
+	// whiteouts. It is usually set from SOURCE_DATE_EPOCH. If it is the zero
+	// time, mtimes are not clamped and whiteouts use the Unix epoch.
+	ClampMtime time.Time
+}
+
+// mapsIDs returns whether the MapOptions change any ids, which is the case if
+// there are any mappings or if rootless mode is enabled.
+func (m MapOptions) mapsIDs() bool {
+	return m.Rootless || len(m.UIDMappings) > 0 || len(m.GIDMappings) > 0
+}
+
 // mapHeader maps a tar.Header generated from the filesystem so that it
 // describes the inode as it would be observed by a container process. In
 // particular this involves apply an ID mapping from the host filesystem to the
@@ -63,6 +131,31 @@ func mapHeader(hdr *tar.Header, mapOptions MapOptions) error {
 
 	hdr.Uid = newUID
 	hdr.Gid = newGID
+
+	// The ids inside ACL and capability xattrs have to be mapped as well. In
+	// rootless mode, ids which cannot be mapped are treated as root (in the
+	// same way as the owner of every file is). Without any mappings the xattrs
+	// are left untouched.
+	if !mapOptions.mapsIDs() {
+		return nil
+	}
+	mapUID := func(id int) (int, error) {
+		newID, err := idtools.ToContainer(id, mapOptions.UIDMappings)
+		if err != nil && mapOptions.Rootless {
+			return 0, nil
+		}
+		return newID, err
+	}
+	mapGID := func(id int) (int, error) {
+		newID, err := idtools.ToContainer(id, mapOptions.GIDMappings)
+		if err != nil && mapOptions.Rootless {
+			return 0, nil
+		}
+		return newID, err
+	}
+	if err := mapXattrIDs(hdr.Name, hdr.Xattrs, mapUID, mapGID); err != nil {
+		return errors.Wrap(err, "map xattrs to container")
+	}
 	return nil
 }
 
@@ -90,6 +183,31 @@ func unmapHeader(hdr *tar.Header, mapOptions MapOptions) error {
 
 	hdr.Uid = newUID
 	hdr.Gid = newGID
+
+	// The ids inside ACL and capability xattrs have to be mapped as well. In
+	// rootless mode, ids which cannot be mapped are treated as root (in the
+	// same way as the owner of every file is). Without any mappings the xattrs
+	// are left untouched.
+	if !mapOptions.mapsIDs() {
+		return nil
+	}
+	unmapUID := func(id int) (int, error) {
+		newID, err := idtools.ToHost(id, mapOptions.UIDMappings)
+		if err != nil && mapOptions.Rootless {
+			return idtools.ToHost(0, mapOptions.UIDMappings)
+		}
+		return newID, err
+	}
+	unmapGID := func(id int) (int, error) {
+		newID, err := idtools.ToHost(id, mapOptions.GIDMappings)
+		if err != nil && mapOptions.Rootless {
+			return idtools.ToHost(0, mapOptions.GIDMappings)
+		}
+		return newID, err
+	}
+	if err := mapXattrIDs(hdr.Name, hdr.Xattrs, unmapUID, unmapGID); err != nil {
+		return errors.Wrap(err, "map xattrs to host")
+	}
 	return nil
 }
 
@@ -123,3 +241,31 @@ func CleanPath(path string) string {
 	// Clean the path again for good measure.
 	return filepath.Clean(path)
 }
+
+// countingReader is an io.Reader which counts the number of bytes read from
+// the underlying reader.
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+// Read reads from the underlying reader.
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count += int64(n)
+	return n, err
+}
+
+// countingWriter is an io.Writer which counts the number of bytes written to
+// the underlying writer.
+type countingWriter struct {
+	writer io.Writer
+	count  int64
+}
+
+// Write writes to the underlying writer.
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	w.count += int64(n)
+	return n, err
+}
@@ -0,0 +1,90 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package layer
+
+import (
+	"path"
+
+	"github.com/pkg/errors"
+)
+
+// defaultXattrExclude is the set of xattrs which are excluded unless they are
+// matched by one of the Include patterns of an XattrFilter.
+var defaultXattrExclude = []string{
+	// SELinux labels are host-specific (the label of a file in a rootfs is
+	// decided by the host's policy) and SELinux doesn't allow you to set them
+	// generically, so they are neither included in layers nor applied when
+	// extracting them by default.
+	"security.selinux",
+}
+
+// XattrFilter restricts the set of xattrs which are included in generated
+// layers and applied when extracting layers. Each filter is an xattr name,
+// which may contain path.Match globs (so "user.*" matches every xattr in the
+// user namespace).
+type XattrFilter struct {
+	// Include is the set of xattrs which are kept even though they are
+	// excluded by default (such as security.selinux). It doesn't restrict
+	// any other xattrs, which are kept unless they match Exclude.
+	Include []string `json:"include,omitempty"`
+
+	// Exclude is the set of xattrs which are never included or applied. It
+	// takes precedence over Include.
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// Empty returns whether there are no filters, and so only the xattrs which
+// are excluded by default are dropped.
+func (f XattrFilter) Empty() bool {
+	return len(f.Include) == 0 && len(f.Exclude) == 0
+}
+
+// Validate returns an error if any of the filters are not valid.
+func (f XattrFilter) Validate() error {
+	for _, filters := range [][]string{f.Include, f.Exclude} {
+		for _, filter := range filters {
+			if filter == "" {
+				return errors.Errorf("xattr filter is empty")
+			}
+			if _, err := path.Match(filter, ""); err != nil {
+				return errors.Wrapf(err, "invalid xattr filter: %s", filter)
+			}
+		}
+	}
+	return nil
+}
+
+// Allowed returns whether the xattr with the given name passes the filters.
+func (f XattrFilter) Allowed(name string) bool {
+	if matchXattr(f.Exclude, name) {
+		return false
+	}
+	if matchXattr(defaultXattrExclude, name) {
+		return matchXattr(f.Include, name)
+	}
+	return true
+}
+
+// matchXattr returns whether any of the filters match the given xattr name.
+func matchXattr(filters []string, name string) bool {
+	for _, filter := range filters {
+		if ok, _ := path.Match(filter, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,150 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package layer
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+)
+
+// The names of the xattrs which contain uids and gids, which have to be
+// mapped in the same way as the owner of the inode.
+const (
+	xattrACLAccess  = "system.posix_acl_access"
+	xattrACLDefault = "system.posix_acl_default"
+	xattrCapability = "security.capability"
+)
+
+// The layout of POSIX ACL xattrs (see <linux/posix_acl_xattr.h>). The value
+// is a version header followed by a list of entries, and only the ACL_USER
+// and ACL_GROUP entries contain ids.
+const (
+	aclXattrVersion = 0x0002
+	aclHeaderSize   = 4
+	aclEntrySize    = 8
+	aclTagUser      = 0x02
+	aclTagGroup     = 0x08
+)
+
+// The layout of file capability xattrs (see <linux/capability.h>). Only
+// version 3 file capabilities contain an id (the host uid of the root user of
+// the user namespace the capabilities apply in), which is stored after the
+// capability sets.
+const (
+	vfsCapRevisionMask = 0xff000000
+	vfsCapRevision3    = 0x03000000
+	vfsCapV3Size       = 24
+	vfsCapRootIDOffset = 20
+)
+
+// errMalformedXattr is returned by mapACLXattr and mapCapabilityXattr if the
+// value of the xattr cannot be parsed.
+var errMalformedXattr = fmt.Errorf("malformed xattr value")
+
+// idMapFunc maps a uid or gid, returning an error if it cannot be mapped.
+type idMapFunc func(id int) (int, error)
+
+// mapXattrIDs rewrites the uids and gids embedded in the given xattrs (the
+// POSIX ACL xattrs and version 3 file capabilities) using mapUID and mapGID,
+// in the same way that the owner of an inode is mapped. Other xattrs, and
+// xattrs which cannot be parsed, are left unchanged. The path is only used
+// for logging.
+func mapXattrIDs(path string, xattrs map[string]string, mapUID, mapGID idMapFunc) error {
+	for name, value := range xattrs {
+		var newValue []byte
+		var err error
+		switch name {
+		case xattrACLAccess, xattrACLDefault:
+			newValue, err = mapACLXattr([]byte(value), mapUID, mapGID)
+		case xattrCapability:
+			newValue, err = mapCapabilityXattr([]byte(value), mapUID)
+		default:
+			continue
+		}
+		if errors.Cause(err) == errMalformedXattr {
+			log.Warnf("map xattr ids: leaving malformed xattr unchanged: %s: %s: %v", path, name, err)
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "map ids in xattr %s", name)
+		}
+		xattrs[name] = string(newValue)
+	}
+	return nil
+}
+
+// mapACLXattr returns a copy of the given POSIX ACL xattr value, with the ids
+// of the ACL_USER and ACL_GROUP entries mapped using mapUID and mapGID.
+func mapACLXattr(value []byte, mapUID, mapGID idMapFunc) ([]byte, error) {
+	if len(value) < aclHeaderSize || (len(value)-aclHeaderSize)%aclEntrySize != 0 {
+		return nil, errors.Wrapf(errMalformedXattr, "invalid acl xattr size %d", len(value))
+	}
+	if version := binary.LittleEndian.Uint32(value); version != aclXattrVersion {
+		return nil, errors.Wrapf(errMalformedXattr, "unsupported acl xattr version %d", version)
+	}
+
+	newValue := make([]byte, len(value))
+	copy(newValue, value)
+	for off := aclHeaderSize; off < len(newValue); off += aclEntrySize {
+		entry := newValue[off : off+aclEntrySize]
+
+		var mapID idMapFunc
+		switch binary.LittleEndian.Uint16(entry[0:2]) {
+		case aclTagUser:
+			mapID = mapUID
+		case aclTagGroup:
+			mapID = mapGID
+		default:
+			// The other entries don't refer to a particular user or group.
+			continue
+		}
+
+		id, err := mapID(int(binary.LittleEndian.Uint32(entry[4:8])))
+		if err != nil {
+			return nil, errors.Wrap(err, "map acl entry id")
+		}
+		binary.LittleEndian.PutUint32(entry[4:8], uint32(id))
+	}
+	return newValue, nil
+}
+
+// mapCapabilityXattr returns a copy of the given file capability xattr value,
+// with the root id of version 3 file capabilities mapped using mapUID. Earlier
+// versions are returned unchanged, because they apply in every user namespace.
+func mapCapabilityXattr(value []byte, mapUID idMapFunc) ([]byte, error) {
+	if len(value) < 4 {
+		return nil, errors.Wrapf(errMalformedXattr, "invalid capability xattr size %d", len(value))
+	}
+	if binary.LittleEndian.Uint32(value)&vfsCapRevisionMask != vfsCapRevision3 {
+		return value, nil
+	}
+	if len(value) != vfsCapV3Size {
+		return nil, errors.Wrapf(errMalformedXattr, "invalid v3 capability xattr size %d", len(value))
+	}
+
+	rootID, err := mapUID(int(binary.LittleEndian.Uint32(value[vfsCapRootIDOffset:])))
+	if err != nil {
+		return nil, errors.Wrap(err, "map capability root id")
+	}
+	newValue := make([]byte, len(value))
+	copy(newValue, value)
+	binary.LittleEndian.PutUint32(newValue[vfsCapRootIDOffset:], uint32(rootID))
+	return newValue, nil
+}
@@ -0,0 +1,216 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package layer
+
+import (
+	"archive/tar"
+	"encoding/binary"
+	"testing"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// aclEntry is an entry of a POSIX ACL xattr.
+type aclEntry struct {
+	tag  uint16
+	perm uint16
+	id   uint32
+}
+
+// aclXattr returns the POSIX ACL xattr value containing the given entries.
+func aclXattr(entries ...aclEntry) string {
+	value := make([]byte, aclHeaderSize+len(entries)*aclEntrySize)
+	binary.LittleEndian.PutUint32(value, aclXattrVersion)
+	for idx, entry := range entries {
+		off := aclHeaderSize + idx*aclEntrySize
+		binary.LittleEndian.PutUint16(value[off:], entry.tag)
+		binary.LittleEndian.PutUint16(value[off+2:], entry.perm)
+		binary.LittleEndian.PutUint32(value[off+4:], entry.id)
+	}
+	return string(value)
+}
+
+// capXattr returns a file capability xattr value with the given revision (and
+// root id, for version 3 file capabilities).
+func capXattr(revision uint32, rootID uint32) string {
+	size := 20
+	if revision == vfsCapRevision3 {
+		size = vfsCapV3Size
+	}
+	value := make([]byte, size)
+	binary.LittleEndian.PutUint32(value, revision|0x1)
+	// CAP_NET_BIND_SERVICE in the permitted set.
+	binary.LittleEndian.PutUint32(value[4:], 1<<10)
+	if revision == vfsCapRevision3 {
+		binary.LittleEndian.PutUint32(value[vfsCapRootIDOffset:], rootID)
+	}
+	return string(value)
+}
+
+const aclUndefinedID = 0xffffffff
+
+func TestMapHeaderXattrs(t *testing.T) {
+	mapOptions := MapOptions{
+		UIDMappings: []rspec.IDMapping{{HostID: 100000, ContainerID: 0, Size: 65536}},
+		GIDMappings: []rspec.IDMapping{{HostID: 200000, ContainerID: 0, Size: 65536}},
+	}
+
+	// Only the ACL_USER and ACL_GROUP entries and the root id of v3 file
+	// capabilities contain ids.
+	hostXattrs := map[string]string{
+		xattrACLAccess: aclXattr(
+			aclEntry{0x01, 7, aclUndefinedID},
+			aclEntry{aclTagUser, 6, 101000},
+			aclEntry{0x04, 5, aclUndefinedID},
+			aclEntry{aclTagGroup, 4, 201000},
+			aclEntry{0x10, 7, aclUndefinedID},
+			aclEntry{0x20, 0, aclUndefinedID},
+		),
+		xattrACLDefault: aclXattr(
+			aclEntry{0x01, 7, aclUndefinedID},
+			aclEntry{aclTagUser, 7, 100033},
+		),
+		xattrCapability: capXattr(vfsCapRevision3, 100000),
+		"user.other":    "unchanged",
+	}
+	containerXattrs := map[string]string{
+		xattrACLAccess: aclXattr(
+			aclEntry{0x01, 7, aclUndefinedID},
+			aclEntry{aclTagUser, 6, 1000},
+			aclEntry{0x04, 5, aclUndefinedID},
+			aclEntry{aclTagGroup, 4, 1000},
+			aclEntry{0x10, 7, aclUndefinedID},
+			aclEntry{0x20, 0, aclUndefinedID},
+		),
+		xattrACLDefault: aclXattr(
+			aclEntry{0x01, 7, aclUndefinedID},
+			aclEntry{aclTagUser, 7, 33},
+		),
+		xattrCapability: capXattr(vfsCapRevision3, 0),
+		"user.other":    "unchanged",
+	}
+
+	hdr := &tar.Header{Uid: 100000, Gid: 200000, Xattrs: map[string]string{}}
+	for name, value := range hostXattrs {
+		hdr.Xattrs[name] = value
+	}
+	if err := mapHeader(hdr, mapOptions); err != nil {
+		t.Fatalf("unexpected error in mapHeader: %+v", err)
+	}
+	for name, value := range containerXattrs {
+		if hdr.Xattrs[name] != value {
+			t.Errorf("mapHeader: xattr %s: expected %x, got %x", name, value, hdr.Xattrs[name])
+		}
+	}
+
+	if err := unmapHeader(hdr, mapOptions); err != nil {
+		t.Fatalf("unexpected error in unmapHeader: %+v", err)
+	}
+	for name, value := range hostXattrs {
+		if hdr.Xattrs[name] != value {
+			t.Errorf("unmapHeader: xattr %s: expected %x, got %x", name, value, hdr.Xattrs[name])
+		}
+	}
+}
+
+func TestMapHeaderXattrsUnmappable(t *testing.T) {
+	mapOptions := MapOptions{
+		UIDMappings: []rspec.IDMapping{{HostID: 1000, ContainerID: 0, Size: 1}},
+		GIDMappings: []rspec.IDMapping{{HostID: 1000, ContainerID: 0, Size: 1}},
+	}
+
+	newHeader := func() *tar.Header {
+		return &tar.Header{
+			Uid: 1000,
+			Gid: 1000,
+			Xattrs: map[string]string{
+				xattrACLAccess: aclXattr(aclEntry{aclTagUser, 6, 1234}),
+			},
+		}
+	}
+
+	// Ids which cannot be mapped are an error...
+	if err := mapHeader(newHeader(), mapOptions); err == nil {
+		t.Errorf("mapHeader: expected an error with an unmappable acl entry")
+	}
+	if err := unmapHeader(newHeader(), mapOptions); err == nil {
+		t.Errorf("unmapHeader: expected an error with an unmappable acl entry")
+	}
+
+	// ... unless we're in rootless mode, where they are treated as root.
+	mapOptions.Rootless = true
+	hdr := newHeader()
+	if err := mapHeader(hdr, mapOptions); err != nil {
+		t.Fatalf("unexpected error in rootless mapHeader: %+v", err)
+	}
+	if expected := aclXattr(aclEntry{aclTagUser, 6, 0}); hdr.Xattrs[xattrACLAccess] != expected {
+		t.Errorf("rootless mapHeader: expected %x, got %x", expected, hdr.Xattrs[xattrACLAccess])
+	}
+	hdr = newHeader()
+	if err := unmapHeader(hdr, mapOptions); err != nil {
+		t.Fatalf("unexpected error in rootless unmapHeader: %+v", err)
+	}
+	if expected := aclXattr(aclEntry{aclTagUser, 6, 1000}); hdr.Xattrs[xattrACLAccess] != expected {
+		t.Errorf("rootless unmapHeader: expected %x, got %x", expected, hdr.Xattrs[xattrACLAccess])
+	}
+}
+
+func TestMapXattrIDsInvalid(t *testing.T) {
+	identity := func(id int) (int, error) { return id, nil }
+
+	// Version 2 file capabilities don't contain a root id, so are unchanged.
+	v2 := capXattr(0x02000000, 0)
+	xattrs := map[string]string{xattrCapability: v2}
+	if err := mapXattrIDs("file", xattrs, identity, identity); err != nil {
+		t.Errorf("unexpected error with v2 capability: %+v", err)
+	} else if xattrs[xattrCapability] != v2 {
+		t.Errorf("v2 capability was modified: %x", xattrs[xattrCapability])
+	}
+
+	// Values which cannot be parsed are left unchanged.
+	for _, test := range []struct {
+		name, value string
+	}{
+		{xattrACLAccess, ""},
+		{xattrACLAccess, aclXattr(aclEntry{aclTagUser, 6, 1000})[:10]},
+		{xattrACLDefault, "\x01\x00\x00\x00"},
+		{xattrCapability, "\x00\x00"},
+		{xattrCapability, capXattr(vfsCapRevision3, 0)[:20]},
+	} {
+		xattrs := map[string]string{test.name: test.value}
+		if err := mapXattrIDs("file", xattrs, identity, identity); err != nil {
+			t.Errorf("unexpected error mapping %s=%x: %+v", test.name, test.value, err)
+		} else if xattrs[test.name] != test.value {
+			t.Errorf("malformed %s was modified: expected %x, got %x", test.name, test.value, xattrs[test.name])
+		}
+	}
+}
+
+func TestMapHeaderXattrsNoMappings(t *testing.T) {
+	// Without any mappings, xattrs (even malformed ones) are left alone.
+	acl := aclXattr(aclEntry{aclTagUser, 6, 1234})[:10]
+	hdr := &tar.Header{Uid: 1000, Gid: 1000, Xattrs: map[string]string{xattrACLAccess: acl}}
+	if err := mapHeader(hdr, MapOptions{}); err != nil {
+		t.Fatalf("unexpected error in mapHeader: %+v", err)
+	}
+	if err := unmapHeader(hdr, MapOptions{}); err != nil {
+		t.Fatalf("unexpected error in unmapHeader: %+v", err)
+	}
+	if hdr.Xattrs[xattrACLAccess] != acl {
+		t.Errorf("xattr was modified without mappings: %x", hdr.Xattrs[xattrACLAccess])
+	}
+}
@@ -0,0 +1,86 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package layer
+
+import (
+	"testing"
+)
+
+func TestXattrFilterAllowed(t *testing.T) {
+	for _, test := range []struct {
+		filter  XattrFilter
+		name    string
+		allowed bool
+	}{
+		// Without any filters, only the default exclusions are dropped.
+		{XattrFilter{}, "user.foo", true},
+		{XattrFilter{}, "security.capability", true},
+		{XattrFilter{}, "security.selinux", false},
+		// Exclusions are added to the default ones.
+		{XattrFilter{Exclude: []string{"user.*", "security.ima"}}, "user.foo", false},
+		{XattrFilter{Exclude: []string{"user.*", "security.ima"}}, "security.ima", false},
+		{XattrFilter{Exclude: []string{"user.*", "security.ima"}}, "security.capability", true},
+		{XattrFilter{Exclude: []string{"user.*", "security.ima"}}, "security.selinux", false},
+		{XattrFilter{Exclude: []string{"user.*", "security.ima"}}, "trusted.foo", true},
+		// Inclusions only override the default exclusions, and don't
+		// restrict the other xattrs.
+		{XattrFilter{Include: []string{"security.selinux"}}, "security.selinux", true},
+		{XattrFilter{Include: []string{"security.selinux"}}, "security.capability", true},
+		{XattrFilter{Include: []string{"security.selinux"}}, "user.foo", true},
+		{XattrFilter{Include: []string{"security.*"}}, "security.selinux", true},
+		{XattrFilter{Include: []string{"user.*"}}, "security.selinux", false},
+		{XattrFilter{Include: []string{"*"}}, "security.selinux", true},
+		{XattrFilter{Include: []string{"*"}}, "user.foo", true},
+		// Exclusions take precedence over inclusions.
+		{XattrFilter{Include: []string{"security.*"}, Exclude: []string{"security.ima"}}, "security.ima", false},
+		{XattrFilter{Include: []string{"security.*"}, Exclude: []string{"security.ima"}}, "security.capability", true},
+	} {
+		if got := test.filter.Allowed(test.name); got != test.allowed {
+			t.Errorf("%v.Allowed(%q): expected %v, got %v", test.filter, test.name, test.allowed, got)
+		}
+	}
+}
+
+func TestXattrFilterValidate(t *testing.T) {
+	// Validate must not modify the filters it is given.
+	include := make([]string, 1, 2)
+	include[0] = "security.selinux"
+	filter := XattrFilter{Include: include, Exclude: []string{"user.*"}}
+	if err := filter.Validate(); err != nil {
+		t.Errorf("Validate(%v): unexpected error: %v", filter, err)
+	}
+	if extra := include[:2][1]; extra != "" {
+		t.Errorf("Validate(%v): modified the backing array of Include: %q", filter, extra)
+	}
+
+	for _, test := range []struct {
+		filter XattrFilter
+		valid  bool
+	}{
+		{XattrFilter{}, true},
+		{XattrFilter{Include: []string{"security.capability"}, Exclude: []string{"user.*"}}, true},
+		{XattrFilter{Include: []string{""}}, false},
+		{XattrFilter{Exclude: []string{"user.[foo"}}, false},
+	} {
+		err := test.filter.Validate()
+		if test.valid && err != nil {
+			t.Errorf("Validate(%v): unexpected error: %v", test.filter, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("Validate(%v): expected an error", test.filter)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package progress
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/docker/go-units"
+)
+
+// eventKey identifies the operation an event belongs to.
+type eventKey struct {
+	operation string
+	layer     int
+	digest    string
+}
+
+func keyOf(event Event) eventKey {
+	return eventKey{
+		operation: event.Operation,
+		layer:     event.Layer,
+		digest:    event.Digest.String(),
+	}
+}
+
+// throttle decides whether an event should be displayed, so that an operation
+// is displayed at most once per interval (but its first and last events are
+// always displayed).
+type throttle struct {
+	interval time.Duration
+	last     map[eventKey]time.Time
+
+	// now is time.Now, and is only changed for testing.
+	now func() time.Time
+}
+
+func (t *throttle) allow(event Event) bool {
+	key := keyOf(event)
+	now := t.now()
+	if last, ok := t.last[key]; ok && !event.Done && now.Sub(last) < t.interval {
+		return false
+	}
+	if event.Done {
+		delete(t.last, key)
+	} else {
+		t.last[key] = now
+	}
+	return true
+}
+
+// TerminalReporter is a Reporter which displays the progress of the current
+// operation on a single line of a terminal, which is redrawn as progress is
+// made. A new line is started for each operation once it is done.
+type TerminalReporter struct {
+	mu       sync.Mutex
+	w        io.Writer
+	throttle throttle
+
+	// drawn is whether there is an unfinished progress line on the terminal.
+	drawn bool
+}
+
+// NewTerminalReporter creates a TerminalReporter writing to w (which should be
+// a terminal, as the display uses carriage returns and ANSI escape codes).
+func NewTerminalReporter(w io.Writer) *TerminalReporter {
+	return &TerminalReporter{
+		w: w,
+		throttle: throttle{
+			interval: 100 * time.Millisecond,
+			last:     map[eventKey]time.Time{},
+			now:      time.Now,
+		},
+	}
+}
+
+// Report redraws the progress line.
+func (r *TerminalReporter) Report(event Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.throttle.allow(event) {
+		return
+	}
+	line := "\r\x1b[K" + formatEvent(event)
+	if event.Done {
+		line += "\n"
+	}
+	r.drawn = !event.Done
+	io.WriteString(r.w, line)
+}
+
+// Close ends the current progress line (if there is one), so that any
+// further output starts on a new line. This is needed if an operation failed
+// before it was done.
+func (r *TerminalReporter) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.drawn {
+		r.drawn = false
+		_, err := io.WriteString(r.w, "\n")
+		return err
+	}
+	return nil
+}
+
+// formatEvent returns a human-readable description of an event.
+func formatEvent(event Event) string {
+	var buf bytes.Buffer
+	buf.WriteString(event.Operation)
+	if event.Layer >= 0 {
+		fmt.Fprintf(&buf, " layer %d", event.Layer)
+	}
+	if event.Digest != "" {
+		hex := event.Digest.Hex()
+		if len(hex) > 12 {
+			hex = hex[:12]
+		}
+		fmt.Fprintf(&buf, " (%s)", hex)
+	}
+	fmt.Fprintf(&buf, ": %s", units.HumanSize(float64(event.Bytes)))
+	if event.Total > 0 {
+		fmt.Fprintf(&buf, " / %s (%d%%)", units.HumanSize(float64(event.Total)), 100*event.Bytes/event.Total)
+	}
+	if event.Entries > 0 {
+		fmt.Fprintf(&buf, ", %d entries", event.Entries)
+	}
+	if event.Done {
+		buf.WriteString(", done")
+	}
+	return buf.String()
+}
+
+// JSONReporter is a Reporter which writes events as lines of JSON, for
+// consumption by other programs. To avoid flooding the output, the events of
+// an operation are written at most once per interval (though the first and
+// last events of each operation are always written).
+type JSONReporter struct {
+	mu       sync.Mutex
+	enc      *json.Encoder
+	throttle throttle
+}
+
+// NewJSONReporter creates a JSONReporter writing to w, writing the events of
+// each operation at most once per interval.
+func NewJSONReporter(w io.Writer, interval time.Duration) *JSONReporter {
+	return &JSONReporter{
+		enc: json.NewEncoder(w),
+		throttle: throttle{
+			interval: interval,
+			last:     map[eventKey]time.Time{},
+			now:      time.Now,
+		},
+	}
+}
+
+// Report writes the event, unless an event for the same operation was written
+// less than the reporter's interval ago.
+func (r *JSONReporter) Report(event Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.throttle.allow(event) {
+		return
+	}
+	r.enc.Encode(event)
+}
+
+// Close is a no-op, and is only provided for symmetry with TerminalReporter.
+func (r *JSONReporter) Close() error {
+	return nil
+}
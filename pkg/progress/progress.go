@@ -0,0 +1,118 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package progress provides a way for long-running operations (such as
+// unpacking a layer or writing a blob) to report how far along they are, and
+// implementations of Reporter which display that progress to a user.
+package progress
+
+import (
+	"io"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// Event describes the progress of an operation on a single layer or blob.
+// Events for the same operation are reported with increasing values of Bytes
+// and Entries, and the last event of a successful operation has Done set.
+type Event struct {
+	// Operation is a short name for the operation, such as "unpack".
+	Operation string `json:"operation"`
+
+	// Layer is the index of the layer in the image manifest, or -1 if the
+	// operation isn't on a layer of an image.
+	Layer int `json:"layer"`
+
+	// Digest is the digest of the blob being processed, if it is known.
+	Digest digest.Digest `json:"digest,omitempty"`
+
+	// Bytes is the number of bytes processed so far.
+	Bytes int64 `json:"bytes"`
+
+	// Total is the expected value of Bytes once the operation is complete, or
+	// zero if it isn't known in advance.
+	Total int64 `json:"total,omitempty"`
+
+	// Entries is the number of tar entries processed so far (if the operation
+	// processes tar entries).
+	Entries int64 `json:"entries,omitempty"`
+
+	// Done is set for the last event of an operation.
+	Done bool `json:"done,omitempty"`
+}
+
+// Reporter is implemented by consumers of progress events. Report may be
+// called from goroutines other than the one that started the operation, but
+// calls for a single operation are never concurrent. Implementations must not
+// block for long, because they are called in the middle of the operation.
+type Reporter interface {
+	Report(event Event)
+}
+
+// ReporterFunc is an adapter to allow the use of ordinary functions as a
+// Reporter.
+type ReporterFunc func(event Event)
+
+// Report calls f(event).
+func (f ReporterFunc) Report(event Event) {
+	f(event)
+}
+
+// Report reports the given event to reporter, unless reporter is nil. This
+// allows operations to treat a nil Reporter as "don't report progress".
+func Report(reporter Reporter, event Event) {
+	if reporter != nil {
+		reporter.Report(event)
+	}
+}
+
+// reader is the io.Reader returned by NewReader.
+type reader struct {
+	reader   io.Reader
+	reporter Reporter
+	event    Event
+}
+
+// NewReader returns an io.Reader that reads from r, and reports the given
+// event (with Bytes set to the number of bytes read so far) to reporter after
+// each read. Done is set once r returns io.EOF. This is intended to be used to
+// report the progress of callers of io.Reader-consuming APIs, such as
+// cas.Engine.PutBlob. If reporter is nil, r is returned unchanged.
+func NewReader(r io.Reader, reporter Reporter, event Event) io.Reader {
+	if reporter == nil {
+		return r
+	}
+	return &reader{
+		reader:   r,
+		reporter: reporter,
+		event:    event,
+	}
+}
+
+// Read reads from the underlying reader.
+func (r *reader) Read(p []byte) (int, error) {
+	if r.event.Done {
+		return 0, io.EOF
+	}
+	n, err := r.reader.Read(p)
+	r.event.Bytes += int64(n)
+	if n > 0 || err == io.EOF {
+		r.event.Done = err == io.EOF
+		r.reporter.Report(r.event)
+	}
+	return n, err
+}
@@ -0,0 +1,150 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package progress
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestNewReader(t *testing.T) {
+	var events []Event
+	reporter := ReporterFunc(func(event Event) {
+		events = append(events, event)
+	})
+
+	data := "some data to read"
+	r := NewReader(iotest.OneByteReader(strings.NewReader(data)), reporter, Event{Operation: "test", Layer: 3})
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("unexpected error reading: %+v", err)
+	}
+	if string(got) != data {
+		t.Errorf("unexpected data: expected %q, got %q", data, got)
+	}
+
+	if len(events) != len(data)+1 {
+		t.Fatalf("expected %d events, got %d", len(data)+1, len(events))
+	}
+	for idx, event := range events {
+		expected := Event{Operation: "test", Layer: 3, Bytes: int64(idx + 1)}
+		if idx == len(data) {
+			expected.Bytes = int64(len(data))
+			expected.Done = true
+		}
+		if event != expected {
+			t.Errorf("unexpected event %d: expected %+v, got %+v", idx, expected, event)
+		}
+	}
+
+	// Reading again must not report another event.
+	if n, err := r.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("expected EOF after done, got %d %v", n, err)
+	}
+	if len(events) != len(data)+1 {
+		t.Errorf("unexpected event after done: %+v", events[len(events)-1])
+	}
+
+	// A nil reporter doesn't wrap the reader.
+	sr := strings.NewReader(data)
+	if r := NewReader(sr, nil, Event{}); r != io.Reader(sr) {
+		t.Errorf("expected nil reporter to return the original reader")
+	}
+}
+
+func TestJSONReporter(t *testing.T) {
+	var buf bytes.Buffer
+	reporter := NewJSONReporter(&buf, time.Second)
+	now := time.Unix(1000, 0)
+	reporter.throttle.now = func() time.Time { return now }
+
+	for _, event := range []Event{
+		{Operation: "a", Layer: 0, Bytes: 1},               // first event for a
+		{Operation: "a", Layer: 0, Bytes: 2},               // throttled
+		{Operation: "a", Layer: 1, Bytes: 1},               // first event for another layer
+		{Operation: "a", Layer: 0, Bytes: 3, Done: true},   // done is always written
+		{Operation: "b", Layer: -1, Bytes: 1, Entries: 10}, // first event for b
+	} {
+		reporter.Report(event)
+	}
+	now = now.Add(2 * time.Second)
+	reporter.Report(Event{Operation: "b", Layer: -1, Bytes: 2, Entries: 20})
+
+	var got []Event
+	dec := json.NewDecoder(&buf)
+	for {
+		var event Event
+		if err := dec.Decode(&event); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("unexpected error decoding events: %+v", err)
+		}
+		got = append(got, event)
+	}
+
+	expected := []Event{
+		{Operation: "a", Layer: 0, Bytes: 1},
+		{Operation: "a", Layer: 1, Bytes: 1},
+		{Operation: "a", Layer: 0, Bytes: 3, Done: true},
+		{Operation: "b", Layer: -1, Bytes: 1, Entries: 10},
+		{Operation: "b", Layer: -1, Bytes: 2, Entries: 20},
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("expected %d events, got %d: %+v", len(expected), len(got), got)
+	}
+	for idx := range expected {
+		if got[idx] != expected[idx] {
+			t.Errorf("unexpected event %d: expected %+v, got %+v", idx, expected[idx], got[idx])
+		}
+	}
+}
+
+func TestTerminalReporter(t *testing.T) {
+	var buf bytes.Buffer
+	reporter := NewTerminalReporter(&buf)
+
+	reporter.Report(Event{Operation: "unpack", Layer: 2, Digest: "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", Bytes: 500, Total: 1000, Entries: 7})
+	if expected := "\r\x1b[Kunpack layer 2 (0123456789ab): 500 B / 1 kB (50%), 7 entries"; buf.String() != expected {
+		t.Errorf("unexpected output: expected %q, got %q", expected, buf.String())
+	}
+
+	// An unfinished line is terminated by Close.
+	buf.Reset()
+	if err := reporter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "\n" {
+		t.Errorf("expected Close to end the line, got %q", buf.String())
+	}
+
+	// Done ends the line itself.
+	buf.Reset()
+	reporter.Report(Event{Operation: "repack", Layer: -1, Bytes: 2000, Done: true})
+	if err := reporter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "\r\x1b[Krepack: 2 kB, done\n"; buf.String() != expected {
+		t.Errorf("unexpected output: expected %q, got %q", expected, buf.String())
+	}
+}
@@ -85,7 +85,7 @@ func Lsetxattr(path, name string, value []byte, flags int) error {
 		uintptr(flags),                     //.   int flags);
 		0)
 	if err != 0 {
-		return errors.Wrapf(err, "lsetxattr(%s, %s, %s, %d): %s", path, name, value, flags)
+		return errors.Wrapf(err, "lsetxattr(%s, %s, %s, %d)", path, name, value, flags)
 	}
 	return nil
 }
@@ -0,0 +1,86 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_image
+}
+
+@test "umoci convert" {
+	BUNDLE_A="$(setup_bundle)"
+	BUNDLE_B="$(setup_bundle)"
+
+	image-verify "${IMAGE}"
+
+	# Get the original configuration.
+	manifest="$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}" | sed 's/:/\//')"
+	config="$(jq -SMr '.config.digest' "${IMAGE}/blobs/$manifest")"
+	nlayers="$(jq -SMr '.layers | length' "${IMAGE}/blobs/$manifest")"
+
+	# Convert the image to zstd.
+	umoci convert --image "${IMAGE}:${TAG}" --tag "${TAG}-zstd" --compress=zstd
+	[ "$status" -eq 0 ]
+
+	# Every layer must be zstd compressed, with the same config.
+	manifest="$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}-zstd" | sed 's/:/\//')"
+	[[ "$(jq -SMr '.config.digest' "${IMAGE}/blobs/$manifest")" == "$config" ]]
+	[[ "$(jq -SMr '.layers | length' "${IMAGE}/blobs/$manifest")" == "$nlayers" ]]
+	[[ "$(jq -SMr '[.layers[].mediaType | select(endswith("+zstd") | not)] | length' "${IMAGE}/blobs/$manifest")" == "0" ]]
+
+	# Convert it back to uncompressed layers, overwriting the tag.
+	umoci convert --image "${IMAGE}:${TAG}-zstd" --compress=none
+	[ "$status" -eq 0 ]
+
+	# The layer digests must now match the diffids.
+	manifest="$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}-zstd" | sed 's/:/\//')"
+	[[ "$(jq -SMr '.config.digest' "${IMAGE}/blobs/$manifest")" == "$config" ]]
+	layers="$(jq -SMr '[.layers[].digest] | join(" ")' "${IMAGE}/blobs/$manifest")"
+	diffids="$(jq -SMr '.rootfs.diff_ids | join(" ")' "${IMAGE}/blobs/$(echo "$config" | sed 's/:/\//')")"
+	[[ "$layers" == "$diffids" ]]
+	image-verify "${IMAGE}"
+
+	# Both images must unpack to the same rootfs.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+	umoci unpack --image "${IMAGE}:${TAG}-zstd" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+	gomtree -p "$BUNDLE_B/rootfs" -f "$BUNDLE_A"/sha256_*.mtree
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+}
+
+@test "umoci convert [invalid arguments]" {
+	umoci convert
+	[ "$status" -ne 0 ]
+
+	umoci convert --image "${IMAGE}:${TAG}" --compress=lz4
+	[ "$status" -ne 0 ]
+
+	umoci convert --image "${IMAGE}:${TAG}" too many arguments
+	[ "$status" -ne 0 ]
+
+	umoci convert --image "${IMAGE}:${TAG}-nonexistent" --tag "${TAG}-new"
+	[ "$status" -ne 0 ]
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -ne 0 ]
+}
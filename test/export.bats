@@ -0,0 +1,90 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_image
+}
+
+@test "umoci export" {
+	BUNDLE="$(setup_bundle)"
+
+	image-verify "${IMAGE}"
+
+	# Unpack the image for comparison.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Export the image, and compare it with the unpacked rootfs.
+	EXPORT="$(mktemp -d --tmpdir="$BATS_TMPDIR" umoci-integration-export.XXXXXXXX)"
+	umoci export --image "${IMAGE}:${TAG}" --output "$EXPORT/rootfs.tar.gz" --compress=gzip
+	[ "$status" -eq 0 ]
+
+	mkdir "$EXPORT/rootfs"
+	sane_run tar -xzf "$EXPORT/rootfs.tar.gz" -C "$EXPORT/rootfs"
+	[ "$status" -eq 0 ]
+	sane_run diff -r --no-dereference "$BUNDLE/rootfs" "$EXPORT/rootfs"
+	[ "$status" -eq 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci export [whiteout]" {
+	BUNDLE="$(setup_bundle)"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Remove a directory and repack.
+	rm -rf "$BUNDLE/rootfs/etc"
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	EXPORT="$(mktemp -d --tmpdir="$BATS_TMPDIR" umoci-integration-export.XXXXXXXX)"
+	umoci export --image "${IMAGE}:${TAG}-new" -o "$EXPORT/rootfs.tar"
+	[ "$status" -eq 0 ]
+
+	# Neither the directory nor the whiteout may be in the archive.
+	sane_run tar -tf "$EXPORT/rootfs.tar"
+	[ "$status" -eq 0 ]
+	! echo "$output" | grep -E '(^|/)etc(/|$)'
+	! echo "$output" | grep '\.wh\.'
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci export [invalid arguments]" {
+	umoci export --image "${IMAGE}:${TAG}" --compress=none --compress-level=3 -o "$BATS_TMPDIR/umoci-integration-export.tar"
+	[ "$status" -ne 0 ]
+
+	umoci export --image "${IMAGE}:${TAG}" --include etc -o "$BATS_TMPDIR/umoci-integration-export.tar"
+	[ "$status" -ne 0 ]
+
+	umoci export --image "${IMAGE}:${TAG}" extra
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
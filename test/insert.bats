@@ -0,0 +1,104 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_image
+}
+
+@test "umoci insert" {
+	BUNDLE="$(setup_bundle)"
+
+	image-verify "${IMAGE}"
+
+	# Create some files to insert.
+	INSERTDIR="$(mktemp -d --tmpdir="$BATS_TMPDIR" umoci-integration-insert.XXXXXXXX)"
+	echo "inserted file" > "$INSERTDIR/file"
+	mkdir -p "$INSERTDIR/dir/sub"
+	echo "nested file" > "$INSERTDIR/dir/sub/nested"
+	ln -s ../file "$INSERTDIR/dir/link"
+
+	manifest="$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}" | sed 's/:/\//')"
+	nlayers="$(jq -SMr '.layers | length' "${IMAGE}/blobs/$manifest")"
+
+	# Insert a file and a directory.
+	umoci insert --image "${IMAGE}:${TAG}" --tag "${TAG}-insert" "$INSERTDIR/file" /usr/share/inserted
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	umoci insert --image "${IMAGE}:${TAG}-insert" --uid 1234 --gid 5678 "$INSERTDIR/dir" /opt/inserted
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Insert a tar archive from stdin.
+	tar -cf "$INSERTDIR/archive.tar" -C "$INSERTDIR/dir" .
+	umoci insert --image "${IMAGE}:${TAG}-insert" - /srv/archive < "$INSERTDIR/archive.tar"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Each insert adds a single layer and history entry.
+	manifest="$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}-insert" | sed 's/:/\//')"
+	[[ "$(jq -SMr '.layers | length' "${IMAGE}/blobs/$manifest")" == "$((nlayers + 3))" ]]
+	umoci stat --image "${IMAGE}:${TAG}-insert" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.history[-1].created_by')" == "umoci insert" ]]
+
+	# The original tag is left alone.
+	manifest="$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}" | sed 's/:/\//')"
+	[[ "$(jq -SMr '.layers | length' "${IMAGE}/blobs/$manifest")" == "$nlayers" ]]
+
+	umoci unpack --image "${IMAGE}:${TAG}-insert" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	[[ "$(cat "$BUNDLE/rootfs/usr/share/inserted")" == "inserted file" ]]
+	[[ "$(cat "$BUNDLE/rootfs/opt/inserted/sub/nested")" == "nested file" ]]
+	[[ "$(readlink "$BUNDLE/rootfs/opt/inserted/link")" == "../file" ]]
+	[[ "$(cat "$BUNDLE/rootfs/srv/archive/sub/nested")" == "nested file" ]]
+	[[ "$(readlink "$BUNDLE/rootfs/srv/archive/link")" == "../file" ]]
+
+	# Ownership overrides are applied to every inserted path.
+	if [[ "$(id -u)" == 0 ]]; then
+		[[ "$(stat -c '%u:%g' "$BUNDLE/rootfs/opt/inserted")" == "1234:5678" ]]
+		[[ "$(stat -c '%u:%g' "$BUNDLE/rootfs/opt/inserted/sub/nested")" == "1234:5678" ]]
+	fi
+
+	# The rest of the image is unchanged.
+	[ -d "$BUNDLE/rootfs/etc" ]
+}
+
+@test "umoci insert [invalid arguments]" {
+	umoci insert
+	[ "$status" -ne 0 ]
+
+	umoci insert --image "${IMAGE}:${TAG}" /nonexistent
+	[ "$status" -ne 0 ]
+
+	umoci insert --image "${IMAGE}:${TAG}" /nonexistent /target
+	[ "$status" -ne 0 ]
+
+	umoci insert --image "${IMAGE}:${TAG}" --uid -1 "$BATS_TEST_FILENAME" /target
+	[ "$status" -ne 0 ]
+
+	umoci insert --image "${IMAGE}:${TAG}" too many arguments
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
@@ -443,6 +443,65 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci {un,re}pack --xattr-include --xattr-exclude" {
+	BUNDLE_A="$(setup_bundle)"
+	BUNDLE_B="$(setup_bundle)"
+	BUNDLE_C="$(setup_bundle)"
+
+	image-verify "${IMAGE}"
+
+	# Unpack the image, dropping the user.drop.* xattrs.
+	umoci unpack --image "${IMAGE}:${TAG}" --xattr-exclude 'user.drop.*' "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	# The filters are saved in the bundle.
+	sane_run grep -F 'user.drop.*' "$BUNDLE_A/umoci.json"
+	[ "$status" -eq 0 ]
+
+	# Set some xattrs, which are only included if they pass the filters.
+	chmod +w "$BUNDLE_A/rootfs/etc" && xattr -w user.keep     kept    "$BUNDLE_A/rootfs/etc"
+	chmod +w "$BUNDLE_A/rootfs/etc" && xattr -w user.drop.foo dropped "$BUNDLE_A/rootfs/etc"
+	chmod +w "$BUNDLE_A/rootfs/etc" && xattr -w user.extra    dropped "$BUNDLE_A/rootfs/etc"
+
+	# Repack the image, also dropping user.extra.
+	umoci repack --image "${IMAGE}:${TAG}-new" --xattr-exclude user.extra "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Unpack the image again.
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	sane_run xattr -p user.keep "$BUNDLE_B/rootfs/etc"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "kept" ]]
+	sane_run xattr -p user.drop.foo "$BUNDLE_B/rootfs/etc"
+	[[ "$output" == *"No such xattr: user.drop.foo"* ]]
+	sane_run xattr -p user.extra "$BUNDLE_B/rootfs/etc"
+	[[ "$output" == *"No such xattr: user.extra"* ]]
+
+	# Including SELinux labels doesn't drop any other xattrs.
+	umoci unpack --image "${IMAGE}:${TAG}-new" --xattr-include security.selinux "$BUNDLE_C"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_C"
+
+	sane_run xattr -p user.keep "$BUNDLE_C/rootfs/etc"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "kept" ]]
+
+	# --update must use the same filters.
+	umoci unpack --image "${IMAGE}:${TAG}-new" --update --xattr-include 'user.*' "$BUNDLE_C"
+	[ "$status" -ne 0 ]
+
+	# Invalid filters are rejected.
+	umoci unpack --image "${IMAGE}:${TAG}" --xattr-exclude 'user.[' "$(setup_bundle)"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci {un,re}pack [unicode]" {
 	BUNDLE_A="$(setup_bundle)"
 	BUNDLE_B="$(setup_bundle)"
@@ -498,3 +557,287 @@ function teardown() {
 
 	image-verify "${IMAGE}"
 }
+
+@test "umoci repack --compress" {
+	BUNDLE_A="$(setup_bundle)"
+
+	image-verify "${IMAGE}"
+
+	# Unpack the image.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	# Make some small change.
+	echo "compressed file" > "$BUNDLE_A/rootfs/compressed_file"
+
+	for compress in none gzip zstd; do
+		BUNDLE_B="$(setup_bundle)"
+
+		# Repack the image using the compression algorithm.
+		umoci repack --image "${IMAGE}:${TAG}-$compress" --compress="$compress" --compress-level=0 "$BUNDLE_A"
+		[ "$status" -eq 0 ]
+
+		# Check the media type of the new layer.
+		manifest="$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}-$compress" | sed 's/:/\//')"
+		mediatype="$(jq -SMr '.layers[-1].mediaType' "${IMAGE}/blobs/$manifest")"
+		case "$compress" in
+			none) [[ "$mediatype" == "application/vnd.oci.image.layer.v1.tar" ]] ;;
+			*) [[ "$mediatype" == "application/vnd.oci.image.layer.v1.tar+$compress" ]] ;;
+		esac
+
+		# Make sure it can be unpacked.
+		umoci unpack --image "${IMAGE}:${TAG}-$compress" "$BUNDLE_B"
+		[ "$status" -eq 0 ]
+		bundle-verify "$BUNDLE_B"
+		[[ "$(cat "$BUNDLE_B/rootfs/compressed_file")" == "compressed file" ]]
+	done
+
+	# Invalid algorithms and levels must be rejected.
+	umoci repack --image "${IMAGE}:${TAG}-bad" --compress=lz4 "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+	umoci repack --image "${IMAGE}:${TAG}-bad" --compress=gzip --compress-level=10 "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+	umoci repack --image "${IMAGE}:${TAG}-bad" --compress=none --compress-level=1 "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+	umoci stat --image "${IMAGE}:${TAG}-bad" --json
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci repack [reproducible]" {
+	BUNDLE_A="$(setup_bundle)"
+	BUNDLE_B="$(setup_bundle)"
+
+	image-verify "${IMAGE}"
+
+	# Make the same changes to two separate bundles, at different times.
+	for bundle in "$BUNDLE_A" "$BUNDLE_B"; do
+		umoci unpack --image "${IMAGE}:${TAG}" "$bundle"
+		[ "$status" -eq 0 ]
+		bundle-verify "$bundle"
+
+		echo "reproducible file" > "$bundle/rootfs/reproducible_file"
+		rm -rf "$bundle/rootfs/etc"
+		sleep 1s
+	done
+
+	# Repacking with SOURCE_DATE_EPOCH or --clamp-mtime results in identical
+	# images.
+	SOURCE_DATE_EPOCH=1500000000 umoci repack --image "${IMAGE}:${TAG}-a" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	umoci repack --image "${IMAGE}:${TAG}-b" --clamp-mtime 2017-07-14T02:40:00Z "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	digestA="$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}-a")"
+	digestB="$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}-b")"
+	[[ "$digestA" == "$digestB" ]]
+
+	# The history entry uses the fixed timestamp.
+	umoci stat --image "${IMAGE}:${TAG}-a" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.history[-1].created')" == "2017-07-14T02:40:00Z" ]]
+
+	# Invalid timestamps are rejected.
+	umoci repack --image "${IMAGE}:${TAG}-bad" --clamp-mtime yesterday "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+	SOURCE_DATE_EPOCH=yesterday umoci repack --image "${IMAGE}:${TAG}-bad" "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --mask-path" {
+	BUNDLE_A="$(setup_bundle)"
+	BUNDLE_B="$(setup_bundle)"
+
+	image-verify "${IMAGE}"
+
+	# Unpack the image.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	# Modify and remove files, some of which are masked.
+	mkdir -p "$BUNDLE_A/rootfs/var/cache"
+	echo "cached" > "$BUNDLE_A/rootfs/var/cache/file"
+	echo "kept" > "$BUNDLE_A/rootfs/kept_file"
+	chmod +w "$BUNDLE_A/rootfs/etc/." && rm -rf "$BUNDLE_A/rootfs/etc"
+	chmod +w "$BUNDLE_A/rootfs/usr/bin/." && rm "$BUNDLE_A/rootfs/usr/bin/env"
+
+	# Mask /etc in umoci.json, and the rest with --mask-path.
+	jq -SMc '.mask_paths = ["/etc"]' "$BUNDLE_A/umoci.json" > "$BUNDLE_A/umoci.json.new"
+	mv "$BUNDLE_A/umoci.json.new" "$BUNDLE_A/umoci.json"
+	umoci repack --image "${IMAGE}:${TAG}-new" --mask-path /var/cache --mask-path /usr/bin/env "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Unpack it again.
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	# Only the unmasked changes were included.
+	[ -f "$BUNDLE_B/rootfs/kept_file" ]
+	! [ -e "$BUNDLE_B/rootfs/var/cache/file" ]
+	[ -d "$BUNDLE_B/rootfs/etc" ]
+	[ -e "$BUNDLE_B/rootfs/usr/bin/env" ]
+
+	# Relative masks are rejected.
+	umoci repack --image "${IMAGE}:${TAG}-bad" --mask-path var/cache "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack [stat cache]" {
+	BUNDLE_A="$(setup_bundle)"
+	BUNDLE_B="$(setup_bundle)"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	# A stat cache is stored next to the mtree manifest.
+	[ "$(ls "$BUNDLE_A"/sha256_*.statcache | wc -l)" -eq 1 ]
+
+	# Modify a file without changing its size or mtime.
+	file="$(find "$BUNDLE_A/rootfs" -type f -size +0 | head -n1)"
+	cp -p "$file" "$BUNDLE_A/original"
+	tr '\0-\377' '\1-\377\0' < "$BUNDLE_A/original" > "$file"
+	touch -r "$BUNDLE_A/original" "$file"
+	rm "$BUNDLE_A/original"
+
+	# The change must still be found.
+	umoci repack --no-update-bundle --clamp-mtime 2017-07-14T02:40:00Z --image "${IMAGE}:${TAG}-new" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+	gomtree -p "$BUNDLE_A/rootfs" -f "$BUNDLE_B"/sha256_*.mtree
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	# Without a stat cache (or with --paranoid) every file is hashed, with the
+	# same result.
+	umoci repack --no-update-bundle --clamp-mtime 2017-07-14T02:40:00Z --paranoid --image "${IMAGE}:${TAG}-paranoid" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	rm "$BUNDLE_A"/sha256_*.statcache
+	umoci repack --no-update-bundle --clamp-mtime 2017-07-14T02:40:00Z --image "${IMAGE}:${TAG}-nocache" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	digest="$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}-new")"
+	for tag in "${TAG}-paranoid" "${TAG}-nocache"; do
+		[[ "$(jq -SMr '.digest' "${IMAGE}/refs/${tag}")" == "$digest" ]]
+	done
+}
+
+@test "umoci repack --refresh-config" {
+	BUNDLE_A="$(setup_bundle)"
+	BUNDLE_B="$(setup_bundle)"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	# Modify the runtime configuration.
+	jq -SM '.process.env += ["REFRESH=yes"] | .process.cwd = "/refreshed" | .process.args = ["/bin/echo", "refreshed"] | .process.user.uid = 1234 | .process.user.gid = 5678 | .annotations["com.example.refreshed"] = "yes"' \
+		"$BUNDLE_A/config.json" >"$BATS_TMPDIR/refresh-config.json"
+	mv "$BATS_TMPDIR/refresh-config.json" "$BUNDLE_A/config.json"
+
+	# Without --refresh-config, changes to config.json are ignored.
+	umoci repack --image "${IMAGE}:${TAG}-same" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	umoci stat --image "${IMAGE}:${TAG}-same" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.history[-1].created_by')" != "umoci repack --refresh-config" ]]
+
+	umoci repack --refresh-config --image "${IMAGE}:${TAG}-new" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The changes are applied with their own history entry.
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.history[-1].created_by')" == "umoci repack --refresh-config" ]]
+	[[ "$(echo "$output" | jq -SMr '.history[-1].empty_layer')" == "true" ]]
+
+	# ... and end up in the config.json of new bundles.
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	sane_run jq -SMr '.process.env[]' "$BUNDLE_B/config.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"REFRESH=yes"* ]]
+	sane_run jq -SMr '.process.cwd' "$BUNDLE_B/config.json"
+	[[ "$output" == "/refreshed" ]]
+	sane_run jq -SMr '.process.args | join(" ")' "$BUNDLE_B/config.json"
+	[[ "$output" == "/bin/echo refreshed" ]]
+	sane_run jq -SMr '.process.user.uid' "$BUNDLE_B/config.json"
+	[[ "$output" == "1234" ]]
+	sane_run jq -SMr '.process.user.gid' "$BUNDLE_B/config.json"
+	[[ "$output" == "5678" ]]
+	sane_run jq -SMr '.annotations["com.example.refreshed"]' "$BUNDLE_B/config.json"
+	[[ "$output" == "yes" ]]
+}
+
+@test "umoci repack [incremental]" {
+	BUNDLE_A="$(setup_bundle)"
+	BUNDLE_B="$(setup_bundle)"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+	oldmtree="$(ls "$BUNDLE_A"/sha256_*.mtree)"
+
+	# The first repack includes a large file.
+	dd if=/dev/urandom of="$BUNDLE_A/rootfs/large_file" bs=1M count=1
+	umoci repack --image "${IMAGE}:${TAG}-first" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The bundle now refers to the new image.
+	manifest="$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}-first")"
+	[[ "$(jq -SMr '.from_descriptor.digest' "$BUNDLE_A/umoci.json")" == "$manifest" ]]
+	! [ -e "$oldmtree" ]
+	[ "$(ls "$BUNDLE_A"/sha256_*.mtree | wc -l)" -eq 1 ]
+	[ -f "$BUNDLE_A/${manifest/:/_}.mtree" ]
+	gomtree -p "$BUNDLE_A/rootfs" -f "$BUNDLE_A"/sha256_*.mtree
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	# The second repack only includes the new change.
+	echo "small file" > "$BUNDLE_A/rootfs/small_file"
+	umoci repack --image "${IMAGE}:${TAG}-second" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	manifest="$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}-second" | sed 's/:/\//')"
+	[ "$(jq -SMr '.layers[-1].size' "${IMAGE}/blobs/$manifest")" -lt 10000 ]
+
+	umoci unpack --image "${IMAGE}:${TAG}-second" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+	gomtree -p "$BUNDLE_A/rootfs" -f "$BUNDLE_B"/sha256_*.mtree
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	# With --no-update-bundle, the bundle is left alone.
+	oldmeta="$(cat "$BUNDLE_A/umoci.json")"
+	echo "another file" > "$BUNDLE_A/rootfs/another_file"
+	umoci repack --no-update-bundle --image "${IMAGE}:${TAG}-third" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	[[ "$(cat "$BUNDLE_A/umoci.json")" == "$oldmeta" ]]
+	[ "$(ls "$BUNDLE_A"/sha256_*.mtree | wc -l)" -eq 1 ]
+}
@@ -0,0 +1,111 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_image
+}
+
+@test "umoci squash" {
+	BUNDLE_A="$(setup_bundle)"
+	BUNDLE_B="$(setup_bundle)"
+	BUNDLE_C="$(setup_bundle)"
+
+	image-verify "${IMAGE}"
+
+	# Add two layers on top of the image, which overwrite and remove files.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+	echo "first" > "$BUNDLE_A/rootfs/squash_file"
+	dd if=/dev/zero of="$BUNDLE_A/rootfs/squash_junk" bs=1M count=1
+	umoci repack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+	echo "second" > "$BUNDLE_B/rootfs/squash_file"
+	rm "$BUNDLE_B/rootfs/squash_junk"
+	chmod +w "$BUNDLE_B/rootfs/etc/." && rm -rf "$BUNDLE_B/rootfs/etc"
+	umoci repack --image "${IMAGE}:${TAG}" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	manifest="$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}" | sed 's/:/\//')"
+	nlayers="$(jq -SMr '.layers | length' "${IMAGE}/blobs/$manifest")"
+
+	# Squash the two new layers.
+	umoci squash --image "${IMAGE}:${TAG}" --tag "${TAG}-squashed" --layers "$((nlayers - 2)):"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The new layer replaces both layers, and its history entry replaces
+	# theirs.
+	manifest="$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}-squashed" | sed 's/:/\//')"
+	[[ "$(jq -SMr '.layers | length' "${IMAGE}/blobs/$manifest")" == "$((nlayers - 1))" ]]
+	config="$(jq -SMr '.config.digest' "${IMAGE}/blobs/$manifest" | sed 's/:/\//')"
+	[[ "$(jq -SMr '.rootfs.diff_ids | length' "${IMAGE}/blobs/$config")" == "$((nlayers - 1))" ]]
+	umoci stat --image "${IMAGE}:${TAG}-squashed" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.history[-1].created_by')" == "umoci squash" ]]
+	[[ "$(echo "$output" | jq -SMr '[.history[] | select(.empty_layer | not)] | length')" == "$((nlayers - 1))" ]]
+
+	# The removed file doesn't take up any space in the squashed layer.
+	[ "$(jq -SMr '.layers[-1].size' "${IMAGE}/blobs/$manifest")" -lt 10000 ]
+
+	# The squashed image must unpack to the same rootfs.
+	umoci unpack --image "${IMAGE}:${TAG}-squashed" "$BUNDLE_C"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_C"
+	gomtree -p "$BUNDLE_B/rootfs" -f "$BUNDLE_C"/sha256_*.mtree
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+	[[ "$(cat "$BUNDLE_C/rootfs/squash_file")" == "second" ]]
+	! [ -e "$BUNDLE_C/rootfs/etc" ]
+
+	# Squashing every layer results in a single layer.
+	umoci squash --image "${IMAGE}:${TAG}-squashed"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	manifest="$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}-squashed" | sed 's/:/\//')"
+	[[ "$(jq -SMr '.layers | length' "${IMAGE}/blobs/$manifest")" == "1" ]]
+}
+
+@test "umoci squash [invalid arguments]" {
+	umoci squash
+	[ "$status" -ne 0 ]
+
+	umoci squash --image "${IMAGE}:${TAG}" --layers 1
+	[ "$status" -ne 0 ]
+
+	umoci squash --image "${IMAGE}:${TAG}" --layers 2:1
+	[ "$status" -ne 0 ]
+
+	umoci squash --image "${IMAGE}:${TAG}" --layers 0:1000
+	[ "$status" -ne 0 ]
+
+	umoci squash --image "${IMAGE}:${TAG}" too many arguments
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
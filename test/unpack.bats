@@ -118,4 +118,173 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci unpack --update" {
+	BUNDLE_A="$(setup_bundle)"
+	BUNDLE_B="$(setup_bundle)"
+
+	image-verify "${IMAGE}"
+
+	# Unpack the image twice.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	# Create a new layer in one bundle.
+	echo "new file" > "$BUNDLE_A/rootfs/newfile"
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Update the other bundle to the new image.
+	umoci unpack --image "${IMAGE}:${TAG}-new" --update "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+	[ -f "$BUNDLE_B/rootfs/newfile" ]
+	[[ "$(cat "$BUNDLE_B/rootfs/newfile")" == "new file" ]]
+
+	# Only the new mtree manifest should remain, and it must match.
+	[ "$(ls "$BUNDLE_B"/sha256_*.mtree | wc -l)" -eq 1 ]
+	gomtree -p "$BUNDLE_B/rootfs" -f "$BUNDLE_B"/sha256_*.mtree
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	# The updated bundle can be updated again (to the same image).
+	umoci unpack --image "${IMAGE}:${TAG}-new" --update "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	# Bundles cannot be updated to an image without the bundle's layers.
+	umoci unpack --image "${IMAGE}:${TAG}" --update "$BUNDLE_B"
+	[ "$status" -ne 0 ]
+
+	# Modified bundles cannot be updated.
+	echo "modified" > "$BUNDLE_B/rootfs/newfile"
+	umoci unpack --image "${IMAGE}:${TAG}-new" --update "$BUNDLE_B"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack [failure leaves no bundle]" {
+	BUNDLE="$(setup_bundle)"
+	rm -rf "$BUNDLE"
+
+	# Corrupt the last layer of the image.
+	manifest="$(jq -r '.digest' "${IMAGE}/refs/${TAG}" | cut -d: -f2)"
+	layer="$(jq -r '.layers[-1].digest' "${IMAGE}/blobs/sha256/$manifest" | cut -d: -f2)"
+	chmod +w "${IMAGE}/blobs/sha256/$layer"
+	echo "corrupted" > "${IMAGE}/blobs/sha256/$layer"
+
+	# Unpacking must fail, without leaving anything behind.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	! [ -e "$BUNDLE" ]
+	[ -z "$(find "$(dirname "$BUNDLE")" -maxdepth 1 -name '.umoci-unpack-*')" ]
+}
+
+@test "umoci unpack --include --exclude" {
+	BUNDLE_A="$(setup_bundle)"
+	BUNDLE_B="$(setup_bundle)"
+
+	image-verify "${IMAGE}"
+
+	# Only unpack /etc, without /etc/group.
+	umoci unpack --image "${IMAGE}:${TAG}" --include /etc --exclude /etc/group "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	[ -e "$BUNDLE_A/rootfs/etc/passwd" ]
+	! [ -e "$BUNDLE_A/rootfs/etc/group" ]
+	! [ -e "$BUNDLE_A/rootfs/bin" ]
+
+	# Repacking must not remove the paths which were not unpacked.
+	echo "new file" > "$BUNDLE_A/rootfs/etc/newfile"
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	[ -e "$BUNDLE_B/rootfs/etc/newfile" ]
+	[ -e "$BUNDLE_B/rootfs/etc/group" ]
+	[ -e "$BUNDLE_B/rootfs/bin/sh" ]
+
+	# Relative filters are not allowed.
+	umoci unpack --image "${IMAGE}:${TAG}" --include etc "$(setup_bundle)"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack [limits]" {
+	BUNDLE="$(setup_bundle)"
+
+	image-verify "${IMAGE}"
+
+	# Each of these limits is exceeded by the test image.
+	umoci unpack --image "${IMAGE}:${TAG}" --max-bytes 1KiB "$BUNDLE"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"maximum total size"* ]]
+	! [ -e "$BUNDLE/rootfs" ]
+
+	umoci unpack --image "${IMAGE}:${TAG}" --max-entries 10 "$BUNDLE"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"maximum entry count"* ]]
+	! [ -e "$BUNDLE/rootfs" ]
+
+	umoci unpack --image "${IMAGE}:${TAG}" --max-path-depth 1 "$BUNDLE"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"maximum path depth"* ]]
+	! [ -e "$BUNDLE/rootfs" ]
+
+	# Invalid limits.
+	umoci unpack --image "${IMAGE}:${TAG}" --max-bytes foo "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	# Generous limits don't affect the unpack.
+	umoci unpack --image "${IMAGE}:${TAG}" --max-bytes 10GiB --max-entries 1000000 --max-path-depth 64 --max-path-length 4096 --max-xattr-size 64KiB --strip-setuid "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# No setuid or setgid files remain.
+	sane_run find "$BUNDLE/rootfs" -perm /6000
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack [progress]" {
+	BUNDLE_A="$(setup_bundle)"
+	BUNDLE_B="$(setup_bundle)"
+	BUNDLE_C="$(setup_bundle)"
+
+	image-verify "${IMAGE}"
+
+	# Each layer reports that it is done.
+	UMOCI_PROGRESS=json umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+	numLayers="$(printf -- '%s\n' "${lines[@]}" | grep '^{' | jq -s 'map(select(.operation == "unpack" and .done)) | length')"
+	[ "$numLayers" -gt 0 ]
+
+	# No progress is reported with --progress=none.
+	UMOCI_PROGRESS=none umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+	[[ "$output" != *'"operation"'* ]]
+
+	# Invalid progress modes are rejected.
+	UMOCI_PROGRESS=foo umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_C"
+	[ "$status" -ne 0 ]
+	! [ -e "$BUNDLE_C/rootfs" ]
+
+	image-verify "${IMAGE}"
+}
+
 # TODO: Add a test using OCI extraction and verify it with go-mtree.